@@ -1,42 +1,75 @@
 package core
 
 import (
+	"bytes"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
+	"sort"
 )
 
+// Write serializes msg to the writer source it is linked to, as a line of
+// JSON (ndjson), a CSV record (csv), or as it is (raw)
 func Write() Spec {
 	return Spec{
 		Name: "write",
 		Inputs: []Pin{
-			Pin{"writer", WRITER},
 			Pin{"msg", ANY},
+			Pin{"format", STRING},
 		},
 		Outputs: []Pin{
-			Pin{"writer", WRITER},
+			Pin{"written", BOOLEAN},
 		},
+		Source: ANY_WRITER,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
 
-			writer, ok := in[0].(io.Writer)
+			format, ok := in[1].(string)
 			if !ok {
-				out[0] = NewError("writer must implement io.Writer")
+				out[0] = NewError("write requires format to be a string")
 				return nil
 			}
 
-			data, err := json.Marshal(in[1])
-			if err != nil {
-				out[0] = NewError("could not marshal msg")
+			var data []byte
+			switch format {
+			case "ndjson":
+				d, err := json.Marshal(in[0])
+				if err != nil {
+					out[0] = NewError("could not marshal msg")
+					return nil
+				}
+				data = append(d, '\n')
+			case "csv":
+				record, err := csvRecord(in[0])
+				if err != nil {
+					out[0] = NewError(err.Error())
+					return nil
+				}
+				var buf bytes.Buffer
+				w := csv.NewWriter(&buf)
+				w.Write(record)
+				w.Flush()
+				data = buf.Bytes()
+			case "raw":
+				msg, ok := in[0].(string)
+				if !ok {
+					out[0] = NewError("write requires a string msg for raw format")
+					return nil
+				}
+				data = []byte(msg)
+			default:
+				out[0] = NewError("write format must be ndjson, csv or raw")
 				return nil
 			}
 
-			_, err = writer.Write(data)
+			_, err := s.(Writer).Write(data)
 			if err != nil {
-				out[0] = NewError("could not write data to writer")
+				out[0] = NewError("could not write data to writer: " + err.Error())
 				return nil
 			}
 
-			out[0] = writer
+			out[0] = true
 
 			return nil
 
@@ -44,6 +77,45 @@ func Write() Spec {
 	}
 }
 
+// csvRecord returns the fields of a CSV record for msg, which is either an
+// array or an object, whose values are written in the order of their keys.
+// Strings are written as they are, and anything else as JSON.
+func csvRecord(msg Message) ([]string, error) {
+	var values []interface{}
+	switch m := msg.(type) {
+	case []interface{}:
+		values = m
+	case map[string]interface{}:
+		keys := []string{}
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			values = append(values, m[k])
+		}
+	default:
+		return nil, errors.New("write requires an array or object msg for csv format")
+	}
+
+	record := make([]string, len(values))
+	for j, v := range values {
+		if s, ok := v.(string); ok {
+			record[j] = s
+			continue
+		}
+		if v == nil {
+			continue
+		}
+		d, err := json.Marshal(v)
+		if err != nil {
+			return nil, errors.New("could not marshal csv field")
+		}
+		record[j] = string(d)
+	}
+	return record, nil
+}
+
 func Close() Spec {
 	return Spec{
 		Name: "close",
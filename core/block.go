@@ -2,6 +2,9 @@ package core
 
 import (
 	"errors"
+	"fmt"
+	"reflect"
+	"sort"
 	"sync"
 	"time"
 )
@@ -11,12 +14,21 @@ func NewBlock(s Spec) *Block {
 	var in []Input
 	var out []Output
 
-	for _, v := range s.Inputs {
+	for i, v := range s.Inputs {
+		trigger := REQUIRED
+		if i < len(s.Triggers) {
+			trigger = s.Triggers[i]
+		}
+		var value *InputValue
+		if d, ok := s.Defaults[RouteIndex(i)]; ok {
+			value = &InputValue{Copy(d)}
+		}
 		in = append(in, Input{
-			Name:  v.Name,
-			Type:  v.Type,
-			Value: nil,
-			C:     make(chan Message, 1),
+			Name:    v.Name,
+			Type:    v.Type,
+			Value:   value,
+			Trigger: trigger,
+			C:       make(chan Message, 1),
 		})
 	}
 
@@ -28,24 +40,33 @@ func NewBlock(s Spec) *Block {
 		})
 	}
 
+	var sourceTypes []SourceType
+	if s.Source != NONE {
+		sourceTypes = append([]SourceType{s.Source}, s.ExtraSources...)
+	}
+
 	return &Block{
 		state: BlockState{
 			make(MessageMap),
 			make(MessageMap),
 			make(MessageMap),
+			make(MessageMap),
 			make(Manifest),
 			false,
 		},
 		routing: BlockRouting{
 			Inputs:        in,
 			Outputs:       out,
+			Sources:       make([]Source, len(sourceTypes)),
 			InterruptChan: make(chan Interrupt),
 		},
-		kernel:     s.Kernel,
-		sourceType: s.Source,
-		Monitor:    make(chan MonitorMessage, 1),
-		lastCrank:  time.Now(),
-		done:       make(chan struct{}),
+		kernel:      s.Kernel,
+		sourceTypes: sourceTypes,
+		variadic:    s.Variadic,
+		reshape:     s.Reshape,
+		Monitor:     make(chan MonitorMessage, 1),
+		lastCrank:   time.Now(),
+		done:        make(chan struct{}),
 	}
 }
 
@@ -98,8 +119,9 @@ func (b *Block) exportInput(id RouteIndex) (*Input, error) {
 		Value: &InputValue{
 			Data: Copy((*b.routing.Inputs[id].Value).Data),
 		},
-		C:    b.routing.Inputs[id].C,
-		Name: b.routing.Inputs[id].Name,
+		C:       b.routing.Inputs[id].C,
+		Name:    b.routing.Inputs[id].Name,
+		Trigger: b.routing.Inputs[id].Trigger,
 	}, nil
 
 }
@@ -142,9 +164,87 @@ func (b *Block) SetInput(id RouteIndex, v *InputValue) error {
 		if _, ok := b.state.inputValues[id]; ok {
 			delete(b.state.inputValues, id)
 		}
+		delete(b.state.latchedValues, id)
 
 		b.routing.Inputs[id].Value = v
 
+		if b.reshape != nil {
+			if pins, ok := b.reshape(id, v); ok {
+				b.setOutputs(pins)
+			}
+		}
+
+		returnVal <- nil
+		return true
+	}
+	return <-returnVal
+}
+
+// setOutputs replaces the block's outputs with the supplied pins. Outputs
+// that keep their index also keep their connections.
+func (b *Block) setOutputs(pins []Pin) {
+	for id := len(pins); id < len(b.routing.Outputs); id++ {
+		delete(b.state.outputValues, RouteIndex(id))
+	}
+
+	outputs := make([]Output, len(pins), len(pins))
+	for id, pin := range pins {
+		connections := make(map[Connection]struct{})
+		if id < len(b.routing.Outputs) {
+			connections = b.routing.Outputs[id].Connections
+		}
+		outputs[id] = Output{
+			Name:        pin.Name,
+			Type:        pin.Type,
+			Connections: connections,
+		}
+	}
+	b.routing.Outputs = outputs
+}
+
+// SetInputCount resizes the block's variadic input group to n inputs. Inputs
+// that survive the resize keep their channels, and so their connections.
+// Connections to any removed inputs must be disconnected beforehand.
+func (b *Block) SetInputCount(n int) error {
+	returnVal := make(chan error, 1)
+	b.routing.InterruptChan <- func() bool {
+		if b.variadic == nil {
+			returnVal <- errors.New("block does not have variadic inputs")
+			return true
+		}
+
+		if n < b.variadic.Min {
+			returnVal <- errors.New("too few inputs for this block")
+			return true
+		}
+
+		if n > b.variadic.Max {
+			returnVal <- errors.New("too many inputs for this block")
+			return true
+		}
+
+		total := b.variadic.Start + n
+		template := b.routing.Inputs[b.variadic.Start]
+
+		for id := total; id < len(b.routing.Inputs); id++ {
+			delete(b.state.inputValues, RouteIndex(id))
+			delete(b.state.latchedValues, RouteIndex(id))
+		}
+
+		if total < len(b.routing.Inputs) {
+			b.routing.Inputs = b.routing.Inputs[:total]
+		}
+
+		for len(b.routing.Inputs) < total {
+			b.routing.Inputs = append(b.routing.Inputs, Input{
+				Name:    template.Name,
+				Type:    template.Type,
+				Value:   nil,
+				Trigger: template.Trigger,
+				C:       make(chan Message, 1),
+			})
+		}
+
 		returnVal <- nil
 		return true
 	}
@@ -169,22 +269,36 @@ func (b *Block) GetOutputs() []Output {
 	return m
 }
 
+// GetSource returns the block's first source
 func (b *Block) GetSource() Source {
 	b.routing.RLock()
-	v := b.routing.Source
-	b.routing.RUnlock()
-	return v
+	defer b.routing.RUnlock()
+	if len(b.routing.Sources) == 0 {
+		return nil
+	}
+	return b.routing.Sources[0]
 }
 
 // sets a store for the block. can be set to nil
 func (b *Block) SetSource(s Source) error {
+	return b.SetSourceAt(0, s)
+}
+
+// SetSourceAt sets the block's source at index id, for a block whose spec has
+// ExtraSources. It can be set to nil.
+func (b *Block) SetSourceAt(id RouteIndex, s Source) error {
 	returnVal := make(chan error, 1)
 	b.routing.InterruptChan <- func() bool {
-		if s != nil && s.GetType() != b.sourceType {
+		if int(id) < 0 || int(id) >= len(b.sourceTypes) {
 			returnVal <- errors.New("invalid source type for this block")
 			return true
 		}
-		b.routing.Source = s
+		t := b.sourceTypes[id]
+		if s != nil && s.GetType() != t && !linkable(t, s) {
+			returnVal <- errors.New("invalid source type for this block")
+			return true
+		}
+		b.routing.Sources[id] = s
 		returnVal <- nil
 		return true
 	}
@@ -241,6 +355,9 @@ func (b *Block) Reset() {
 	for k, _ := range b.state.internalValues {
 		delete(b.state.internalValues, k)
 	}
+	for k, _ := range b.state.latchedValues {
+		delete(b.state.latchedValues, k)
+	}
 
 	// if there are any messages on the input channels, flush them.
 	// note: all blocks that are sending to this block MUST BE IN A
@@ -267,6 +384,12 @@ func (b *Block) Stop() {
 
 // wait and listen for all kernel inputs to be filled.
 func (b *Block) receive() Interrupt {
+	for _, input := range b.routing.Inputs {
+		if input.Trigger != REQUIRED {
+			return b.receiveAny()
+		}
+	}
+
 	for id, input := range b.routing.Inputs {
 		b.Monitor <- MonitorMessage{
 			BI_INPUT,
@@ -293,6 +416,131 @@ func (b *Block) receive() Interrupt {
 	return nil
 }
 
+// receiveAny listens on all inputs at once, for blocks with HOT or COLD
+// inputs. It returns once every REQUIRED input is filled and, if the block has
+// any HOT inputs, exactly one of them has received a message or the kernel's
+// DEADLINE has passed. COLD inputs latch their latest message, which is handed
+// to the kernel on every crank.
+func (b *Block) receiveAny() Interrupt {
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		ready, fired, hasHot := true, false, false
+
+		for id, input := range b.routing.Inputs {
+			rid := RouteIndex(id)
+			switch input.Trigger {
+			case COLD:
+				if input.Value != nil {
+					b.state.latchedValues[rid] = Copy(input.Value.Data)
+				}
+			case HOT:
+				hasHot = true
+				if _, ok := b.state.inputValues[rid]; ok {
+					fired = true
+				}
+			default:
+				if _, ok := b.state.inputValues[rid]; !ok {
+					if input.Value == nil {
+						ready = false
+						continue
+					}
+					b.state.inputValues[rid] = Copy(input.Value.Data)
+				}
+			}
+		}
+
+		// a HOT input set to a value fires on every crank, just as a
+		// REQUIRED input set to a value is always filled.
+		if hasHot && !fired {
+			for id, input := range b.routing.Inputs {
+				if input.Trigger == HOT && input.Value != nil {
+					b.state.inputValues[RouteIndex(id)] = Copy(input.Value.Data)
+					fired = true
+					break
+				}
+			}
+		}
+
+		if ready && (fired || !hasHot) {
+			for k, v := range b.state.latchedValues {
+				b.state.inputValues[k] = v
+			}
+			return nil
+		}
+
+		b.Monitor <- MonitorMessage{
+			BI_INPUT,
+			nil,
+		}
+
+		// listen on the interrupt, every COLD input, every unfilled
+		// REQUIRED input and, until one of them has fired, every HOT input.
+		cases := []reflect.SelectCase{
+			reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(b.routing.InterruptChan),
+			},
+		}
+		ids := []RouteIndex{-1}
+		for id, input := range b.routing.Inputs {
+			rid := RouteIndex(id)
+			if input.Value != nil {
+				continue
+			}
+			if _, ok := b.state.inputValues[rid]; ok && input.Trigger != COLD {
+				continue
+			}
+			if input.Trigger == HOT && fired {
+				continue
+			}
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(input.C),
+			})
+			ids = append(ids, rid)
+		}
+
+		// wake up for the kernel's deadline once every REQUIRED input is in
+		deadline, hasDeadline := b.state.internalValues[DEADLINE].(time.Time)
+		if ready && hasDeadline {
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.NewTimer(deadline.Sub(time.Now()))
+			cases = append(cases, reflect.SelectCase{
+				Dir:  reflect.SelectRecv,
+				Chan: reflect.ValueOf(timer.C),
+			})
+		}
+
+		chosen, v, _ := reflect.Select(cases)
+		if chosen == 0 {
+			return v.Interface().(Interrupt)
+		}
+
+		if chosen == len(ids) {
+			delete(b.state.internalValues, DEADLINE)
+			for k, v := range b.state.latchedValues {
+				b.state.inputValues[k] = v
+			}
+			return nil
+		}
+
+		rid := ids[chosen]
+		if b.routing.Inputs[rid].Trigger == COLD {
+			b.state.latchedValues[rid] = v.Interface()
+		} else {
+			b.state.inputValues[rid] = v.Interface()
+		}
+	}
+}
+
 // run kernel on inputs, produce outputs
 func (b *Block) process() Interrupt {
 
@@ -305,35 +553,42 @@ func (b *Block) process() Interrupt {
 		return nil
 	}
 
-	// block until connected to source if necessary
+	// block until connected to sources if necessary
 
-	if b.sourceType != NONE && b.routing.Source == nil {
-		select {
-		case f := <-b.routing.InterruptChan:
-			return f
+	for _, source := range b.routing.Sources {
+		if source == nil {
+			select {
+			case f := <-b.routing.InterruptChan:
+				return f
+			}
 		}
 	}
 
 	// we should only be able to get here if
 	// - we don't need an shared state
-	// - we have an external shared state and it has been attached
-
-	// if we have a store, lock it
-	var store sync.Locker
-	var ok bool
-	if store, ok = b.routing.Source.(sync.Locker); ok {
-		store.Lock()
+	// - we have external shared state and all of it has been attached
+
+	var source Source
+	switch len(b.routing.Sources) {
+	case 0:
+	case 1:
+		source = b.routing.Sources[0]
+	default:
+		source = Sources(b.routing.Sources)
 	}
 
+	// if we have stores, lock them
+	stores := lockSources(b.routing.Sources)
+
 	// run the kernel
 	interrupt := b.kernel(b.state.inputValues,
 		b.state.outputValues,
 		b.state.internalValues,
-		b.routing.Source,
+		source,
 		b.routing.InterruptChan)
 
-	// unlock the store if necessary
-	if store != nil {
+	// unlock the stores if necessary
+	for _, store := range stores {
 		store.Unlock()
 	}
 
@@ -342,6 +597,16 @@ func (b *Block) process() Interrupt {
 		return interrupt
 	}
 
+	// a kernel can emit to an output the block doesn't have, such as a
+	// switch whose cases arrived on a connection and so never reshaped it.
+	// broadcast would drop the message, so report it instead.
+	for id := range b.state.outputValues {
+		if int(id) >= len(b.routing.Outputs) {
+			delete(b.state.outputValues, id)
+			b.state.outputValues[0] = NewError(fmt.Sprintf("block has no output %d", id))
+		}
+	}
+
 	b.state.Processed = true
 	return nil
 }
@@ -403,3 +668,41 @@ func (b *Block) crank() {
 	}
 	b.state.Processed = false
 }
+
+// lockSources locks each source that is a store, and returns them to be
+// unlocked. A store linked more than once is only locked once, and stores are
+// locked in order of their address, so that blocks linked to the same stores
+// in a different order can't deadlock.
+func lockSources(sources []Source) []sync.Locker {
+	var stores []sync.Locker
+	for _, source := range sources {
+		store, ok := source.(sync.Locker)
+		if !ok {
+			continue
+		}
+		linked := false
+		for _, s := range stores {
+			linked = linked || s == store
+		}
+		if !linked {
+			stores = append(stores, store)
+		}
+	}
+	sort.Slice(stores, func(i, j int) bool {
+		return storeAddress(stores[i]) < storeAddress(stores[j])
+	})
+	for _, store := range stores {
+		store.Lock()
+	}
+	return stores
+}
+
+// storeAddress returns the address of a store held by pointer, and 0 for any
+// other store
+func storeAddress(store sync.Locker) uintptr {
+	v := reflect.ValueOf(store)
+	if v.Kind() != reflect.Ptr {
+		return 0
+	}
+	return v.Pointer()
+}
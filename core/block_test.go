@@ -3,7 +3,11 @@ package core
 import (
 	"encoding/json"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -237,12 +241,111 @@ func TestHTTPRequest(t *testing.T) {
 	out := make(chan Message)
 	block.Connect(0, out)
 	urlRoute.C <- "http://private-e92ba-stcoretest.apiary-mock.com/get"
-	m := <-out
-	if reflect.DeepEqual(m, `{"msg": "hello there!"}`) {
+	m, ok := (<-out).(map[string]interface{})
+	if !ok || reflect.DeepEqual(m["body"], `{"msg": "hello there!"}`) {
 		t.Error("didn't get expected output from HTTPRequest GET")
 	}
 }
 
+func TestHTTPStatusAndRetries(t *testing.T) {
+	log.Println("testing HTTPRequest status and retries")
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&attempts, 1)
+		switch r.URL.Path {
+		case "/flaky":
+			if n < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"msg": "hello there!"}`))
+		case "/missing":
+			w.Header().Set("X-Reason", "gone")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("not here"))
+		case "/down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
+
+	block := NewBlock(GetLibrary()["HTTPRequest"])
+	go DummyMonitor(block.Monitor)
+	go block.Serve()
+	inputs := block.GetInputs()
+	if inputs[4].Value == nil || inputs[4].Value.Data != "0s" || inputs[7].Value == nil || inputs[7].Value.Data != false ||
+		inputs[8].Value == nil || inputs[8].Value.Data != false {
+		t.Error("HTTPRequest did not default its timeout, skipVerify and retryAll")
+	}
+	block.SetInput(1, &InputValue{map[string]interface{}{}})
+	block.SetInput(2, &InputValue{"GET"})
+	block.SetInput(3, &InputValue{""})
+	block.SetInput(4, &InputValue{"50ms"})
+	block.SetInput(5, &InputValue{float64(2)})
+	block.SetInput(6, &InputValue{"1ms"})
+	block.SetInput(7, &InputValue{false})
+	urlRoute, _ := block.GetInput(0)
+	out := make(chan Message)
+	block.Connect(0, out)
+
+	urlRoute.C <- server.URL + "/flaky"
+	m, ok := (<-out).(map[string]interface{})
+	if !ok {
+		t.Fatal("expected response object after retries")
+	}
+	if atomic.LoadInt32(&attempts) != 3 || m["status"] != float64(200) || m["body"] != `{"msg": "hello there!"}` {
+		t.Error("unexpected response from HTTPRequest", atomic.LoadInt32(&attempts), m)
+	}
+	if !reflect.DeepEqual(m["json"], map[string]interface{}{"msg": "hello there!"}) {
+		t.Error("HTTPRequest did not parse JSON body", m["json"])
+	}
+	if m["headers"].(map[string]interface{})["Content-Type"] != "application/json" {
+		t.Error("HTTPRequest did not emit headers", m["headers"])
+	}
+
+	// failed responses are still emitted, with an error carrying the status
+	urlRoute.C <- server.URL + "/missing"
+	m, ok = (<-out).(map[string]interface{})
+	if !ok || m["status"] != float64(404) || m["body"] != "not here" {
+		t.Fatal("expected response object for a 404", m)
+	}
+	if e, _ := m["error"].(string); !strings.Contains(e, "404") {
+		t.Error("expected error carrying status from HTTPRequest", m["error"])
+	}
+	if m["headers"].(map[string]interface{})["X-Reason"] != "gone" {
+		t.Error("HTTPRequest did not emit headers of a failed response", m["headers"])
+	}
+
+	// a POST is only retried if retryAll is set
+	block.SetInput(2, &InputValue{"POST"})
+	for _, r := range []struct {
+		retryAll bool
+		attempts int32
+	}{
+		{false, 1},
+		{true, 3},
+	} {
+		block.SetInput(8, &InputValue{r.retryAll})
+		atomic.StoreInt32(&attempts, 0)
+		urlRoute.C <- server.URL + "/down"
+		if m, ok := (<-out).(map[string]interface{}); !ok || m["status"] != float64(503) {
+			t.Error("expected 503 response", m)
+		}
+		if n := atomic.LoadInt32(&attempts); n != r.attempts {
+			t.Error("POST with retryAll", r.retryAll, "made", n, "attempts")
+		}
+	}
+	block.SetInput(2, &InputValue{"GET"})
+
+	urlRoute.C <- server.URL + "/slow"
+	if _, ok := (<-out).(*stcoreError); !ok {
+		t.Error("expected timeout error from HTTPRequest")
+	}
+}
+
 func TestParseJSON(t *testing.T) {
 	log.Println("testing ParseJSON")
 	lib := GetLibrary()
@@ -330,3 +433,271 @@ func TestMerge(t *testing.T) {
 	expected = map[string]interface{}{"a": 3, "b": true, "c": map[string]interface{}{"foo": false, "bar": "car"}}
 	testMerge(inmsg4, inmsg6, expected)
 }
+
+func TestStreamMerge(t *testing.T) {
+	log.Println("testing streamMerge")
+	block := NewBlock(GetLibrary()["streamMerge"])
+	go DummyMonitor(block.Monitor)
+	go block.Serve()
+	out := make(chan Message)
+	block.Connect(0, out)
+	in0, _ := block.GetInput(0)
+	in1, _ := block.GetInput(1)
+
+	// a block that waited for both inputs would deadlock here
+	for _, m := range []string{"a", "b", "c"} {
+		in1.C <- m
+		if <-out != m {
+			t.Error("streamMerge did not emit message from second input")
+		}
+	}
+	in0.C <- "d"
+	if <-out != "d" {
+		t.Error("streamMerge did not emit message from first input")
+	}
+
+	block.Stop()
+}
+
+func TestHotColdInputs(t *testing.T) {
+	log.Println("testing hot and cold inputs")
+	spec := Spec{
+		Name:     "pair",
+		Inputs:   []Pin{Pin{"in", ANY}, Pin{"latest", ANY}},
+		Outputs:  []Pin{Pin{"out", ARRAY}},
+		Triggers: []Trigger{HOT, COLD},
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			out[0] = []interface{}{in[0], in[1]}
+			return nil
+		},
+	}
+	block := NewBlock(spec)
+	go DummyMonitor(block.Monitor)
+	go block.Serve()
+	out := make(chan Message)
+	block.Connect(0, out)
+	hot, _ := block.GetInput(0)
+	cold, _ := block.GetInput(1)
+
+	if hot.Trigger != HOT || cold.Trigger != COLD {
+		t.Fatal("inputs do not carry the triggers from their spec")
+	}
+
+	// nothing has been latched yet, so the cold value is absent
+	hot.C <- 1.0
+	if pair := (<-out).([]interface{}); pair[0] != 1.0 || pair[1] != nil {
+		t.Error("hot input did not fire with an empty cold input")
+	}
+
+	// the second send only completes once the first has been latched
+	cold.C <- "x"
+	cold.C <- "x"
+	for _, v := range []float64{2.0, 3.0} {
+		hot.C <- v
+		if pair := (<-out).([]interface{}); pair[0] != v || pair[1] != "x" {
+			t.Error("hot input did not fire with the latched cold value")
+		}
+	}
+
+	block.SetInput(1, &InputValue{"y"})
+	hot.C <- 4.0
+	if pair := (<-out).([]interface{}); pair[1] != "y" {
+		t.Error("cold input did not take its route value")
+	}
+
+	block.Stop()
+}
+
+func TestVariadicInputs(t *testing.T) {
+	log.Println("testing variadic inputs")
+	add := NewBlock(GetLibrary()["+"])
+	go DummyMonitor(add.Monitor)
+	go add.Serve()
+	out := make(chan Message)
+	add.Connect(0, out)
+
+	x, _ := add.GetInput(0)
+
+	err := add.SetInputCount(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := add.GetInputs()
+	if len(inputs) != 4 {
+		t.Fatal("expected 4 inputs, got", len(inputs))
+	}
+	if inputs[0].C != x.C {
+		t.Error("resizing replaced a surviving input's channel")
+	}
+
+	for _, input := range inputs {
+		input.C <- 1.0
+	}
+	if <-out != 4.0 {
+		t.Error("+ did not sum all of its inputs")
+	}
+
+	err = add.SetInputCount(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(add.GetInputs()) != 2 {
+		t.Fatal("block did not shrink its inputs")
+	}
+
+	if add.SetInputCount(1) == nil {
+		t.Error("block accepted fewer inputs than its minimum")
+	}
+	if add.SetInputCount(65) == nil {
+		t.Error("block accepted more inputs than its maximum")
+	}
+
+	delay := NewBlock(GetLibrary()["delay"])
+	go DummyMonitor(delay.Monitor)
+	go delay.Serve()
+	if delay.SetInputCount(3) == nil {
+		t.Error("block without variadic inputs accepted a new input count")
+	}
+
+	add.Stop()
+	delay.Stop()
+}
+
+func TestSwitch(t *testing.T) {
+	log.Println("testing switch")
+	block := NewBlock(GetLibrary()["switch"])
+	go DummyMonitor(block.Monitor)
+	go block.Serve()
+
+	defaultOut := make(chan Message, 1)
+	block.Connect(0, defaultOut)
+
+	var cases interface{}
+	json.Unmarshal([]byte(`[{"equals": "a"}, {"regex": "^b"}, {"min": 0, "max": 10}]`), &cases)
+	err := block.SetInput(2, &InputValue{cases})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputs := block.GetOutputs()
+	if len(outputs) != 4 {
+		t.Fatal("switch did not add an output per case, got", len(outputs))
+	}
+	if len(outputs[0].Connections) != 1 {
+		t.Error("switch dropped the connection on its default output")
+	}
+
+	outs := []chan Message{defaultOut}
+	for id := 1; id < 4; id++ {
+		c := make(chan Message, 1)
+		block.Connect(RouteIndex(id), c)
+		outs = append(outs, c)
+	}
+
+	in, _ := block.GetInput(0)
+	value, _ := block.GetInput(1)
+	tests := []struct {
+		value    interface{}
+		expected int
+	}{
+		{"a", 1},
+		{"banana", 2},
+		{5.0, 3},
+		{10.0, 0},
+		{"c", 0},
+	}
+	for _, test := range tests {
+		in.C <- "msg"
+		value.C <- test.value
+		select {
+		case <-outs[test.expected]:
+		case <-time.After(time.Second):
+			t.Fatal("switch did not route", test.value, "to output", test.expected)
+		}
+	}
+
+	err = block.SetInput(2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.GetOutputs()) != 1 {
+		t.Error("switch did not remove outputs when its cases were cleared")
+	}
+
+	// cases that arrive on a connection don't add outputs, so a match is
+	// reported as an error on the default output
+	casesIn, _ := block.GetInput(2)
+	in.C <- "msg"
+	value.C <- "a"
+	casesIn.C <- cases
+	select {
+	case m := <-outs[0]:
+		if _, ok := m.(*stcoreError); !ok {
+			t.Error("expected error for a case without an output, got", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("switch dropped a match for a case without an output")
+	}
+
+	block.Stop()
+}
+
+func TestWatchdog(t *testing.T) {
+	log.Println("testing watchdog")
+	block := NewBlock(GetLibrary()["watchdog"])
+	go DummyMonitor(block.Monitor)
+	go block.Serve()
+	out := make(chan Message)
+	timeout := make(chan Message)
+	block.Connect(0, out)
+	block.Connect(1, timeout)
+	block.SetInput(1, &InputValue{"50ms"})
+	in, _ := block.GetInput(0)
+
+	in.C <- "a"
+	if <-out != "a" {
+		t.Fatal("watchdog did not pass message through")
+	}
+
+	// keep the watchdog fed for longer than its duration
+	for j := 0; j < 4; j++ {
+		time.Sleep(20 * time.Millisecond)
+		in.C <- j
+		select {
+		case <-out:
+		case <-timeout:
+			t.Fatal("watchdog timed out while being fed")
+		}
+	}
+
+	select {
+	case m := <-timeout:
+		event, ok := m.(map[string]interface{})
+		if !ok || event["duration"] != "50ms" {
+			t.Error("watchdog emitted unexpected timeout event")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watchdog did not time out")
+	}
+
+	// the watchdog emits once per quiet period
+	select {
+	case <-timeout:
+		t.Error("watchdog timed out twice without a message")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// stopping and resetting an armed watchdog disarms it
+	in.C <- "b"
+	<-out
+	block.Stop()
+	block.Reset()
+	go block.Serve()
+	select {
+	case <-timeout:
+		t.Error("watchdog timed out after being reset")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	block.Stop()
+}
@@ -2,7 +2,7 @@ package core
 
 import (
 	"encoding/json"
-	"fmt"
+	"log"
 	"math"
 	"time"
 )
@@ -92,9 +92,9 @@ func Get() Spec {
 	}
 }
 
-// Log writes the inbound message to stdout
-// TODO where should this write exactly?
-// TODO there should be a stdout source block and Log should be a compound block with a writer
+// Log writes the inbound message as JSON to the server's log. To write
+// somewhere else, or in another format, link a write block to a stdWriter or
+// fileWriter source.
 func Log() Spec {
 	return Spec{
 		Name:     "log",
@@ -104,9 +104,10 @@ func Log() Spec {
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
 			o, err := json.Marshal(in[0])
 			if err != nil {
-				fmt.Println(err)
+				log.Println("log could not marshal message:", err)
+				return nil
 			}
-			fmt.Println(string(o))
+			log.Println(string(o))
 			return nil
 		},
 	}
@@ -178,7 +179,26 @@ func Identity() Spec {
 	}
 }
 
-// Merge recursively merges two objects, favouring the first input to resolve conflicts
+// StreamMerge emits each inbound message as soon as it arrives on either input
+func StreamMerge() Spec {
+	return Spec{
+		Name:     "streamMerge",
+		Category: []string{"mechanism"},
+		Inputs:   []Pin{Pin{"in", ANY}, Pin{"in", ANY}},
+		Outputs:  []Pin{Pin{"out", ANY}},
+		Triggers: []Trigger{HOT, HOT},
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			// only the input that fired is present in the MessageMap
+			for _, m := range in {
+				out[0] = m
+			}
+			return nil
+		},
+	}
+}
+
+// Merge recursively merges its objects in order, so that later inputs
+// overwrite earlier ones when keys conflict
 func Merge() Spec {
 	return Spec{
 		Name:     "merge",
@@ -187,29 +207,22 @@ func Merge() Spec {
 			Pin{"in", OBJECT},
 			Pin{"in", OBJECT},
 		},
-		Outputs: []Pin{Pin{"out", OBJECT}},
+		Outputs:  []Pin{Pin{"out", OBJECT}},
+		Variadic: &Variadic{Start: 0, Min: 2, Max: 64},
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
 			result := make(map[string]interface{})
 			var err error
-			in0, ok := in[0].(map[string]interface{})
-			if !ok {
-				out[0] = NewError("Merge needs map")
-				return nil
-			}
-			result, err = MergeMap(result, in0)
-			if err != nil {
-				out[0] = err
-				return nil
-			}
-			in1, ok := in[1].(map[string]interface{})
-			if !ok {
-				out[0] = NewError("Merge needs map")
-				return nil
-			}
-			result, err = MergeMap(result, in1)
-			if err != nil {
-				out[0] = err
-				return nil
+			for j := 0; j < len(in); j++ {
+				obj, ok := in[RouteIndex(j)].(map[string]interface{})
+				if !ok {
+					out[0] = NewError("Merge needs map")
+					return nil
+				}
+				result, err = MergeMap(result, obj)
+				if err != nil {
+					out[0] = err
+					return nil
+				}
 			}
 			out[0] = result
 			return nil
@@ -224,18 +237,18 @@ func Addition() Spec {
 		Category: []string{"maths"},
 		Inputs:   []Pin{Pin{"x", NUMBER}, Pin{"y", NUMBER}},
 		Outputs:  []Pin{Pin{"x+y", NUMBER}},
+		Variadic: &Variadic{Start: 0, Min: 2, Max: 64},
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
-			a1, ok := in[0].(float64)
-			if !ok {
-				out[0] = NewError("Addition requires floats")
-				return nil
-			}
-			a2, ok := in[1].(float64)
-			if !ok {
-				out[0] = NewError("Addition requires floats")
-				return nil
+			sum := 0.0
+			for j := 0; j < len(in); j++ {
+				a, ok := in[RouteIndex(j)].(float64)
+				if !ok {
+					out[0] = NewError("Addition requires floats")
+					return nil
+				}
+				sum += a
 			}
-			out[0] = a1 + a2
+			out[0] = sum
 			return nil
 		},
 	}
@@ -0,0 +1,211 @@
+//go:build !windows
+// +build !windows
+
+package core
+
+import (
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// processGone reports whether pid has exited, counting zombies as exited
+func processGone(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return true
+	}
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	return err == nil && strings.Contains(string(stat), ") Z ")
+}
+
+func TestExec(t *testing.T) {
+	log.Println("testing exec")
+
+	defer func(base, max time.Duration) {
+		reconnectBase, reconnectMax = base, max
+	}(reconnectBase, reconnectMax)
+	reconnectBase, reconnectMax = 10*time.Millisecond, 50*time.Millisecond
+
+	script := `
+sleep 60 >/dev/null 2>&1 &
+echo "child $!"
+echo "$GREETING"
+echo oops >&2
+while read line; do
+	if [ "$line" = exit ]; then exit 1; fi
+	echo "got $line"
+done`
+
+	e := NewExec().(*execSource)
+	e.SetSourceParameter("command", "sh")
+	e.SetSourceParameter("args", `["-c", `+strconv.Quote(script)+`]`)
+	e.SetSourceParameter("env", `{"GREETING": "hello"}`)
+	e.SetSourceParameter("env", `not json`)
+	if e.Describe()[2]["value"] != `{"GREETING":"hello"}` {
+		t.Error("exec kept unexpected env", e.Describe())
+	}
+	go e.Serve()
+
+	library := GetLibrary()
+	receive := NewBlock(library["execReceive"])
+	send := NewBlock(library["execSend"])
+	received := make(chan Message)
+	sent := make(chan Message)
+	for b, out := range map[*Block]chan Message{receive: received, send: sent} {
+		go b.Serve()
+		go DummyMonitor(b.Monitor)
+		if err := b.SetSource(e); err != nil {
+			t.Fatal(err)
+		}
+		b.Connect(0, out)
+	}
+
+	next := func() Message {
+		select {
+		case m := <-received:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("execReceive never emitted")
+		}
+		return nil
+	}
+
+	// stdout and stderr are read separately, so the error can come at any point
+	startup := func() int {
+		var child int
+		var stdout []string
+		gotError := false
+		for len(stdout) < 2 || !gotError {
+			switch m := next().(type) {
+			case string:
+				stdout = append(stdout, m)
+			case *stcoreError:
+				gotError = m.S == "oops"
+			}
+		}
+		if !strings.HasPrefix(stdout[0], "child ") || stdout[1] != "hello" {
+			t.Fatal("unexpected startup output", stdout)
+		}
+		child, _ = strconv.Atoi(strings.TrimPrefix(stdout[0], "child "))
+		return child
+	}
+	startup()
+
+	in, _ := send.GetInput(0)
+	in.C <- map[string]interface{}{"n": 1.0}
+	if r := <-sent; r != true {
+		t.Fatal("execSend failed", r)
+	}
+	if m := next(); m != `got {"n":1}` {
+		t.Error("unexpected reply", m)
+	}
+
+	// the process is restarted after it exits
+	in.C <- "exit"
+	<-sent
+	child := startup()
+
+	e.Stop()
+	if e.State()["status"] != STATUS_DISCONNECTED {
+		t.Error("exec should be disconnected once stopped", e.State())
+	}
+	for j := 0; !processGone(child); j++ {
+		if j == 100 {
+			t.Fatal("stopping exec left a child running")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestExecBackgroundChild(t *testing.T) {
+	log.Println("testing exec with a child that holds stdout open")
+
+	defer func(base, max, drain time.Duration) {
+		reconnectBase, reconnectMax, execDrainTimeout = base, max, drain
+	}(reconnectBase, reconnectMax, execDrainTimeout)
+	reconnectBase, reconnectMax = 10*time.Millisecond, 50*time.Millisecond
+	execDrainTimeout = 50 * time.Millisecond
+
+	e := NewExec().(*execSource)
+	e.SetSourceParameter("command", "sh")
+	e.SetSourceParameter("args", `["-c", "sleep 60 & echo \"child $!\""]`)
+	go e.Serve()
+	defer e.Stop()
+
+	received := make(chan Message)
+	linkBlock(t, e, received, "execReceive")
+
+	// the process is reaped and restarted although its child keeps stdout
+	children := []int{}
+	defer func() {
+		for _, child := range children {
+			syscall.Kill(child, syscall.SIGKILL)
+		}
+	}()
+	for len(children) < 2 {
+		select {
+		case m := <-received:
+			s, _ := m.(string)
+			child, err := strconv.Atoi(strings.TrimPrefix(s, "child "))
+			if err != nil {
+				t.Fatal("unexpected output", m)
+			}
+			children = append(children, child)
+		case <-time.After(5 * time.Second):
+			t.Fatal("exec was never restarted", e.State())
+		}
+	}
+}
+
+func TestExecBlockedStdin(t *testing.T) {
+	log.Println("testing exec with a process that doesn't read stdin")
+
+	e := NewExec().(*execSource)
+	e.SetSourceParameter("command", "sleep")
+	e.SetSourceParameter("args", `["60"]`)
+	go e.Serve()
+	defer e.Stop()
+	for e.State()["status"] != STATUS_CONNECTED {
+		select {
+		case <-e.StateChanges():
+		case <-time.After(5 * time.Second):
+			t.Fatal("exec never started", e.State())
+		}
+	}
+
+	send := NewBlock(GetLibrary()["execSend"])
+	go send.Serve()
+	go DummyMonitor(send.Monitor)
+	if err := send.SetSource(e); err != nil {
+		t.Fatal(err)
+	}
+	send.Connect(0, make(chan Message))
+
+	// more than a pipe holds, so the write blocks
+	in, _ := send.GetInput(0)
+	in.C <- strings.Repeat("x", 1024*1024)
+	time.Sleep(50 * time.Millisecond)
+
+	state := make(chan map[string]interface{})
+	go func() { state <- e.State() }()
+	select {
+	case <-state:
+	case <-time.After(time.Second):
+		t.Fatal("State blocked behind a stuck send")
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		send.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("a stuck send could not be interrupted")
+	}
+}
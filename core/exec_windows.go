@@ -0,0 +1,13 @@
+package core
+
+import "os/exec"
+
+// Windows has no process groups to run cmd in, so children that cmd starts
+// are left running when it is stopped
+func execSetGroup(cmd *exec.Cmd) {
+}
+
+// Windows can't ask a process to exit, so cmd is always killed
+func execSignalGroup(cmd *exec.Cmd, kill bool) {
+	cmd.Process.Kill()
+}
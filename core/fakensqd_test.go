@@ -0,0 +1,149 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeNSQDCommand struct {
+	name   string
+	params []string
+	bodies []string
+}
+
+// fakeNSQD speaks just enough of the nsqd TCP protocol to accept publishes
+// and to deliver messages to subscribers. Publishing to the topic "bad" fails
+// with E_BAD_TOPIC. Every command other than IDENTIFY, SUB, RDY and CLS is
+// sent on commands, and every string sent on messages is delivered to one
+// subscriber.
+type fakeNSQD struct {
+	l        net.Listener
+	commands chan fakeNSQDCommand
+	messages chan string
+}
+
+func newFakeNSQD(t *testing.T) *fakeNSQD {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveFakeNSQD(l)
+}
+
+func serveFakeNSQD(l net.Listener) *fakeNSQD {
+	f := &fakeNSQD{
+		l:        l,
+		commands: make(chan fakeNSQDCommand, 10),
+		messages: make(chan string),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeNSQD) Addr() string {
+	return f.l.Addr().String()
+}
+
+func (f *fakeNSQD) Close() {
+	f.l.Close()
+}
+
+func (f *fakeNSQD) serve(conn net.Conn) {
+	defer conn.Close()
+
+	var mu sync.Mutex
+	write := func(frameType int32, data []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		binary.Write(conn, binary.BigEndian, int32(len(data)+4))
+		binary.Write(conn, binary.BigEndian, frameType)
+		conn.Write(data)
+	}
+
+	r := bufio.NewReader(conn)
+	readBody := func() string {
+		var size int32
+		binary.Read(r, binary.BigEndian, &size)
+		body := make([]byte, size)
+		io.ReadFull(r, body)
+		return string(body)
+	}
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return
+	}
+
+	closed := make(chan struct{})
+	defer close(closed)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		cmd := fakeNSQDCommand{name: fields[0], params: fields[1:]}
+		switch cmd.name {
+		case "IDENTIFY":
+			readBody()
+			write(0, []byte("OK"))
+			continue
+		case "SUB":
+			write(0, []byte("OK"))
+			go func() {
+				for id := 0; ; id++ {
+					select {
+					case body := <-f.messages:
+						// timestamp, attempts, id and body
+						data := make([]byte, 26, 26+len(body))
+						binary.BigEndian.PutUint64(data[:8], uint64(time.Now().UnixNano()))
+						binary.BigEndian.PutUint16(data[8:10], 1)
+						copy(data[10:26], fmt.Sprintf("%016d", id))
+						write(2, append(data, body...))
+					case <-closed:
+						return
+					}
+				}
+			}()
+			continue
+		case "RDY":
+			continue
+		case "CLS":
+			write(0, []byte("CLOSE_WAIT"))
+			return
+		case "PUB", "DPUB":
+			cmd.bodies = []string{readBody()}
+		case "MPUB":
+			var size, n int32
+			binary.Read(r, binary.BigEndian, &size)
+			binary.Read(r, binary.BigEndian, &n)
+			for j := int32(0); j < n; j++ {
+				cmd.bodies = append(cmd.bodies, readBody())
+			}
+		}
+		if len(cmd.params) > 0 && cmd.params[0] == "bad" {
+			write(1, []byte("E_BAD_TOPIC"))
+			continue
+		}
+		f.commands <- cmd
+		if strings.HasSuffix(cmd.name, "PUB") {
+			write(0, []byte("OK"))
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package core
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// fileTailID identifies a file by its device and inode, so that a file that
+// has been replaced since a checkpoint isn't mistaken for the file that was
+// checkpointed
+func fileTailID(info os.FileInfo) string {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return strconv.FormatUint(uint64(stat.Dev), 10) + ":" + strconv.FormatUint(uint64(stat.Ino), 10)
+}
@@ -0,0 +1,122 @@
+package core
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileTail(t *testing.T) {
+	log.Println("testing file tail")
+
+	dir, err := ioutil.TempDir("", "filetail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.log")
+	checkpoint := filepath.Join(dir, "checkpoint.json")
+
+	appendTo := func(s string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(s)
+		f.Close()
+	}
+
+	newTail := func() (*fileTail, chan Message) {
+		tail := NewFileTail().(*fileTail)
+		tail.SetSourceParameter("paths", filepath.Join(dir, "*.log")+", "+filepath.Join(dir, "missing", "*"))
+		tail.SetSourceParameter("checkpoint", checkpoint)
+		tail.SetSourceParameter("pollInterval", "10ms")
+		tail.SetSourceParameter("start", "middle")
+		go tail.Serve()
+
+		block := NewBlock(GetLibrary()["fileTailReceive"])
+		go block.Serve()
+		go DummyMonitor(block.Monitor)
+		if err := block.SetSource(tail); err != nil {
+			t.Fatal(err)
+		}
+		out := make(chan Message)
+		block.Connect(0, out)
+		return tail, out
+	}
+
+	expect := func(out chan Message, line string, offset float64) {
+		select {
+		case m := <-out:
+			l := m.(map[string]interface{})
+			if l["line"] != line || l["file"] != path || l["offset"] != offset {
+				t.Error("fileTailReceive emitted unexpected line", l, "expected", line, offset)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("fileTailReceive never emitted", line)
+		}
+	}
+
+	// lines written before the tail starts are skipped
+	appendTo("old\n")
+	tail, out := newTail()
+	if tail.Describe()[1]["value"] != FILETAIL_START_END {
+		t.Error("fileTail accepted an unknown start", tail.Describe())
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	appendTo("one\n")
+	expect(out, "one", 4)
+
+	// partial lines wait for their newline
+	appendTo("tw")
+	time.Sleep(50 * time.Millisecond)
+	appendTo("o\r\n")
+	expect(out, "two", 8)
+
+	// the rotated file is finished, including any partial line at its end,
+	// before the new one is followed
+	appendTo("three\npart")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendTo("four\n")
+	expect(out, "three", 13)
+	expect(out, "part", 19)
+	expect(out, "four", 0)
+
+	// truncation starts the file over
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	appendTo("5\n")
+	expect(out, "5", 0)
+
+	// a restarted tail resumes from the checkpoint
+	tail.Stop()
+	appendTo("six\n")
+	tail, out = newTail()
+	expect(out, "six", 2)
+
+	// a file replaced while the tail is stopped is followed from its
+	// beginning, even if it is larger than the checkpointed offset
+	tail.Stop()
+	if err := os.Rename(path, path+".2"); err != nil {
+		t.Fatal(err)
+	}
+	appendTo("seven is longer\n")
+	tail, out = newTail()
+	defer tail.Stop()
+	expect(out, "seven is longer", 0)
+}
+
+func TestFileTailOldCheckpoint(t *testing.T) {
+	log.Println("testing file tail checkpoints without file identities")
+	offsets := readFileTailCheckpoint([]byte(`{"/var/log/a.log": 13}`))
+	if offsets["/var/log/a.log"] != (fileTailOffset{Offset: 13}) {
+		t.Error("unexpected offsets from an old checkpoint", offsets)
+	}
+}
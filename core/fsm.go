@@ -0,0 +1,130 @@
+package core
+
+import (
+	"errors"
+	"reflect"
+	"time"
+)
+
+// fsmTable is a parsed transition table. A table is written as
+// {"initial": state, "transitions": {state: {event: state}}}
+type fsmTable struct {
+	initial     string
+	transitions map[string]map[string]string
+}
+
+func parseFSMTable(m interface{}) (*fsmTable, error) {
+	obj, ok := m.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("fsm table must be an object")
+	}
+
+	initial, ok := obj["initial"].(string)
+	if !ok {
+		return nil, errors.New("fsm table requires string initial state")
+	}
+
+	transitions, ok := obj["transitions"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("fsm table requires object transitions")
+	}
+
+	table := &fsmTable{
+		initial:     initial,
+		transitions: make(map[string]map[string]string),
+	}
+
+	for state, events := range transitions {
+		eventMap, ok := events.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("fsm transitions for state " + state + " must be an object")
+		}
+		table.transitions[state] = make(map[string]string)
+		for event, to := range eventMap {
+			toState, ok := to.(string)
+			if !ok {
+				return nil, errors.New("fsm transition " + state + " -> " + event + " must be a string")
+			}
+			table.transitions[state][event] = toState
+		}
+	}
+
+	return table, nil
+}
+
+// FSM tracks the state of every key in a key_value store using a transition
+// table. Keys that aren't in the store start in the table's initial state.
+// Each valid event moves its key to a new state and emits the transition,
+// otherwise the event is emitted on invalid.
+func FSM() Spec {
+	return Spec{
+		Name:     "fsm",
+		Category: []string{"mechanism"},
+		Inputs: []Pin{
+			Pin{"key", STRING},
+			Pin{"event", STRING},
+			Pin{"table", OBJECT},
+		},
+		Outputs: []Pin{
+			Pin{"transition", OBJECT},
+			Pin{"invalid", OBJECT},
+		},
+		Source: KEY_VALUE,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			kv := s.(*KeyValue)
+			key, ok := in[0].(string)
+			if !ok {
+				out[0] = NewError("fsm requires string key")
+				return nil
+			}
+			event, ok := in[1].(string)
+			if !ok {
+				out[0] = NewError("fsm requires string event")
+				return nil
+			}
+			// the table is only parsed when it changes
+			if _, ok := internal[1]; !ok || !reflect.DeepEqual(internal[0], in[2]) {
+				table, err := parseFSMTable(in[2])
+				if err != nil {
+					out[0] = NewError(err.Error())
+					return nil
+				}
+				internal[0] = in[2]
+				internal[1] = table
+			}
+			table := internal[1].(*fsmTable)
+
+			kv.expire(key, time.Now())
+			from := table.initial
+			if state, ok := kv.kv[key]; ok {
+				from, ok = state.(string)
+				if !ok {
+					out[0] = NewError("fsm found non-string state for key " + key)
+					return nil
+				}
+			}
+
+			to, ok := table.transitions[from][event]
+			if !ok {
+				out[1] = map[string]interface{}{
+					"key":   key,
+					"from":  from,
+					"event": event,
+				}
+				return nil
+			}
+
+			if err := kv.set(key, to); err != nil {
+				out[0] = NewError("fsm failed with: " + err.Error())
+				return nil
+			}
+			out[0] = map[string]interface{}{
+				"key":   key,
+				"from":  from,
+				"to":    to,
+				"event": event,
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,139 @@
+package core
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPIngress(t *testing.T) {
+	log.Println("testing http ingress")
+
+	ingressSource := NewHTTPIngress()
+	ingress, ok := ingressSource.(Interface)
+	if !ok {
+		t.Fatal("could not assert http ingress to Interface")
+	}
+	go ingress.Serve()
+	defer ingress.Stop()
+
+	h := ingressSource.(*HTTPIngress)
+	h.SetSourceParameter("timeout", "100ms")
+	h.SetSourceParameter("maxBodySize", "8")
+	if h.Describe()[0]["value"] != "100ms" || h.Describe()[1]["value"] != "8" {
+		t.Fatal("http ingress did not set its parameters", h.Describe())
+	}
+
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	library := GetLibrary()
+	receive := NewBlock(library["httpReceive"])
+	respond := NewBlock(library["httpRespond"])
+	for _, b := range []*Block{receive, respond} {
+		go b.Serve()
+		go DummyMonitor(b.Monitor)
+		err := b.SetSource(ingress)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	respond.SetInput(1, &InputValue{float64(201)})
+	respond.SetInput(2, &InputValue{map[string]interface{}{"X-Test": "yes"}})
+	idIn, _ := respond.GetInput(0)
+	bodyIn, _ := respond.GetInput(3)
+	sent := make(chan Message)
+	respond.Connect(0, sent)
+
+	requests := make(chan Message)
+	receive.Connect(0, requests)
+
+	type result struct {
+		resp *http.Response
+		body string
+	}
+	results := make(chan result)
+	go func() {
+		resp, err := http.Post(server.URL+"/hook?a=1", "text/plain", strings.NewReader("hello"))
+		if err != nil {
+			results <- result{}
+			return
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		results <- result{resp, string(body)}
+	}()
+
+	req := (<-requests).(map[string]interface{})
+	if req["method"] != "POST" || req["path"] != "/hook" || req["body"] != "hello" {
+		t.Fatal("httpReceive emitted unexpected request", req)
+	}
+	if req["query"].(map[string]interface{})["a"] != "1" {
+		t.Error("httpReceive did not emit query", req)
+	}
+	if req["headers"].(map[string]interface{})["Content-Type"] != "text/plain" {
+		t.Error("httpReceive did not emit headers", req)
+	}
+
+	idIn.C <- req["id"]
+	bodyIn.C <- map[string]interface{}{"ok": true}
+	if <-sent != true {
+		t.Fatal("httpRespond failed to respond")
+	}
+
+	r := <-results
+	if r.resp == nil || r.resp.StatusCode != 201 || r.resp.Header.Get("X-Test") != "yes" {
+		t.Fatal("ingress sent unexpected response", r.resp)
+	}
+	if strings.TrimSpace(r.body) != `{"ok":true}` {
+		t.Error("ingress sent unexpected body", r.body)
+	}
+
+	// bodies over maxBodySize are refused before reaching the pattern
+	resp, err := http.Post(server.URL+"/hook", "text/plain", strings.NewReader("far too long"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Error("expected 413 for a large body, got", resp.StatusCode)
+	}
+
+	// statuses that net/http can't send are refused
+	for _, status := range []float64{99, 600, 200.5} {
+		respond.SetInput(1, &InputValue{status})
+		idIn.C <- "1"
+		bodyIn.C <- "bad status"
+		if _, ok := (<-sent).(*stcoreError); !ok {
+			t.Error("expected error responding with status", status)
+		}
+	}
+	respond.SetInput(1, &InputValue{float64(201)})
+
+	// requests that nobody answers time out
+	go func() {
+		resp, err := http.Get(server.URL + "/hook")
+		if err != nil {
+			results <- result{}
+			return
+		}
+		resp.Body.Close()
+		results <- result{resp, ""}
+	}()
+	req = (<-requests).(map[string]interface{})
+	r = <-results
+	if r.resp == nil || r.resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatal("expected 504 for unanswered request")
+	}
+
+	// responding late fails
+	idIn.C <- req["id"]
+	bodyIn.C <- "too late"
+	if _, ok := (<-sent).(*stcoreError); !ok {
+		t.Fatal("expected error responding to timed out request")
+	}
+}
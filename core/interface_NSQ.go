@@ -3,6 +3,8 @@ package core
 import (
 	"errors"
 	"log"
+	"sync"
+	"time"
 
 	"github.com/bitly/go-nsq"
 )
@@ -15,11 +17,21 @@ func NSQConsumerInterface() SourceSpec {
 	}
 }
 
+// NSQConsumer reads from a single topic and channel. It can be connected
+// through nsqlookupd, directly to nsqd, or both, and connecting again
+// replaces the running consumer. Failed connects, and dropped connections to
+// nsqd, are retried with backoff. In manual ack mode messages are only
+// finished or requeued by the NSQAck and NSQRequeue blocks.
 type NSQConsumer struct {
-	connectChan chan NSQConf
-	topic       string
-	fromNSQ     chan string
-	quit        chan chan error
+	connState
+	mu             sync.Mutex
+	reader         *nsq.Consumer
+	conf           *NSQConf
+	pending        map[string]*nsq.Message
+	connectChan    chan NSQConf
+	disconnectChan chan chan error
+	fromNSQ        chan nsqDelivery
+	quit           chan chan error
 }
 
 type NSQConf struct {
@@ -27,6 +39,8 @@ type NSQConf struct {
 	topic      string
 	channel    string
 	lookupAddr string
+	nsqdAddr   string
+	manualAck  bool
 	errChan    chan *stcoreError
 }
 
@@ -35,72 +49,253 @@ type NSQMsg struct {
 	errChan chan *stcoreError
 }
 
-func (s NSQConsumer) GetType() SourceType {
+type nsqDelivery struct {
+	msg    string
+	handle string
+}
+
+// nsqHandler hands messages from one reader to the pattern. done is closed
+// when the reader is stopped, so that blocked handlers can give up.
+type nsqHandler struct {
+	s         *NSQConsumer
+	manualAck bool
+	done      chan struct{}
+}
+
+func (s *NSQConsumer) GetType() SourceType {
 	return NSQCONSUMER
 }
 
 func NewNSQConsumer() Source {
 	return &NSQConsumer{
-		quit:        make(chan chan error),
-		connectChan: make(chan NSQConf),
-		fromNSQ:     make(chan string),
+		connState:      newConnState(),
+		quit:           make(chan chan error),
+		connectChan:    make(chan NSQConf),
+		disconnectChan: make(chan chan error),
+		fromNSQ:        make(chan nsqDelivery),
+		pending:        make(map[string]*nsq.Message),
 	}
 }
 
-func (s NSQConsumer) Serve() {
-	var reader *nsq.Consumer
-	var err error
+func (s *NSQConsumer) Serve() {
+	var handler *nsqHandler
+	var retry <-chan time.Time
+	retries := 0
+	check := time.NewTicker(reconnectPoll)
+	defer check.Stop()
+
+	// reconnect replaces the running reader using the last connect's parameters
+	reconnect := func() *stcoreError {
+		s.disconnect(handler)
+		s.mu.Lock()
+		conf := *s.conf
+		s.mu.Unlock()
+		handler = &nsqHandler{s, conf.manualAck, make(chan struct{})}
+		err := s.connect(conf, handler)
+		if err != nil {
+			s.disconnect(handler)
+			handler = nil
+		}
+		return err
+	}
+
+	scheduleRetry := func(err string) {
+		s.setStatus(STATUS_RETRYING, retries, err)
+		retry = time.After(reconnectDelay(retries))
+		retries++
+	}
+
 	for {
 		select {
 		case conf := <-s.connectChan:
-			reader, err = nsq.NewConsumer(conf.topic, conf.channel, conf.conf)
+			s.mu.Lock()
+			s.conf = &conf
+			s.mu.Unlock()
+			retries = 0
+			retry = nil
+			err := reconnect()
+			conf.errChan <- err
 			if err != nil {
-				select {
-				case conf.errChan <- NewError("NSQ failed to create Consumer with error:" + err.Error()):
-				default:
-				}
+				scheduleRetry(err.Error())
 				continue
 			}
-			reader.AddHandler(s)
-			err = reader.ConnectToNSQLookupd(conf.lookupAddr)
+			s.setStatus(s.readerStatus(), 0, "")
+		case <-retry:
+			retry = nil
+			err := reconnect()
 			if err != nil {
-				select {
-				case conf.errChan <- NewError("NSQ connect failed with:" + err.Error()):
-				default:
-				}
+				scheduleRetry(err.Error())
 				continue
 			}
-		case c := <-s.quit:
-			if reader != nil {
-				reader.Stop()
-				<-reader.StopChan // this blocks until the reader is definitely dead
-				reader = nil
+			retries = 0
+			s.setStatus(s.readerStatus(), 0, "")
+		case <-check.C:
+			if handler == nil {
+				continue
+			}
+			status := s.readerStatus()
+			// go-nsq only retries nsqd connections every 15 seconds, so
+			// we replace the reader and back off on our own
+			if status == STATUS_CONNECTING && s.getStatus() == STATUS_CONNECTED && s.conf.nsqdAddr != "" {
+				s.disconnect(handler)
+				handler = nil
+				scheduleRetry("NSQ connection to nsqd dropped")
+				continue
 			}
+			s.setStatus(status, 0, "")
+		case c := <-s.disconnectChan:
+			s.disconnect(handler)
+			handler = nil
+			retry = nil
+			s.mu.Lock()
+			s.conf = nil
+			s.mu.Unlock()
+			s.setStatus(STATUS_DISCONNECTED, 0, "")
+			c <- nil
+		case c := <-s.quit:
+			s.disconnect(handler)
+			s.setStatus(STATUS_DISCONNECTED, 0, "")
 			c <- nil
+			return
 		}
 	}
 }
 
-func (s NSQConsumer) HandleMessage(message *nsq.Message) error {
-	// this blocks until ReceiveMessage is called
-	s.fromNSQ <- string(message.Body)
+// readerStatus is connected if the reader has any nsqd connections
+func (s *NSQConsumer) readerStatus() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reader == nil {
+		return STATUS_DISCONNECTED
+	}
+	if s.reader.Stats().Connections > 0 {
+		return STATUS_CONNECTED
+	}
+	return STATUS_CONNECTING
+}
+
+func (s *NSQConsumer) connect(conf NSQConf, handler *nsqHandler) *stcoreError {
+	reader, err := nsq.NewConsumer(conf.topic, conf.channel, conf.conf)
+	if err != nil {
+		return NewError("NSQ failed to create Consumer with error:" + err.Error())
+	}
+	reader.AddHandler(handler)
+
+	s.mu.Lock()
+	s.reader = reader
+	s.mu.Unlock()
+
+	if conf.nsqdAddr != "" {
+		err = reader.ConnectToNSQD(conf.nsqdAddr)
+		if err != nil {
+			return NewError("NSQ connect to nsqd failed with:" + err.Error())
+		}
+	}
+	if conf.lookupAddr != "" {
+		err = reader.ConnectToNSQLookupd(conf.lookupAddr)
+		if err != nil {
+			return NewError("NSQ connect to lookupd failed with:" + err.Error())
+		}
+	}
 	return nil
 }
 
-func (s NSQConsumer) ReceiveMessage(i chan Interrupt) (string, Interrupt, error) {
+// disconnect stops the running reader. Messages waiting for an ack are
+// requeued, as the reader can't stop while they are in flight.
+func (s *NSQConsumer) disconnect(handler *nsqHandler) {
+	if handler != nil {
+		close(handler.done)
+	}
+
+	s.mu.Lock()
+	reader := s.reader
+	s.reader = nil
+	for handle, m := range s.pending {
+		m.Requeue(-1)
+		delete(s.pending, handle)
+	}
+	s.mu.Unlock()
+
+	if reader != nil {
+		reader.Stop()
+		<-reader.StopChan // this blocks until the reader is definitely dead
+	}
+}
+
+func (h *nsqHandler) HandleMessage(message *nsq.Message) error {
+	handle := ""
+	if h.manualAck {
+		message.DisableAutoResponse()
+		handle = string(message.ID[:])
+		h.s.mu.Lock()
+		h.s.pending[handle] = message
+		h.s.mu.Unlock()
+	}
+
+	// this blocks until ReceiveMessage is called
+	select {
+	case h.s.fromNSQ <- nsqDelivery{string(message.Body), handle}:
+		return nil
+	case <-h.done:
+		// in manual ack mode the message may already have been requeued
+		// by disconnect, otherwise returning an error requeues it
+		if h.manualAck {
+			h.s.Respond(handle, true, -1)
+		}
+		return errors.New("NSQ consumer has stopped")
+	}
+}
+
+// State reports whether the consumer is connected, and how it was configured
+func (s *NSQConsumer) State() map[string]interface{} {
+	state := s.connState.connState()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reader != nil {
+		state["connections"] = float64(s.reader.Stats().Connections)
+	}
+	if s.conf != nil {
+		state["topic"] = s.conf.topic
+		state["channel"] = s.conf.channel
+		state["lookupAddr"] = s.conf.lookupAddr
+		state["nsqdAddr"] = s.conf.nsqdAddr
+		state["manualAck"] = s.conf.manualAck
+	}
+	return state
+}
+
+func (s *NSQConsumer) ReceiveMessage(i chan Interrupt) (nsqDelivery, Interrupt, error) {
 	// receives message
 	select {
 	case msg, ok := <-s.fromNSQ:
 		if !ok {
-			return "", nil, errors.New("NSQ connection has closed")
+			return nsqDelivery{}, nil, errors.New("NSQ connection has closed")
 		}
 		return msg, nil, nil
 	case f := <-i:
-		return "", f, nil
+		return nsqDelivery{}, f, nil
 	}
 }
 
-func (s NSQConsumer) Stop() {
+// Respond finishes the message with the given handle, or requeues it if
+// requeue is true.
+func (s *NSQConsumer) Respond(handle string, requeue bool, delay time.Duration) *stcoreError {
+	s.mu.Lock()
+	m, ok := s.pending[handle]
+	delete(s.pending, handle)
+	s.mu.Unlock()
+	if !ok {
+		return NewError("NSQ has no message waiting for an ack with handle " + handle)
+	}
+	if requeue {
+		m.Requeue(delay)
+	} else {
+		m.Finish()
+	}
+	return nil
+}
+
+func (s *NSQConsumer) Stop() {
 	m := make(chan error)
 	s.quit <- m
 	// block until closed
@@ -110,12 +305,27 @@ func (s NSQConsumer) Stop() {
 	}
 }
 
+// NSQConsumerConnect connects the consumer through lookupAddr, nsqdAddr, or
+// both; either address can be left empty. Connecting again replaces the
+// running consumer. With manualAck, messages are only finished or requeued
+// by NSQAck and NSQRequeue. nsqdAddr and manualAck default to "" and false.
 func NSQConsumerConnect() Spec {
 	return Spec{
 		Name:    "NSQConsumerConnect",
 		Outputs: []Pin{Pin{"connected", BOOLEAN}},
-		Inputs:  []Pin{Pin{"topic", STRING}, Pin{"channel", STRING}, Pin{"lookupAddr", STRING}, Pin{"maxInFlight", NUMBER}},
-		Source:  NSQCONSUMER,
+		Inputs: []Pin{
+			Pin{"topic", STRING},
+			Pin{"channel", STRING},
+			Pin{"lookupAddr", STRING},
+			Pin{"maxInFlight", NUMBER},
+			Pin{"nsqdAddr", STRING},
+			Pin{"manualAck", BOOLEAN},
+		},
+		Defaults: map[RouteIndex]Message{
+			4: "",
+			5: false,
+		},
+		Source: NSQCONSUMER,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
 
 			topic, ok := in[0].(string)
@@ -138,6 +348,20 @@ func NSQConsumerConnect() Spec {
 				out[0] = NewError("NSQConnect requries number maxInFlight")
 				return nil
 			}
+			nsqdAddr, ok := in[4].(string)
+			if !ok {
+				out[0] = NewError("NSQConnect requries string nsqdAddr")
+				return nil
+			}
+			if lookupAddr == "" && nsqdAddr == "" {
+				out[0] = NewError("NSQConnect requires one of lookupAddr or nsqdAddr")
+				return nil
+			}
+			manualAck, ok := in[5].(bool)
+			if !ok {
+				out[0] = NewError("NSQConnect requries boolean manualAck")
+				return nil
+			}
 
 			conf := nsq.NewConfig()
 			conf.MaxInFlight = int(maxInFlight)
@@ -147,17 +371,24 @@ func NSQConsumerConnect() Spec {
 				log.Fatal("could not assert source is NSQ")
 			}
 
-			errChan := make(chan *stcoreError)
+			// buffered, in case the connect block has been interrupted
+			errChan := make(chan *stcoreError, 1)
 
 			connParams := NSQConf{
 				conf:       conf,
 				topic:      topic,
 				channel:    channel,
 				lookupAddr: lookupAddr,
+				nsqdAddr:   nsqdAddr,
+				manualAck:  manualAck,
 				errChan:    errChan,
 			}
 
-			nsq.connectChan <- connParams
+			select {
+			case nsq.connectChan <- connParams:
+			case f := <-i:
+				return f
+			}
 
 			// block on connect
 			select {
@@ -176,14 +407,39 @@ func NSQConsumerConnect() Spec {
 	}
 }
 
+// NSQConsumerDisconnect stops the running consumer when it receives any
+// message. Messages waiting for an ack are requeued.
+func NSQConsumerDisconnect() Spec {
+	return Spec{
+		Name:    "NSQConsumerDisconnect",
+		Inputs:  []Pin{Pin{"disconnect", ANY}},
+		Outputs: []Pin{Pin{"disconnected", BOOLEAN}},
+		Source:  NSQCONSUMER,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			nsq := s.(*NSQConsumer)
+			c := make(chan error, 1)
+			select {
+			case nsq.disconnectChan <- c:
+			case f := <-i:
+				return f
+			}
+			<-c
+			out[0] = true
+			return nil
+		},
+	}
+}
+
 // NSQRecieve receives messages from the NSQ system.
 //
 // OutPin 0: received message
+// OutPin 1: the message's handle, only emitted in manual ack mode
 func NSQConsumerReceive() Spec {
 	return Spec{
 		Name: "NSQConsumerReceive",
 		Outputs: []Pin{
 			Pin{"out", STRING},
+			Pin{"handle", STRING},
 		},
 		Source: NSQCONSUMER,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
@@ -196,7 +452,68 @@ func NSQConsumerReceive() Spec {
 			if f != nil {
 				return f
 			}
-			out[0] = string(msg)
+			out[0] = msg.msg
+			if msg.handle != "" {
+				out[1] = msg.handle
+			}
+			return nil
+		},
+	}
+}
+
+// NSQAck finishes the message with the given handle
+func NSQAck() Spec {
+	return Spec{
+		Name:    "NSQAck",
+		Inputs:  []Pin{Pin{"handle", STRING}},
+		Outputs: []Pin{Pin{"acked", BOOLEAN}},
+		Source:  NSQCONSUMER,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			handle, ok := in[0].(string)
+			if !ok {
+				out[0] = NewError("NSQAck requires string handle")
+				return nil
+			}
+			err := s.(*NSQConsumer).Respond(handle, false, 0)
+			if err != nil {
+				out[0] = err
+				return nil
+			}
+			out[0] = true
+			return nil
+		},
+	}
+}
+
+// NSQRequeue requeues the message with the given handle after delay
+func NSQRequeue() Spec {
+	return Spec{
+		Name:    "NSQRequeue",
+		Inputs:  []Pin{Pin{"handle", STRING}, Pin{"delay", STRING}},
+		Outputs: []Pin{Pin{"requeued", BOOLEAN}},
+		Source:  NSQCONSUMER,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			handle, ok := in[0].(string)
+			if !ok {
+				out[0] = NewError("NSQRequeue requires string handle")
+				return nil
+			}
+			delayString, ok := in[1].(string)
+			if !ok {
+				out[0] = NewError("NSQRequeue requires string delay")
+				return nil
+			}
+			delay, err := time.ParseDuration(delayString)
+			if err != nil {
+				out[0] = NewError("NSQRequeue could not parse delay")
+				return nil
+			}
+			e := s.(*NSQConsumer).Respond(handle, true, delay)
+			if e != nil {
+				out[0] = e
+				return nil
+			}
+			out[0] = true
 			return nil
 		},
 	}
@@ -0,0 +1,217 @@
+package core
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bitly/go-nsq"
+)
+
+func NSQProducerInterface() SourceSpec {
+	return SourceSpec{
+		Name: "NSQProducer",
+		Type: NSQPRODUCER,
+		New:  NewNSQProducer,
+	}
+}
+
+const defaultNSQDAddr = "127.0.0.1:4150"
+
+// NSQProducer publishes to a single nsqd. It is configured with the nsqd
+// parameter, the nsqd TCP address, and any other parameter is treated as an
+// nsq config option, such as dial_timeout or client_id. The producer is
+// created on the first publish, and recreated after its parameters change.
+type NSQProducer struct {
+	mu       sync.Mutex
+	addr     string
+	options  map[string]string
+	producer *nsq.Producer
+	quit     chan struct{}
+}
+
+func NewNSQProducer() Source {
+	return &NSQProducer{
+		addr:    defaultNSQDAddr,
+		options: make(map[string]string),
+		quit:    make(chan struct{}),
+	}
+}
+
+func (p *NSQProducer) GetType() SourceType {
+	return NSQPRODUCER
+}
+
+func (p *NSQProducer) SetSourceParameter(name, value string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch name {
+	case "nsqd":
+		p.addr = value
+	default:
+		// only keep options that nsq will accept
+		conf := nsq.NewConfig()
+		if conf.Set(name, value) != nil || conf.Validate() != nil {
+			return
+		}
+		p.options[name] = value
+	}
+	p.reset()
+}
+
+func (p *NSQProducer) Describe() []map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	params := []map[string]string{
+		{"name": "nsqd", "value": p.addr},
+	}
+	names := []string{}
+	for name := range p.options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		params = append(params, map[string]string{"name": name, "value": p.options[name]})
+	}
+	return params
+}
+
+// reset stops the current producer so that the next publish creates one
+// with the latest parameters. The caller must hold the mutex.
+func (p *NSQProducer) reset() {
+	if p.producer != nil {
+		p.producer.Stop()
+		p.producer = nil
+	}
+}
+
+func (p *NSQProducer) getProducer() (*nsq.Producer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.producer != nil {
+		return p.producer, nil
+	}
+	conf := nsq.NewConfig()
+	for name, value := range p.options {
+		conf.Set(name, value)
+	}
+	producer, err := nsq.NewProducer(p.addr, conf)
+	if err != nil {
+		return nil, err
+	}
+	p.producer = producer
+	return producer, nil
+}
+
+func (p *NSQProducer) Serve() {
+	<-p.quit
+}
+
+func (p *NSQProducer) Stop() {
+	close(p.quit)
+	p.mu.Lock()
+	p.reset()
+	p.mu.Unlock()
+}
+
+// Publish sends one message to topic, or several messages at once if there
+// are more than one. Messages can be deferred by delay, but only one at a time.
+func (p *NSQProducer) Publish(topic string, msgs [][]byte, delay time.Duration, i chan Interrupt) (*stcoreError, Interrupt) {
+	producer, err := p.getProducer()
+	if err != nil {
+		return NewError("NSQ failed to create Producer with error:" + err.Error()), nil
+	}
+
+	done := make(chan *nsq.ProducerTransaction, 1)
+	switch {
+	case delay > 0 && len(msgs) == 1:
+		err = producer.DeferredPublishAsync(topic, delay, msgs[0], done)
+	case delay > 0:
+		return NewError("NSQ can only defer a single message"), nil
+	case len(msgs) == 1:
+		err = producer.PublishAsync(topic, msgs[0], done)
+	default:
+		err = producer.MultiPublishAsync(topic, msgs, done)
+	}
+	if err != nil {
+		return NewError("NSQ publish failed with: " + err.Error()), nil
+	}
+
+	select {
+	case t := <-done:
+		if t.Error != nil {
+			return NewError("NSQ publish failed with: " + t.Error.Error()), nil
+		}
+		return nil, nil
+	case f := <-i:
+		return nil, f
+	}
+}
+
+// NSQProducerPublish publishes msg to topic. Strings are published as they
+// are, and other values as JSON. An array is published as one message per
+// element in a single multi-publish. Messages are deferred by delay, which
+// can be "0s" to publish immediately.
+func NSQProducerPublish() Spec {
+	return Spec{
+		Name:    "NSQProducerPublish",
+		Inputs:  []Pin{Pin{"topic", STRING}, Pin{"msg", ANY}, Pin{"delay", STRING}},
+		Outputs: []Pin{Pin{"published", BOOLEAN}},
+		Source:  NSQPRODUCER,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			topic, ok := in[0].(string)
+			if !ok {
+				out[0] = NewError("NSQProducerPublish requires string topic")
+				return nil
+			}
+
+			delayString, ok := in[2].(string)
+			if !ok {
+				out[0] = NewError("NSQProducerPublish requires string delay")
+				return nil
+			}
+			delay, err := time.ParseDuration(delayString)
+			if err != nil {
+				out[0] = NewError("NSQProducerPublish could not parse delay")
+				return nil
+			}
+
+			values := []interface{}{in[1]}
+			if arr, ok := in[1].([]interface{}); ok {
+				values = arr
+			}
+			if len(values) == 0 {
+				out[0] = NewError("NSQProducerPublish cannot publish an empty array")
+				return nil
+			}
+
+			msgs := make([][]byte, len(values))
+			for j, v := range values {
+				if str, ok := v.(string); ok {
+					msgs[j] = []byte(str)
+					continue
+				}
+				b, err := json.Marshal(v)
+				if err != nil {
+					out[0] = NewError("NSQProducerPublish could not marshal msg")
+					return nil
+				}
+				msgs[j] = b
+			}
+
+			nsq := s.(*NSQProducer)
+			e, f := nsq.Publish(topic, msgs, delay, i)
+			if f != nil {
+				return f
+			}
+			if e != nil {
+				out[0] = e
+				return nil
+			}
+
+			out[0] = true
+			return nil
+		},
+	}
+}
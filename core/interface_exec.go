@@ -0,0 +1,419 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+func ExecInterface() SourceSpec {
+	return SourceSpec{
+		Name: "exec",
+		Type: EXEC,
+		New:  NewExec,
+	}
+}
+
+// how long a stopped process has to exit after SIGTERM before it is killed
+var execKillTimeout = 5 * time.Second
+
+// how long the output of a process that has exited is still read for, in
+// case a child it started holds its pipes open
+var execDrainTimeout = time.Second
+
+const execMaxLine = 1024 * 1024
+
+type execLine struct {
+	line   string
+	stderr bool
+}
+
+// execSource runs command with args and env, and restarts it with backoff
+// whenever it exits. args is a JSON array of strings and env is a JSON object
+// of strings. Outside of Windows, the process runs in its own process group,
+// which is killed when the process is restarted or the source is stopped.
+// Changing a parameter restarts the process.
+type execSource struct {
+	connState
+	mu      sync.Mutex
+	command string
+	args    []string
+	env     map[string]string
+	pid     int
+	stdin   io.WriteCloser
+	writeMu sync.Mutex
+	restart chan struct{}
+	lines   chan execLine
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+func NewExec() Source {
+	return &execSource{
+		connState: newConnState(),
+		args:      []string{},
+		env:       map[string]string{},
+		restart:   make(chan struct{}, 1),
+		lines:     make(chan execLine),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (e *execSource) GetType() SourceType {
+	return EXEC
+}
+
+func (e *execSource) SetSourceParameter(name, value string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch name {
+	case "command":
+		e.command = value
+	case "args":
+		var args []string
+		if json.Unmarshal([]byte(value), &args) != nil || args == nil {
+			return
+		}
+		e.args = args
+	case "env":
+		var env map[string]string
+		if json.Unmarshal([]byte(value), &env) != nil || env == nil {
+			return
+		}
+		e.env = env
+	default:
+		return
+	}
+	select {
+	case e.restart <- struct{}{}:
+	default:
+	}
+}
+
+func (e *execSource) Describe() []map[string]string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	args, _ := json.Marshal(e.args)
+	env, _ := json.Marshal(e.env)
+	return []map[string]string{
+		{"name": "command", "value": e.command},
+		{"name": "args", "value": string(args)},
+		{"name": "env", "value": string(env)},
+	}
+}
+
+func (e *execSource) State() map[string]interface{} {
+	state := e.connState.connState()
+	e.mu.Lock()
+	state["command"] = e.command
+	if e.pid != 0 {
+		state["pid"] = float64(e.pid)
+	}
+	e.mu.Unlock()
+	return state
+}
+
+// errNotConfigured is returned by start when there is no command to run
+var errNotConfigured = errors.New("not configured")
+
+// Serve keeps the process running until the source is stopped, restarting it
+// with backoff whenever it exits. Starting a process almost always succeeds,
+// so unlike the sockets, the backoff is only reset once the process has run
+// for reconnectMax. Otherwise a command that fails straight away would be
+// restarted every reconnectBase forever.
+func (e *execSource) Serve() {
+	defer close(e.done)
+
+	// parameters set before serving don't need a restart
+	select {
+	case <-e.restart:
+	default:
+	}
+
+	retries := 0
+	for {
+		e.setStatus(STATUS_CONNECTING, retries, "")
+		closer, failed, err := e.start()
+		if err == errNotConfigured {
+			e.setStatus(STATUS_DISCONNECTED, 0, "")
+			select {
+			case <-e.restart:
+				continue
+			case <-e.quit:
+				return
+			}
+		}
+		if err == nil {
+			started := time.Now()
+			e.setStatus(STATUS_CONNECTED, 0, "")
+			select {
+			case err = <-failed:
+				closer.Close()
+				if time.Since(started) >= reconnectMax {
+					retries = 0
+				}
+			case <-e.restart:
+				closer.Close()
+				retries = 0
+				continue
+			case <-e.quit:
+				closer.Close()
+				e.setStatus(STATUS_DISCONNECTED, 0, "")
+				return
+			}
+		}
+
+		e.setStatus(STATUS_RETRYING, retries, err.Error())
+		select {
+		case <-time.After(reconnectDelay(retries)):
+			retries++
+		case <-e.restart:
+			retries = 0
+		case <-e.quit:
+			e.setStatus(STATUS_DISCONNECTED, 0, "")
+			return
+		}
+	}
+}
+
+func (e *execSource) Stop() {
+	close(e.quit)
+	<-e.done
+}
+
+// start starts the process, and returns a closer that kills its process group
+func (e *execSource) start() (io.Closer, <-chan error, error) {
+	e.mu.Lock()
+	command := e.command
+	cmd := exec.Command(command, e.args...)
+	cmd.Env = os.Environ()
+	keys := []string{}
+	for k := range e.env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cmd.Env = append(cmd.Env, k+"="+e.env[k])
+	}
+	e.mu.Unlock()
+
+	if command == "" {
+		return nil, nil, errNotConfigured
+	}
+
+	execSetGroup(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	// the output pipes are made here rather than with StdoutPipe, since
+	// Wait closes those, and the process has to be reaped as soon as it
+	// exits even if a child it started still holds them open
+	stdout, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	stderr, stderrW, err := os.Pipe()
+	if err != nil {
+		stdout.Close()
+		stdoutW.Close()
+		return nil, nil, err
+	}
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+	err = cmd.Start()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		stdout.Close()
+		stderr.Close()
+		return nil, nil, err
+	}
+
+	e.mu.Lock()
+	e.pid = cmd.Process.Pid
+	e.stdin = stdin
+	e.mu.Unlock()
+
+	// stopped is closed when the process is being killed, and drained when
+	// its output stops being read, so that its readers don't wait to deliver
+	// lines that nobody will receive
+	stopped := make(chan struct{})
+	drained := make(chan struct{})
+	var readers sync.WaitGroup
+	for _, r := range []struct {
+		pipe   io.Reader
+		stderr bool
+	}{{stdout, false}, {stderr, true}} {
+		readers.Add(1)
+		go func(pipe io.Reader, isStderr bool) {
+			defer readers.Done()
+			// whatever isn't delivered is discarded, so that the process
+			// never blocks on a full pipe
+			defer io.Copy(ioutil.Discard, pipe)
+			scanner := bufio.NewScanner(pipe)
+			scanner.Buffer(make([]byte, 64*1024), execMaxLine)
+			for scanner.Scan() {
+				select {
+				case e.lines <- execLine{scanner.Text(), isStderr}:
+				case <-stopped:
+					return
+				case <-drained:
+					return
+				case <-e.quit:
+					return
+				}
+			}
+		}(r.pipe, r.stderr)
+	}
+	readersDone := make(chan struct{})
+	go func() {
+		readers.Wait()
+		close(readersDone)
+	}()
+
+	failed := make(chan error, 1)
+	exited := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		err := cmd.Wait()
+		if err == nil {
+			err = errors.New(command + " exited")
+		}
+		e.mu.Lock()
+		if e.stdin == stdin {
+			e.pid = 0
+			e.stdin = nil
+		}
+		e.mu.Unlock()
+		close(exited)
+
+		// the rest of the output is read until the pipes are closed, unless
+		// a child of the process holds them open
+		select {
+		case <-readersDone:
+		case <-time.After(execDrainTimeout):
+		}
+		close(drained)
+		stdout.Close()
+		stderr.Close()
+		<-readersDone
+		failed <- err
+	}()
+
+	return closerFunc(func() error {
+		close(stopped)
+		// once the process has been reaped its group may be gone, and its
+		// id reused, so it isn't signalled
+		select {
+		case <-exited:
+		default:
+			execSignalGroup(cmd, false)
+			select {
+			case <-exited:
+			case <-time.After(execKillTimeout):
+				execSignalGroup(cmd, true)
+			}
+		}
+		<-finished
+		return nil
+	}), failed, nil
+}
+
+// Send writes msg to the process's stdin as a line. Writes are made one at a
+// time without holding mu, so a process that stops reading stdin only holds
+// up its senders, and they can still be interrupted.
+func (e *execSource) Send(msg []byte, i chan Interrupt) (*stcoreError, Interrupt) {
+	e.mu.Lock()
+	stdin := e.stdin
+	e.mu.Unlock()
+	if stdin == nil {
+		return NewError("execSend failed with: exec process is not running"), nil
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		e.writeMu.Lock()
+		defer e.writeMu.Unlock()
+		_, err := stdin.Write(append(msg, '\n'))
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		if err != nil {
+			return NewError("execSend failed with: " + err.Error()), nil
+		}
+		return nil, nil
+	case f := <-i:
+		return nil, f
+	}
+}
+
+func (e *execSource) ReceiveMessage(i chan Interrupt) (execLine, Interrupt) {
+	select {
+	case line := <-e.lines:
+		return line, nil
+	case f := <-i:
+		return execLine{}, f
+	}
+}
+
+// ExecSend writes msg to the stdin of an exec source's process as a line.
+// Strings are written as they are, and anything else as JSON.
+func ExecSend() Spec {
+	return Spec{
+		Name:    "execSend",
+		Inputs:  []Pin{Pin{"msg", ANY}},
+		Outputs: []Pin{Pin{"sent", BOOLEAN}},
+		Source:  EXEC,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			msg, err := socketMessage(in[0])
+			if err != nil {
+				out[0] = NewError("execSend could not marshal msg")
+				return nil
+			}
+			e, f := s.(*execSource).Send(msg, i)
+			if f != nil {
+				return f
+			}
+			if e != nil {
+				out[0] = e
+				return nil
+			}
+			out[0] = true
+			return nil
+		},
+	}
+}
+
+// ExecReceive emits each line an exec source's process writes to stdout, and
+// each line it writes to stderr as an error
+func ExecReceive() Spec {
+	return Spec{
+		Name:    "execReceive",
+		Outputs: []Pin{Pin{"line", STRING}},
+		Source:  EXEC,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			line, f := s.(*execSource).ReceiveMessage(i)
+			if f != nil {
+				return f
+			}
+			if line.stderr {
+				out[0] = NewError(line.line)
+				return nil
+			}
+			out[0] = line.line
+			return nil
+		},
+	}
+}
@@ -0,0 +1,409 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func FileTailInterface() SourceSpec {
+	return SourceSpec{
+		Name: "fileTail",
+		Type: FILETAIL,
+		New:  NewFileTail,
+	}
+}
+
+const (
+	FILETAIL_START_END       = "end"
+	FILETAIL_START_BEGINNING = "beginning"
+
+	defaultFileTailPoll = 250 * time.Millisecond
+)
+
+type fileTailLine struct {
+	line   string
+	path   string
+	offset int64
+}
+
+// fileTailOffset is the checkpointed position in a file, along with the
+// identity of the file, so that the offset isn't used in a different file.
+type fileTailOffset struct {
+	Offset int64  `json:"offset"`
+	ID     string `json:"id,omitempty"`
+}
+
+// fileTailFile is an open file being followed. offset is the position just
+// after the last complete line read, and partial holds anything read since.
+type fileTailFile struct {
+	path    string
+	file    *os.File
+	info    os.FileInfo
+	offset  int64
+	partial []byte
+}
+
+// fileTail follows every file matching its paths, like tail -F. Files are
+// polled for new lines. A file that is replaced, as when a log is rotated, is
+// read to its end before the new file is followed from its beginning, and a
+// file that shrinks is assumed to have been truncated and is followed from its
+// beginning. If checkpoint names a file, the offset after the last line
+// emitted from each file is saved there along with the file's identity, so
+// that the source resumes where it left off when it is restarted, unless the
+// file has been replaced in the meantime.
+type fileTail struct {
+	mu           sync.Mutex
+	paths        []string
+	start        string
+	checkpoint   string
+	pollInterval time.Duration
+	files        map[string]*fileTailFile
+	offsets      map[string]fileTailOffset
+	lines        chan fileTailLine
+	quit         chan struct{}
+	done         chan struct{}
+}
+
+func NewFileTail() Source {
+	return &fileTail{
+		start:        FILETAIL_START_END,
+		pollInterval: defaultFileTailPoll,
+		files:        make(map[string]*fileTailFile),
+		offsets:      make(map[string]fileTailOffset),
+		lines:        make(chan fileTailLine),
+		quit:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+func (t *fileTail) GetType() SourceType {
+	return FILETAIL
+}
+
+func (t *fileTail) SetSourceParameter(name, value string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch name {
+	case "paths":
+		t.paths = nil
+		for _, p := range strings.Split(value, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				t.paths = append(t.paths, p)
+			}
+		}
+	case "start":
+		if value != FILETAIL_START_END && value != FILETAIL_START_BEGINNING {
+			return
+		}
+		t.start = value
+	case "checkpoint":
+		t.checkpoint = value
+	case "pollInterval":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return
+		}
+		t.pollInterval = d
+	}
+}
+
+func (t *fileTail) Describe() []map[string]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return []map[string]string{
+		{"name": "paths", "value": strings.Join(t.paths, ",")},
+		{"name": "start", "value": t.start},
+		{"name": "checkpoint", "value": t.checkpoint},
+		{"name": "pollInterval", "value": t.pollInterval.String()},
+	}
+}
+
+func (t *fileTail) config() ([]string, string, string, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.paths, t.start, t.checkpoint, t.pollInterval
+}
+
+func (t *fileTail) Serve() {
+	defer close(t.done)
+	defer func() {
+		for path, f := range t.files {
+			f.file.Close()
+			delete(t.files, path)
+		}
+	}()
+
+	_, _, checkpoint, _ := t.config()
+	if checkpoint != "" {
+		data, err := ioutil.ReadFile(checkpoint)
+		if err == nil {
+			t.offsets = readFileTailCheckpoint(data)
+		}
+	}
+
+	initial := true
+	for {
+		dirty, ok := t.poll(initial)
+		if dirty {
+			t.saveCheckpoint()
+		}
+		if !ok {
+			return
+		}
+		initial = false
+
+		_, _, _, interval := t.config()
+		select {
+		case <-time.After(interval):
+		case <-t.quit:
+			return
+		}
+	}
+}
+
+func (t *fileTail) Stop() {
+	close(t.quit)
+	<-t.done
+}
+
+// poll follows any new files and reads new lines from every file. It reports
+// whether any offsets changed, and returns false once the source is stopped.
+func (t *fileTail) poll(initial bool) (bool, bool) {
+	patterns, start, _, _ := t.config()
+	matched := make(map[string]bool)
+	for _, pattern := range patterns {
+		paths, _ := filepath.Glob(pattern)
+		for _, path := range paths {
+			matched[path] = true
+		}
+	}
+
+	dirty := false
+
+	// files that have gone are read to their end and forgotten
+	for path, f := range t.files {
+		if matched[path] {
+			continue
+		}
+		d, ok := t.finish(f)
+		dirty = dirty || d
+		delete(t.files, path)
+		delete(t.offsets, path)
+		if !ok {
+			return dirty, false
+		}
+	}
+
+	paths := []string{}
+	for path := range matched {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		f, ok := t.files[path]
+		if ok && !os.SameFile(f.info, info) {
+			// the file has been rotated, so finish the old one
+			d, ok := t.finish(f)
+			dirty = dirty || d
+			delete(t.files, path)
+			if !ok {
+				return dirty, false
+			}
+			if !t.follow(path, info, 0) {
+				continue
+			}
+			dirty = true
+		} else if !ok {
+			checkpointed, ok := t.offsets[path]
+			offset := checkpointed.Offset
+			switch {
+			case !ok:
+				offset = 0
+				if initial && start == FILETAIL_START_END {
+					offset = info.Size()
+				}
+			case checkpointed.ID != "" && checkpointed.ID != fileTailID(info):
+				// the file was replaced while we weren't following it
+				offset = 0
+			case offset > info.Size():
+				// the file was truncated while we weren't following it
+				offset = 0
+			}
+			if !t.follow(path, info, offset) {
+				continue
+			}
+			dirty = true
+		} else if info.Size() < f.offset+int64(len(f.partial)) {
+			// the file has been truncated
+			f.file.Seek(0, io.SeekStart)
+			f.offset = 0
+			f.partial = nil
+			t.offsets[path] = fileTailOffset{0, fileTailID(info)}
+			dirty = true
+		}
+
+		f = t.files[path]
+		f.info = info
+		d, ok := t.read(f)
+		dirty = dirty || d
+		if !ok {
+			return dirty, false
+		}
+	}
+	return dirty, true
+}
+
+// follow opens the file at path and starts following it from offset
+func (t *fileTail) follow(path string, info os.FileInfo, offset int64) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return false
+	}
+	t.files[path] = &fileTailFile{
+		path:   path,
+		file:   file,
+		info:   info,
+		offset: offset,
+	}
+	t.offsets[path] = fileTailOffset{offset, fileTailID(info)}
+	return true
+}
+
+// read emits every complete line that has been written to f since the last
+// read. It reports whether any lines were emitted, and returns false if the
+// source is stopped before they all are.
+func (t *fileTail) read(f *fileTailFile) (bool, bool) {
+	emitted := false
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.file.Read(buf)
+		data := buf[:n]
+		for len(data) > 0 {
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				f.partial = append(f.partial, data...)
+				break
+			}
+			line := append(f.partial, data[:i]...)
+			next := f.offset + int64(len(line)) + 1
+			data = data[i+1:]
+
+			select {
+			case t.lines <- fileTailLine{strings.TrimSuffix(string(line), "\r"), f.path, f.offset}:
+			case <-t.quit:
+				return emitted, false
+			}
+			f.offset = next
+			f.partial = nil
+			t.offsets[f.path] = fileTailOffset{next, fileTailID(f.info)}
+			emitted = true
+		}
+		if err != nil {
+			return emitted, true
+		}
+	}
+}
+
+// finish reads f to its end and closes it. A partial line at the end of the
+// file will never be completed, so it is emitted as it is.
+func (t *fileTail) finish(f *fileTailFile) (bool, bool) {
+	defer f.file.Close()
+	emitted, ok := t.read(f)
+	if !ok || len(f.partial) == 0 {
+		return emitted, ok
+	}
+	select {
+	case t.lines <- fileTailLine{strings.TrimSuffix(string(f.partial), "\r"), f.path, f.offset}:
+	case <-t.quit:
+		return emitted, false
+	}
+	f.offset += int64(len(f.partial))
+	f.partial = nil
+	return true, true
+}
+
+// readFileTailCheckpoint reads a checkpoint file. Checkpoints that only hold
+// offsets, as they did before files were identified, are still read.
+func readFileTailCheckpoint(data []byte) map[string]fileTailOffset {
+	offsets := make(map[string]fileTailOffset)
+	if json.Unmarshal(data, &offsets) == nil {
+		return offsets
+	}
+	var old map[string]int64
+	if json.Unmarshal(data, &old) != nil {
+		return make(map[string]fileTailOffset)
+	}
+	offsets = make(map[string]fileTailOffset)
+	for path, offset := range old {
+		offsets[path] = fileTailOffset{Offset: offset}
+	}
+	return offsets
+}
+
+// saveCheckpoint writes the offsets to the checkpoint file, replacing it
+// all at once so that a crash never leaves it half written
+func (t *fileTail) saveCheckpoint() {
+	_, _, checkpoint, _ := t.config()
+	if checkpoint == "" {
+		return
+	}
+	data, err := json.Marshal(t.offsets)
+	if err != nil {
+		return
+	}
+	tmp := checkpoint + ".tmp"
+	if ioutil.WriteFile(tmp, data, 0644) != nil {
+		return
+	}
+	os.Rename(tmp, checkpoint)
+}
+
+func (t *fileTail) ReceiveMessage(i chan Interrupt) (fileTailLine, Interrupt) {
+	select {
+	case line := <-t.lines:
+		return line, nil
+	case f := <-i:
+		return fileTailLine{}, f
+	}
+}
+
+// FileTailReceive emits each line read by a fileTail source, with the file it
+// was read from and the offset of its start in that file
+func FileTailReceive() Spec {
+	return Spec{
+		Name:    "fileTailReceive",
+		Outputs: []Pin{Pin{"line", OBJECT}},
+		Source:  FILETAIL,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			line, f := s.(*fileTail).ReceiveMessage(i)
+			if f != nil {
+				return f
+			}
+			out[0] = map[string]interface{}{
+				"line":   line.line,
+				"file":   line.path,
+				"offset": float64(line.offset),
+			}
+			return nil
+		},
+	}
+}
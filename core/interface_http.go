@@ -0,0 +1,296 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func HTTPIngressInterface() SourceSpec {
+	return SourceSpec{
+		Name: "httpIngress",
+		Type: HTTP_INGRESS,
+		New:  NewHTTPIngress,
+	}
+}
+
+const (
+	defaultIngressTimeout = 30 * time.Second
+	defaultIngressMaxBody = 1 << 20
+)
+
+type ingressResponse struct {
+	status  int
+	headers map[string]string
+	body    []byte
+}
+
+type ingressRequest struct {
+	id    string
+	msg   map[string]interface{}
+	reply chan ingressResponse
+}
+
+// HTTPIngress receives HTTP requests from the server's /ingress/{name} route.
+// Each request is held open until a response is sent with its id, or until
+// the timeout passes, in which case the client receives a 504. Request bodies
+// larger than maxBodySize bytes are refused with a 413. The mutex is
+// unexported so that blocks don't hold it while they wait for requests.
+type HTTPIngress struct {
+	mu       sync.Mutex
+	timeout  time.Duration
+	maxBody  int64
+	lastID   int
+	pending  map[string]*ingressRequest
+	requests chan *ingressRequest
+	quit     chan struct{}
+}
+
+func NewHTTPIngress() Source {
+	return &HTTPIngress{
+		timeout:  defaultIngressTimeout,
+		maxBody:  defaultIngressMaxBody,
+		pending:  make(map[string]*ingressRequest),
+		requests: make(chan *ingressRequest),
+		quit:     make(chan struct{}),
+	}
+}
+
+func (h *HTTPIngress) GetType() SourceType {
+	return HTTP_INGRESS
+}
+
+func (h *HTTPIngress) SetSourceParameter(name, value string) {
+	switch name {
+	case "timeout":
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return
+		}
+		h.mu.Lock()
+		h.timeout = d
+		h.mu.Unlock()
+	case "maxBodySize":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return
+		}
+		h.mu.Lock()
+		h.maxBody = n
+		h.mu.Unlock()
+	}
+}
+
+func (h *HTTPIngress) Describe() []map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return []map[string]string{
+		{"name": "timeout", "value": h.timeout.String()},
+		{"name": "maxBodySize", "value": strconv.FormatInt(h.maxBody, 10)},
+	}
+}
+
+func (h *HTTPIngress) Serve() {
+	<-h.quit
+}
+
+func (h *HTTPIngress) Stop() {
+	close(h.quit)
+}
+
+// ServeHTTP hands the request to a receiving block and blocks until the
+// pattern responds, the request times out, or the ingress is stopped.
+func (h *HTTPIngress) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	maxBody := h.maxBody
+	h.mu.Unlock()
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+	if err != nil {
+		if int64(len(body)) >= maxBody {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	query := make(map[string]interface{})
+	for k, v := range r.URL.Query() {
+		query[k] = v[0]
+	}
+
+	headers := make(map[string]interface{})
+	for k, v := range r.Header {
+		headers[k] = strings.Join(v, ", ")
+	}
+
+	h.mu.Lock()
+	h.lastID++
+	id := strconv.Itoa(h.lastID)
+	timeout := h.timeout
+	req := &ingressRequest{
+		id: id,
+		msg: map[string]interface{}{
+			"id":      id,
+			"method":  r.Method,
+			"path":    r.URL.Path,
+			"query":   query,
+			"headers": headers,
+			"body":    string(body),
+		},
+		reply: make(chan ingressResponse, 1),
+	}
+	h.pending[id] = req
+	h.mu.Unlock()
+
+	defer func() {
+		h.mu.Lock()
+		delete(h.pending, id)
+		h.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case h.requests <- req:
+	case <-timer.C:
+		http.Error(w, "no response from pattern", http.StatusGatewayTimeout)
+		return
+	case <-h.quit:
+		http.Error(w, "ingress has stopped", http.StatusServiceUnavailable)
+		return
+	}
+
+	select {
+	case resp := <-req.reply:
+		for k, v := range resp.headers {
+			w.Header().Set(k, v)
+		}
+		w.WriteHeader(resp.status)
+		w.Write(resp.body)
+	case <-timer.C:
+		http.Error(w, "no response from pattern", http.StatusGatewayTimeout)
+	case <-h.quit:
+		http.Error(w, "ingress has stopped", http.StatusServiceUnavailable)
+	}
+}
+
+func (h *HTTPIngress) ReceiveRequest(i chan Interrupt) (map[string]interface{}, Interrupt) {
+	select {
+	case req := <-h.requests:
+		return req.msg, nil
+	case f := <-i:
+		return nil, f
+	}
+}
+
+// Respond replies to the pending request with the given id. It never blocks,
+// and fails if the request has already been answered or has timed out.
+func (h *HTTPIngress) Respond(id string, resp ingressResponse) *stcoreError {
+	h.mu.Lock()
+	req, ok := h.pending[id]
+	delete(h.pending, id)
+	h.mu.Unlock()
+	if !ok {
+		return NewError("no pending request with id " + id)
+	}
+	req.reply <- resp
+	return nil
+}
+
+func HTTPReceive() Spec {
+	return Spec{
+		Name:    "httpReceive",
+		Outputs: []Pin{Pin{"request", OBJECT}},
+		Source:  HTTP_INGRESS,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			h := s.(*HTTPIngress)
+			msg, f := h.ReceiveRequest(i)
+			if f != nil {
+				return f
+			}
+			out[0] = msg
+			return nil
+		},
+	}
+}
+
+func HTTPRespond() Spec {
+	return Spec{
+		Name: "httpRespond",
+		Inputs: []Pin{
+			Pin{"id", STRING},
+			Pin{"status", NUMBER},
+			Pin{"headers", OBJECT},
+			Pin{"body", ANY},
+		},
+		Outputs: []Pin{Pin{"sent", BOOLEAN}},
+		Source:  HTTP_INGRESS,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			h := s.(*HTTPIngress)
+
+			id, ok := in[0].(string)
+			if !ok {
+				out[0] = NewError("httpRespond requires string id")
+				return nil
+			}
+
+			status, ok := in[1].(float64)
+			if !ok {
+				out[0] = NewError("httpRespond requires number status")
+				return nil
+			}
+			if status != float64(int(status)) || status < 100 || status > 599 {
+				out[0] = NewError("httpRespond requires status between 100 and 599")
+				return nil
+			}
+
+			headerMap, ok := in[2].(map[string]interface{})
+			if !ok {
+				out[0] = NewError("httpRespond requires object headers")
+				return nil
+			}
+
+			headers := make(map[string]string)
+			for k, v := range headerMap {
+				hv, ok := v.(string)
+				if !ok {
+					out[0] = NewError("httpRespond requires string header values")
+					return nil
+				}
+				headers[k] = hv
+			}
+
+			// strings are sent as they are, everything else as JSON
+			var body []byte
+			if b, ok := in[3].(string); ok {
+				body = []byte(b)
+			} else {
+				b, err := json.Marshal(in[3])
+				if err != nil {
+					out[0] = NewError("httpRespond could not marshal body")
+					return nil
+				}
+				body = b
+				if _, ok := headers["Content-Type"]; !ok {
+					headers["Content-Type"] = "application/json; charset=UTF-8"
+				}
+			}
+
+			err := h.Respond(id, ingressResponse{int(status), headers, body})
+			if err != nil {
+				out[0] = err
+				return nil
+			}
+
+			out[0] = true
+			return nil
+		},
+	}
+}
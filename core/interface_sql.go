@@ -0,0 +1,362 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func SQLInterface() SourceSpec {
+	return SourceSpec{
+		Name: "sql",
+		Type: SQL,
+		New:  NewSQL,
+	}
+}
+
+// sqlSource is a pool of connections to the database named by dsn, using the
+// database/sql driver named by driver. The pool is opened on first use, and
+// reopened after the driver or dsn change.
+type sqlSource struct {
+	mu              sync.Mutex
+	driver          string
+	dsn             string
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+	db              *sql.DB
+	quit            chan struct{}
+}
+
+func NewSQL() Source {
+	return &sqlSource{
+		maxIdleConns: 2,
+		quit:         make(chan struct{}),
+	}
+}
+
+func (s *sqlSource) GetType() SourceType {
+	return SQL
+}
+
+func (s *sqlSource) SetSourceParameter(name, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch name {
+	case "driver":
+		s.driver = value
+		s.close()
+	case "dsn":
+		s.dsn = value
+		s.close()
+	case "maxOpenConns", "maxIdleConns":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return
+		}
+		if name == "maxOpenConns" {
+			s.maxOpenConns = n
+		} else {
+			s.maxIdleConns = n
+		}
+	case "connMaxLifetime":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return
+		}
+		s.connMaxLifetime = d
+	default:
+		return
+	}
+	if s.db != nil {
+		s.configure()
+	}
+}
+
+func (s *sqlSource) Describe() []map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return []map[string]string{
+		{"name": "driver", "value": s.driver},
+		{"name": "dsn", "value": s.dsn},
+		{"name": "maxOpenConns", "value": strconv.Itoa(s.maxOpenConns)},
+		{"name": "maxIdleConns", "value": strconv.Itoa(s.maxIdleConns)},
+		{"name": "connMaxLifetime", "value": s.connMaxLifetime.String()},
+	}
+}
+
+func (s *sqlSource) Serve() {
+	<-s.quit
+}
+
+func (s *sqlSource) Stop() {
+	close(s.quit)
+	s.mu.Lock()
+	s.close()
+	s.mu.Unlock()
+}
+
+func (s *sqlSource) close() {
+	if s.db == nil {
+		return
+	}
+	s.db.Close()
+	s.db = nil
+}
+
+func (s *sqlSource) configure() {
+	s.db.SetMaxOpenConns(s.maxOpenConns)
+	s.db.SetMaxIdleConns(s.maxIdleConns)
+	s.db.SetConnMaxLifetime(s.connMaxLifetime)
+}
+
+// DB returns the connection pool, opening it if need be
+func (s *sqlSource) DB() (*sql.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db != nil {
+		return s.db, nil
+	}
+	if s.driver == "" {
+		return nil, errors.New("sql source has no driver")
+	}
+	db, err := sql.Open(s.driver, s.dsn)
+	if err != nil {
+		return nil, err
+	}
+	s.db = db
+	s.configure()
+	return db, nil
+}
+
+// sqlArgs converts JSON values to query arguments. Objects and arrays are
+// passed as JSON strings.
+func sqlArgs(in []interface{}) ([]interface{}, error) {
+	args := make([]interface{}, len(in))
+	for j, a := range in {
+		switch a.(type) {
+		case map[string]interface{}, []interface{}:
+			d, err := json.Marshal(a)
+			if err != nil {
+				return nil, err
+			}
+			args[j] = string(d)
+		default:
+			args[j] = a
+		}
+	}
+	return args, nil
+}
+
+// sqlValue converts a scanned column to a JSON value
+func sqlValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case []byte:
+		return string(t)
+	case int64:
+		return float64(t)
+	case float32:
+		return float64(t)
+	case time.Time:
+		return t.Format(time.RFC3339Nano)
+	}
+	return v
+}
+
+// Query runs query with args and returns the rows as objects keyed by column.
+// The query is cancelled if the block is interrupted.
+func (s *sqlSource) Query(query string, args []interface{}, i chan Interrupt) ([]interface{}, Interrupt, error) {
+	db, err := s.DB()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type result struct {
+		rows []interface{}
+		err  error
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan result, 1)
+	go func() {
+		rows, err := db.QueryContext(ctx, query, args...)
+		if err != nil {
+			c <- result{nil, err}
+			return
+		}
+		defer rows.Close()
+		columns, err := rows.Columns()
+		if err != nil {
+			c <- result{nil, err}
+			return
+		}
+		results := []interface{}{}
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			pointers := make([]interface{}, len(columns))
+			for j := range values {
+				pointers[j] = &values[j]
+			}
+			err := rows.Scan(pointers...)
+			if err != nil {
+				c <- result{nil, err}
+				return
+			}
+			row := make(map[string]interface{})
+			for j, column := range columns {
+				row[column] = sqlValue(values[j])
+			}
+			results = append(results, row)
+		}
+		c <- result{results, rows.Err()}
+	}()
+
+	select {
+	case r := <-c:
+		return r.rows, nil, r.err
+	case f := <-i:
+		return nil, f, nil
+	}
+}
+
+// Exec runs query with args and returns the number of rows it affected. The
+// statement is cancelled if the block is interrupted.
+func (s *sqlSource) Exec(query string, args []interface{}, i chan Interrupt) (int64, Interrupt, error) {
+	db, err := s.DB()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	type result struct {
+		n   int64
+		err error
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan result, 1)
+	go func() {
+		r, err := db.ExecContext(ctx, query, args...)
+		if err != nil {
+			c <- result{0, err}
+			return
+		}
+		n, err := r.RowsAffected()
+		c <- result{n, err}
+	}()
+
+	select {
+	case r := <-c:
+		return r.n, nil, r.err
+	case f := <-i:
+		return 0, f, nil
+	}
+}
+
+// SQLQuery runs query with args every time args arrives. If perRow is false
+// the rows are emitted as one array of objects keyed by column, and if it is
+// true each row is emitted as a message of its own.
+func SQLQuery() Spec {
+	return Spec{
+		Name:     "sqlQuery",
+		Inputs:   []Pin{Pin{"query", STRING}, Pin{"args", ARRAY}, Pin{"perRow", BOOLEAN}},
+		Outputs:  []Pin{Pin{"rows", ANY}},
+		Triggers: []Trigger{COLD, HOT, COLD},
+		Source:   SQL,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			// rows waiting to be emitted one at a time
+			pending, _ := internal[0].([]interface{})
+
+			if _, ok := in[1]; ok {
+				query, ok := in[0].(string)
+				if !ok {
+					out[0] = NewError("sqlQuery requires query to be a string")
+					return nil
+				}
+				a, ok := in[1].([]interface{})
+				if !ok {
+					out[0] = NewError("sqlQuery requires args to be an array")
+					return nil
+				}
+				perRow, ok := in[2].(bool)
+				if !ok {
+					out[0] = NewError("sqlQuery requires perRow to be a boolean")
+					return nil
+				}
+				args, err := sqlArgs(a)
+				if err != nil {
+					out[0] = NewError("sqlQuery could not marshal args")
+					return nil
+				}
+
+				rows, f, err := s.(*sqlSource).Query(query, args, i)
+				if f != nil {
+					return f
+				}
+				if err != nil {
+					out[0] = NewError("sqlQuery failed with: " + err.Error())
+					return nil
+				}
+				if !perRow {
+					out[0] = rows
+					return nil
+				}
+				pending = append(pending, rows...)
+			}
+
+			if len(pending) == 0 {
+				delete(internal, 0)
+				return nil
+			}
+			out[0] = pending[0]
+			internal[0] = pending[1:]
+			if len(pending) > 1 {
+				// come straight back for the next row
+				internal[DEADLINE] = time.Now()
+			}
+			return nil
+		},
+	}
+}
+
+// SQLExec runs a statement, such as an insert or update, with args and emits
+// the number of rows it affected
+func SQLExec() Spec {
+	return Spec{
+		Name:    "sqlExec",
+		Inputs:  []Pin{Pin{"query", STRING}, Pin{"args", ARRAY}},
+		Outputs: []Pin{Pin{"rowsAffected", NUMBER}},
+		Source:  SQL,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			query, ok := in[0].(string)
+			if !ok {
+				out[0] = NewError("sqlExec requires query to be a string")
+				return nil
+			}
+			a, ok := in[1].([]interface{})
+			if !ok {
+				out[0] = NewError("sqlExec requires args to be an array")
+				return nil
+			}
+			args, err := sqlArgs(a)
+			if err != nil {
+				out[0] = NewError("sqlExec could not marshal args")
+				return nil
+			}
+
+			n, f, err := s.(*sqlSource).Exec(query, args, i)
+			if f != nil {
+				return f
+			}
+			if err != nil {
+				out[0] = NewError("sqlExec failed with: " + err.Error())
+				return nil
+			}
+			out[0] = float64(n)
+			return nil
+		},
+	}
+}
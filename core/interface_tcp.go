@@ -0,0 +1,276 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+func TCPListenerInterface() SourceSpec {
+	return SourceSpec{
+		Name: "tcpListener",
+		Type: TCPLISTENER,
+		New:  NewTCPListener,
+	}
+}
+
+func TCPDialerInterface() SourceSpec {
+	return SourceSpec{
+		Name: "tcpDialer",
+		Type: TCPDIALER,
+		New:  NewTCPDialer,
+	}
+}
+
+var errTCPClosed = errors.New("connection closed by remote")
+
+// tcpListener accepts connections on its address. Messages are received from
+// and sent to each connection, which is identified by its remote address.
+type tcpListener struct {
+	socket
+	conns map[string]net.Conn
+}
+
+func NewTCPListener() Source {
+	return &tcpListener{
+		socket: newSocket(FRAMING_NEWLINE, FRAMING_LENGTH),
+		conns:  make(map[string]net.Conn),
+	}
+}
+
+func (t *tcpListener) GetType() SourceType {
+	return TCPLISTENER
+}
+
+func (t *tcpListener) Serve() {
+	t.serve(t.listen)
+}
+
+func (t *tcpListener) listen(address string, f socketFraming) (io.Closer, <-chan error, error) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	failed := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				failed <- err
+				return
+			}
+			t.mu.Lock()
+			t.conns[conn.RemoteAddr().String()] = conn
+			t.mu.Unlock()
+			go t.read(conn, f)
+		}
+	}()
+	return closerFunc(func() error {
+		err := l.Close()
+		t.mu.Lock()
+		for addr, conn := range t.conns {
+			delete(t.conns, addr)
+			conn.Close()
+		}
+		t.mu.Unlock()
+		return err
+	}), failed, nil
+}
+
+// read delivers messages from conn until it fails, and then forgets it
+func (t *tcpListener) read(conn net.Conn, f socketFraming) {
+	addr := conn.RemoteAddr().String()
+	defer func() {
+		t.mu.Lock()
+		if t.conns[addr] == conn {
+			delete(t.conns, addr)
+		}
+		t.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := f.read(r)
+		if err != nil {
+			return
+		}
+		if !t.deliver(socketMsg{addr, string(msg)}) {
+			return
+		}
+	}
+}
+
+// Send writes msg to the connection from addr, or to every connection if addr
+// is empty. Connections that can't be written to are closed.
+func (t *tcpListener) Send(addr string, msg []byte) error {
+	// the connections are written to without holding mu, so that a slow
+	// peer doesn't hold up anything else
+	t.mu.Lock()
+	framed, err := t.frame(msg)
+	if err != nil {
+		t.mu.Unlock()
+		return err
+	}
+	var conns []net.Conn
+	if addr != "" {
+		conn, ok := t.conns[addr]
+		if !ok {
+			t.mu.Unlock()
+			return errors.New("no connection from " + addr)
+		}
+		conns = append(conns, conn)
+	} else {
+		for _, conn := range t.conns {
+			conns = append(conns, conn)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+		_, err = conn.Write(framed)
+		if err != nil {
+			conn.Close()
+		}
+	}
+	if addr != "" {
+		return err
+	}
+	return nil
+}
+
+// tcpDialer keeps a connection open to its address, redialing with backoff
+// whenever it drops.
+type tcpDialer struct {
+	socket
+	conn net.Conn
+}
+
+func NewTCPDialer() Source {
+	return &tcpDialer{
+		socket: newSocket(FRAMING_NEWLINE, FRAMING_LENGTH),
+	}
+}
+
+func (t *tcpDialer) GetType() SourceType {
+	return TCPDIALER
+}
+
+func (t *tcpDialer) Serve() {
+	t.serve(t.dial)
+}
+
+func (t *tcpDialer) dial(address string, f socketFraming) (io.Closer, <-chan error, error) {
+	conn, err := net.DialTimeout("tcp", address, socketDialTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	t.mu.Lock()
+	t.conn = conn
+	t.mu.Unlock()
+
+	failed := make(chan error, 1)
+	go func() {
+		r := bufio.NewReader(conn)
+		for {
+			msg, err := f.read(r)
+			if err == io.EOF {
+				err = errTCPClosed
+			}
+			if err != nil {
+				failed <- err
+				return
+			}
+			if !t.deliver(socketMsg{address, string(msg)}) {
+				return
+			}
+		}
+	}()
+	return closerFunc(func() error {
+		t.mu.Lock()
+		if t.conn == conn {
+			t.conn = nil
+		}
+		t.mu.Unlock()
+		return conn.Close()
+	}), failed, nil
+}
+
+func (t *tcpDialer) Send(msg []byte) error {
+	t.mu.Lock()
+	conn := t.conn
+	framed, err := t.frame(msg)
+	t.mu.Unlock()
+	if conn == nil {
+		return errors.New("tcpDialer is not connected")
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+	_, err = conn.Write(framed)
+	return err
+}
+
+func TCPListenerReceive() Spec {
+	return socketReceive("tcpListenerReceive", TCPLISTENER)
+}
+
+func TCPDialerReceive() Spec {
+	return socketReceive("tcpDialerReceive", TCPDIALER)
+}
+
+// TCPListenerSend sends msg to the connection from addr, or to every
+// connection if addr is empty
+func TCPListenerSend() Spec {
+	return Spec{
+		Name:    "tcpListenerSend",
+		Inputs:  []Pin{Pin{"msg", ANY}, Pin{"addr", STRING}},
+		Outputs: []Pin{Pin{"sent", BOOLEAN}},
+		Source:  TCPLISTENER,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			addr, ok := in[1].(string)
+			if !ok {
+				out[0] = NewError("tcpListenerSend requires addr to be a string")
+				return nil
+			}
+			msg, err := socketMessage(in[0])
+			if err != nil {
+				out[0] = NewError("tcpListenerSend could not marshal msg")
+				return nil
+			}
+			err = s.(*tcpListener).Send(addr, msg)
+			if err != nil {
+				out[0] = NewError("tcpListenerSend failed with: " + err.Error())
+				return nil
+			}
+			out[0] = true
+			return nil
+		},
+	}
+}
+
+func TCPDialerSend() Spec {
+	return Spec{
+		Name:    "tcpDialerSend",
+		Inputs:  []Pin{Pin{"msg", ANY}},
+		Outputs: []Pin{Pin{"sent", BOOLEAN}},
+		Source:  TCPDIALER,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			msg, err := socketMessage(in[0])
+			if err != nil {
+				out[0] = NewError("tcpDialerSend could not marshal msg")
+				return nil
+			}
+			err = s.(*tcpDialer).Send(msg)
+			if err != nil {
+				out[0] = NewError("tcpDialerSend failed with: " + err.Error())
+				return nil
+			}
+			out[0] = true
+			return nil
+		},
+	}
+}
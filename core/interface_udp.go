@@ -0,0 +1,136 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+func UDPListenerInterface() SourceSpec {
+	return SourceSpec{
+		Name: "udpListener",
+		Type: UDPLISTENER,
+		New:  NewUDPListener,
+	}
+}
+
+// udpListener receives datagrams on its address, and sends datagrams from it.
+// With datagram framing each datagram is one message, and with newline
+// framing each line of a datagram is. Datagrams larger than maxSize are
+// dropped.
+type udpListener struct {
+	socket
+	conn *net.UDPConn
+}
+
+func NewUDPListener() Source {
+	return &udpListener{
+		socket: newSocket(FRAMING_DATAGRAM, FRAMING_NEWLINE),
+	}
+}
+
+func (u *udpListener) GetType() SourceType {
+	return UDPLISTENER
+}
+
+func (u *udpListener) Serve() {
+	u.serve(u.listen)
+}
+
+func (u *udpListener) listen(address string, f socketFraming) (io.Closer, <-chan error, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	u.mu.Lock()
+	u.conn = conn
+	u.mu.Unlock()
+
+	failed := make(chan error, 1)
+	go func() {
+		buf := make([]byte, f.maxSize+1)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				failed <- err
+				return
+			}
+			if n > f.maxSize {
+				continue
+			}
+			msgs := []string{string(buf[:n])}
+			if f.framing == FRAMING_NEWLINE {
+				msgs = strings.Split(strings.TrimRight(msgs[0], "\r\n"), "\n")
+			}
+			for _, msg := range msgs {
+				if !u.deliver(socketMsg{from.String(), strings.TrimSuffix(msg, "\r")}) {
+					return
+				}
+			}
+		}
+	}()
+	return closerFunc(func() error {
+		u.mu.Lock()
+		if u.conn == conn {
+			u.conn = nil
+		}
+		u.mu.Unlock()
+		return conn.Close()
+	}), failed, nil
+}
+
+// Send sends msg as a datagram to addr
+func (u *udpListener) Send(addr string, msg []byte) error {
+	to, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn == nil {
+		return errors.New("udpListener is not listening")
+	}
+	framed, err := u.frame(msg)
+	if err != nil {
+		return err
+	}
+	_, err = u.conn.WriteToUDP(framed, to)
+	return err
+}
+
+func UDPReceive() Spec {
+	return socketReceive("udpReceive", UDPLISTENER)
+}
+
+func UDPSend() Spec {
+	return Spec{
+		Name:    "udpSend",
+		Inputs:  []Pin{Pin{"msg", ANY}, Pin{"addr", STRING}},
+		Outputs: []Pin{Pin{"sent", BOOLEAN}},
+		Source:  UDPLISTENER,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			addr, ok := in[1].(string)
+			if !ok {
+				out[0] = NewError("udpSend requires addr to be a string")
+				return nil
+			}
+			msg, err := socketMessage(in[0])
+			if err != nil {
+				out[0] = NewError("udpSend could not marshal msg")
+				return nil
+			}
+			err = s.(*udpListener).Send(addr, msg)
+			if err != nil {
+				out[0] = NewError("udpSend failed with: " + err.Error())
+				return nil
+			}
+			out[0] = true
+			return nil
+		},
+	}
+}
@@ -0,0 +1,296 @@
+package core
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func FileWriterInterface() SourceSpec {
+	return SourceSpec{
+		Name: "fileWriter",
+		Type: FILEWRITER,
+		New:  NewFileWriter,
+	}
+}
+
+func StdWriterInterface() SourceSpec {
+	return SourceSpec{
+		Name: "stdWriter",
+		Type: STDWRITER,
+		New:  NewStdWriter,
+	}
+}
+
+// fileWriter writes to the file at path, opening it on the first write. The
+// file is rotated once it would grow past maxSize bytes, or once it has been
+// open for rotateEvery. A rotated file is renamed with the time it was
+// rotated, and compressed if gzip is set. Zero turns off either kind of
+// rotation. A rotated file that can't be compressed is left as it is, and the
+// error is reported in the writer's state.
+type fileWriter struct {
+	mu          sync.Mutex
+	path        string
+	append      bool
+	maxSize     int64
+	rotateEvery time.Duration
+	gzip        bool
+	file        *os.File
+	size        int64
+	opened      time.Time
+	compressing sync.WaitGroup
+	err         string
+	changes     chan struct{}
+	quit        chan struct{}
+}
+
+func NewFileWriter() Source {
+	return &fileWriter{
+		append:  true,
+		changes: make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+}
+
+func (w *fileWriter) GetType() SourceType {
+	return FILEWRITER
+}
+
+func (w *fileWriter) SetSourceParameter(name, value string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	switch name {
+	case "path":
+		if value == w.path {
+			return
+		}
+		w.path = value
+		w.close()
+	case "append":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return
+		}
+		w.append = b
+	case "maxSize":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return
+		}
+		w.maxSize = n
+	case "rotateEvery":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return
+		}
+		w.rotateEvery = d
+	case "gzip":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return
+		}
+		w.gzip = b
+	}
+}
+
+func (w *fileWriter) Describe() []map[string]string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return []map[string]string{
+		{"name": "path", "value": w.path},
+		{"name": "append", "value": strconv.FormatBool(w.append)},
+		{"name": "maxSize", "value": strconv.FormatInt(w.maxSize, 10)},
+		{"name": "rotateEvery", "value": w.rotateEvery.String()},
+		{"name": "gzip", "value": strconv.FormatBool(w.gzip)},
+	}
+}
+
+func (w *fileWriter) State() map[string]interface{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	state := map[string]interface{}{
+		"path": w.path,
+	}
+	if w.err != "" {
+		state["error"] = w.err
+	}
+	return state
+}
+
+func (w *fileWriter) StateChanges() chan struct{} {
+	return w.changes
+}
+
+// setError records the latest error that wasn't returned by a write
+func (w *fileWriter) setError(err error) {
+	w.mu.Lock()
+	w.err = err.Error()
+	w.mu.Unlock()
+	select {
+	case w.changes <- struct{}{}:
+	default:
+	}
+}
+
+func (w *fileWriter) Serve() {
+	<-w.quit
+}
+
+func (w *fileWriter) Stop() {
+	close(w.quit)
+	w.mu.Lock()
+	w.close()
+	w.mu.Unlock()
+	w.compressing.Wait()
+}
+
+// open opens the file at path, truncating it unless the writer appends
+func (w *fileWriter) open(truncate bool) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(w.path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = info.Size()
+	w.opened = time.Now()
+	return nil
+}
+
+func (w *fileWriter) close() {
+	if w.file == nil {
+		return
+	}
+	w.file.Close()
+	w.file = nil
+}
+
+// rotate moves the current file aside and opens a new one
+func (w *fileWriter) rotate() error {
+	w.close()
+	rotated := w.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	err := os.Rename(w.path, rotated)
+	if err != nil {
+		return err
+	}
+	if w.gzip {
+		w.compressing.Add(1)
+		go func() {
+			defer w.compressing.Done()
+			if err := compressFile(rotated); err != nil {
+				w.setError(err)
+			}
+		}()
+	}
+	return w.open(true)
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	select {
+	case <-w.quit:
+		return 0, errors.New("fileWriter has been stopped")
+	default:
+	}
+	if w.path == "" {
+		return 0, errors.New("fileWriter has no path")
+	}
+	if w.file == nil {
+		err := w.open(!w.append)
+		if err != nil {
+			return 0, err
+		}
+	}
+	full := w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize
+	expired := w.rotateEvery > 0 && time.Since(w.opened) >= w.rotateEvery
+	if full || expired {
+		err := w.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// compressFile replaces the file at path with a gzipped copy at path.gz. If
+// compressing fails, the file at path is kept and path.gz removed.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// stdWriter writes to the server's stdout or stderr
+type stdWriter struct {
+	mu     sync.Mutex
+	stream string
+}
+
+func NewStdWriter() Source {
+	return &stdWriter{
+		stream: "stdout",
+	}
+}
+
+func (w *stdWriter) GetType() SourceType {
+	return STDWRITER
+}
+
+func (w *stdWriter) SetSourceParameter(name, value string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if name == "stream" && (value == "stdout" || value == "stderr") {
+		w.stream = value
+	}
+}
+
+func (w *stdWriter) Describe() []map[string]string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return []map[string]string{
+		{"name": "stream", "value": w.stream},
+	}
+}
+
+func (w *stdWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stream == "stderr" {
+		return os.Stderr.Write(p)
+	}
+	return os.Stdout.Write(p)
+}
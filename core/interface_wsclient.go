@@ -1,10 +1,13 @@
 package core
 
 import (
+	"encoding/base64"
 	"errors"
 	"io"
+	"io/ioutil"
 	"log"
-	"strings"
+	"net/http"
+	"time"
 
 	"golang.org/x/net/websocket"
 )
@@ -29,14 +32,69 @@ func (ws *wsClient) Describe() []map[string]string {
 	return []map[string]string{}
 }
 
-func (ws wsClient) GetType() SourceType {
+func (ws *wsClient) GetType() SourceType {
 	return WSCLIENT
 }
 
 type connParams struct {
-	url     string
-	origin  string
-	errChan chan *stcoreError
+	url          string
+	origin       string
+	header       http.Header
+	protocols    []string
+	pingInterval time.Duration
+	readDeadline time.Duration
+	errChan      chan *stcoreError
+}
+
+// wsCodec sends strings as text frames
+var wsCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		return []byte(v.(string)), websocket.TextFrame, nil
+	},
+}
+
+// wsReceive reads the next message from conn. Text messages are returned as
+// strings, and binary messages as {"type": "binary", "data": base64}. Control
+// frames are handled along the way, and onPong is called for each pong.
+func wsReceive(conn *websocket.Conn, onPong func()) (Message, error) {
+	for {
+		frame, err := conn.NewFrameReader()
+		if err != nil {
+			return nil, err
+		}
+		if frame.PayloadType() == websocket.PongFrame {
+			onPong()
+		}
+		frame, err = conn.HandleFrame(frame)
+		if err != nil {
+			return nil, err
+		}
+		if frame == nil {
+			continue
+		}
+		payloadType := frame.PayloadType()
+		data, err := ioutil.ReadAll(io.LimitReader(frame, websocket.DefaultMaxPayloadBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > websocket.DefaultMaxPayloadBytes {
+			return nil, websocket.ErrFrameTooLarge
+		}
+		if payloadType == websocket.BinaryFrame {
+			return map[string]interface{}{
+				"type": "binary",
+				"data": base64.StdEncoding.EncodeToString(data),
+			}, nil
+		}
+		return string(data), nil
+	}
+}
+
+// wsPing sends an empty ping frame
+var wsPing = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		return nil, websocket.PingFrame, nil
+	},
 }
 
 type wsMsg struct {
@@ -44,64 +102,161 @@ type wsMsg struct {
 	errChan chan *stcoreError
 }
 
+// wsDialed is the result of a dial started by Serve. gen tells apart dials
+// that have since been replaced.
+type wsDialed struct {
+	gen  int
+	conn *websocket.Conn
+	err  error
+}
+
+// wsNotify reports the result of a connect to a wsClientConnect block, unless
+// it has stopped waiting
+func wsNotify(c chan *stcoreError, err *stcoreError) {
+	select {
+	case c <- err:
+	default:
+	}
+}
+
+// wsClient keeps the parameters of its last connect, and reconnects with
+// backoff whenever the connection drops or fails. Dials run outside of Serve,
+// so that a slow dial doesn't hold up sends or Stop.
 type wsClient struct {
+	connState
 	IsRunning     bool
 	conn          *websocket.Conn
+	pinger        *time.Ticker
+	params        *connParams
+	readerDone    chan struct{}
 	connectChan   chan connParams
-	subscribe     chan chan string
-	unsubscribe   chan chan string
-	subscribers   map[chan string]struct{}
+	subscribe     chan chan Message
+	unsubscribe   chan chan Message
+	subscribers   map[chan Message]struct{}
 	quit          chan chan error
-	stopReader    chan bool
-	fromWebsocket chan string
+	dropped       chan *websocket.Conn
+	dialed        chan wsDialed
+	done          chan struct{}
+	fromWebsocket chan Message
 	sendChan      chan wsMsg
 }
 
 func NewWsClient() Source {
 	ws := &wsClient{
+		connState:     newConnState(),
 		IsRunning:     false,
 		quit:          make(chan chan error),
-		stopReader:    make(chan bool),
-		subscribe:     make(chan chan string),
-		unsubscribe:   make(chan chan string),
-		subscribers:   make(map[chan string]struct{}),
-		fromWebsocket: make(chan string),
+		dropped:       make(chan *websocket.Conn),
+		dialed:        make(chan wsDialed),
+		done:          make(chan struct{}),
+		subscribe:     make(chan chan Message),
+		unsubscribe:   make(chan chan Message),
+		subscribers:   make(map[chan Message]struct{}),
+		fromWebsocket: make(chan Message),
 		sendChan:      make(chan wsMsg),
 		connectChan:   make(chan connParams),
 	}
 	return ws
 }
 
+// State reports whether the client is connected, and where to
+func (ws *wsClient) State() map[string]interface{} {
+	state := ws.connState.connState()
+	ws.stateMu.Lock()
+	if ws.params != nil {
+		state["url"] = ws.params.url
+	}
+	ws.stateMu.Unlock()
+	return state
+}
+
 func (ws *wsClient) Serve() {
-	var err error
+	var retry <-chan time.Time
+	retries := 0
+
+	// scheduleRetry closes any connection and waits to reconnect
+	scheduleRetry := func(err error) {
+		ws.closeConn()
+		ws.setStatus(STATUS_RETRYING, retries, err.Error())
+		retry = time.After(reconnectDelay(retries))
+		retries++
+	}
+
+	// dial connects in the background, replacing any dial in progress. The
+	// result is reported to connected, if it is set.
+	gen := 0
+	var connected chan *stcoreError
+	dial := func(p connParams, c chan *stcoreError) {
+		wsNotify(connected, NewError("websocket connect was replaced by another"))
+		gen++
+		connected = c
+		go func(gen int) {
+			conn, err := wsDial(p)
+			select {
+			case ws.dialed <- wsDialed{gen, conn, err}:
+			case <-ws.done:
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}(gen)
+	}
+
 	ws.IsRunning = true
 	for {
+		var ping <-chan time.Time
+		if ws.pinger != nil {
+			ping = ws.pinger.C
+		}
 		select {
 		case p := <-ws.connectChan:
-			if ws.conn != nil {
-				ws.stopReader <- true
-			}
-			err = ws.Connect(p)
-
-			// these sends need to be non-blocking in case the connect block has been interrupted
-			if err != nil {
-				select {
-				case p.errChan <- NewError("websocket connect failed with:" + err.Error()):
-				default:
+			ws.closeConn()
+			ws.stateMu.Lock()
+			ws.params = &p
+			ws.stateMu.Unlock()
+			retries = 0
+			retry = nil
+			dial(p, p.errChan)
+		case <-retry:
+			retry = nil
+			dial(*ws.params, nil)
+		case d := <-ws.dialed:
+			// close connections from dials that have been replaced
+			if d.gen != gen {
+				if d.conn != nil {
+					d.conn.Close()
 				}
+				continue
+			}
+			// these notifications are non-blocking in case the connect block has been interrupted
+			if d.err != nil {
+				wsNotify(connected, NewError("websocket connect failed with:"+d.err.Error()))
+				connected = nil
+				scheduleRetry(d.err)
 				break
 			}
-			select {
-			case p.errChan <- nil:
-			default:
+			wsNotify(connected, nil)
+			connected = nil
+			ws.attach(d.conn, *ws.params)
+			retries = 0
+			ws.setStatus(STATUS_CONNECTED, 0, "")
+		case conn := <-ws.dropped:
+			// ignore readers of connections that have already been replaced
+			if conn != ws.conn {
+				continue
+			}
+			scheduleRetry(errors.New("websocket connection dropped"))
+		case <-ping:
+			err := wsPing.Send(ws.conn, nil)
+			if err != nil {
+				scheduleRetry(errors.New("websocket ping failed with: " + err.Error()))
 			}
-			go ws.ReadLoop()
 		case msg := <-ws.sendChan:
 			if ws.conn == nil {
 				msg.errChan <- NewError("websocket connection is nil, cannot send")
 				continue
 			}
-			err := websocket.Message.Send(ws.conn, msg.msg)
+			err := wsCodec.Send(ws.conn, msg.msg)
 			if err != nil {
 				msg.errChan <- NewError("websocket send failed with: " + err.Error())
 			} else {
@@ -116,50 +271,68 @@ func (ws *wsClient) Serve() {
 		case c := <-ws.unsubscribe:
 			delete(ws.subscribers, c)
 		case r := <-ws.quit:
+			close(ws.done)
+			wsNotify(connected, NewError("websocket client has stopped"))
 			var err error
 			if ws.conn != nil {
-				ws.stopReader <- true
+				close(ws.readerDone)
+				err = ws.conn.Close()
+				ws.conn = nil
+			}
+			if ws.pinger != nil {
+				ws.pinger.Stop()
+				ws.pinger = nil
 			}
 			for c, _ := range ws.subscribers {
 				delete(ws.subscribers, c)
 				close(c)
 			}
-			if ws.conn != nil {
-				err = ws.conn.Close()
-			}
+			ws.setStatus(STATUS_DISCONNECTED, 0, "")
 			r <- err
 			return
 		}
 	}
 }
 
-func (ws wsClient) ReadLoop() {
-	c := make(chan string)
-	go func() {
-		for {
-			if ws.conn == nil {
-				return
-			}
-			var msg string
-			err := websocket.Message.Receive(ws.conn, &msg)
-			if err != nil {
-				if err == io.EOF || strings.Contains(err.Error(), "use of closed network connection") {
-					m := make(chan error)
-					ws.quit <- m
-					<-m
-					return
-				}
-				continue
-			}
-			c <- string(msg)
+// closeConn stops the reader and pings and closes the current connection, if
+// there is one
+func (ws *wsClient) closeConn() {
+	if ws.pinger != nil {
+		ws.pinger.Stop()
+		ws.pinger = nil
+	}
+	if ws.conn == nil {
+		return
+	}
+	close(ws.readerDone)
+	ws.conn.Close()
+	ws.conn = nil
+}
+
+// ReadLoop reads from conn until it fails, at which point it reports the
+// connection as dropped. done is closed when the connection is replaced. If
+// readDeadline is set, going that long without a message or a pong also fails
+// the read.
+func (ws *wsClient) ReadLoop(conn *websocket.Conn, done chan struct{}, readDeadline time.Duration) {
+	extend := func() {
+		if readDeadline > 0 {
+			conn.SetReadDeadline(time.Now().Add(readDeadline))
 		}
-	}()
+	}
 	for {
+		extend()
+		msg, err := wsReceive(conn, extend)
+		if err != nil {
+			select {
+			case ws.dropped <- conn:
+			case <-done:
+			}
+			return
+		}
 		select {
-		case <-ws.stopReader:
+		case ws.fromWebsocket <- msg:
+		case <-done:
 			return
-		case msg := <-c:
-			ws.fromWebsocket <- msg
 		}
 	}
 }
@@ -175,24 +348,24 @@ func (ws *wsClient) Stop() {
 	}
 }
 
-func (ws wsClient) ReceiveMessage(i chan Interrupt) (string, Interrupt, error) {
+func (ws *wsClient) ReceiveMessage(i chan Interrupt) (Message, Interrupt, error) {
 	// receives message
-	c := make(chan string, 10)
+	c := make(chan Message, 10)
 	ws.subscribe <- c
 	select {
 	case msg, ok := <-c:
 		if !ok {
-			return "", nil, errors.New("websocket connection has closed")
+			return nil, nil, errors.New("websocket connection has closed")
 		}
 		ws.unsubscribe <- c
 		return msg, nil, nil
 	case f := <-i:
 		ws.unsubscribe <- c
-		return "", f, nil
+		return nil, f, nil
 	}
 }
 
-func (ws wsClient) SendMessage(msg string) *stcoreError {
+func (ws *wsClient) SendMessage(msg string) *stcoreError {
 	if !ws.IsRunning {
 		return NewError("cannot send on stopped websocketClient")
 	}
@@ -203,22 +376,51 @@ func (ws wsClient) SendMessage(msg string) *stcoreError {
 	return err
 }
 
-func (ws *wsClient) Connect(p connParams) error {
-	// dial the websocket
-	conn, err := websocket.Dial(p.url, "", p.origin)
+// wsDial dials the websocket described by p
+func wsDial(p connParams) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig(p.url, p.origin)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	config.Header = p.header
+	config.Protocol = p.protocols
+	return websocket.DialConfig(config)
+}
+
+// attach makes conn the client's connection, reading from it and pinging it
+// as p asks
+func (ws *wsClient) attach(conn *websocket.Conn, p connParams) {
 	ws.conn = conn
-	return nil
+	ws.readerDone = make(chan struct{})
+	go ws.ReadLoop(conn, ws.readerDone, p.readDeadline)
+	if p.pingInterval > 0 {
+		ws.pinger = time.NewTicker(p.pingInterval)
+	}
 }
 
+// wsClientConnect connects a wsClient to url, sending the given headers and
+// asking for one of protocols. A pingInterval and readDeadline of "0s" turn
+// off pings and read deadlines, and are the defaults, along with no headers
+// or protocols.
 func wsClientConnect() Spec {
 	return Spec{
 		Name:    "wsClientConnect",
 		Outputs: []Pin{Pin{"connected", BOOLEAN}},
-		Inputs:  []Pin{Pin{"url", STRING}, Pin{"origin", STRING}},
-		Source:  WSCLIENT,
+		Inputs: []Pin{
+			Pin{"url", STRING},
+			Pin{"origin", STRING},
+			Pin{"headers", OBJECT},
+			Pin{"protocols", ARRAY},
+			Pin{"pingInterval", STRING},
+			Pin{"readDeadline", STRING},
+		},
+		Defaults: map[RouteIndex]Message{
+			2: map[string]interface{}{},
+			3: []interface{}{},
+			4: "0s",
+			5: "0s",
+		},
+		Source: WSCLIENT,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
 
 			url, ok := in[0].(string)
@@ -233,10 +435,70 @@ func wsClientConnect() Spec {
 				return nil
 			}
 
+			headers, ok := in[2].(map[string]interface{})
+			if !ok {
+				out[0] = NewError("wsClientConnect requires headers to be an object")
+				return nil
+			}
+			header := http.Header{}
+			for k, v := range headers {
+				value, ok := v.(string)
+				if !ok {
+					out[0] = NewError("wsClientConnect requires header values to be strings")
+					return nil
+				}
+				header.Set(k, value)
+			}
+
+			protocolList, ok := in[3].([]interface{})
+			if !ok {
+				out[0] = NewError("wsClientConnect requires protocols to be an array")
+				return nil
+			}
+			var protocols []string
+			for _, p := range protocolList {
+				protocol, ok := p.(string)
+				if !ok {
+					out[0] = NewError("wsClientConnect requires protocols to be strings")
+					return nil
+				}
+				protocols = append(protocols, protocol)
+			}
+
+			pingString, ok := in[4].(string)
+			if !ok {
+				out[0] = NewError("wsClientConnect requires pingInterval to be a string")
+				return nil
+			}
+			pingInterval, err := time.ParseDuration(pingString)
+			if err != nil {
+				out[0] = NewError("wsClientConnect could not parse pingInterval")
+				return nil
+			}
+
+			deadlineString, ok := in[5].(string)
+			if !ok {
+				out[0] = NewError("wsClientConnect requires readDeadline to be a string")
+				return nil
+			}
+			readDeadline, err := time.ParseDuration(deadlineString)
+			if err != nil {
+				out[0] = NewError("wsClientConnect could not parse readDeadline")
+				return nil
+			}
+
 			ws := s.(*wsClient)
 
 			errChan := make(chan *stcoreError)
-			ws.connectChan <- connParams{url, origin, errChan}
+			ws.connectChan <- connParams{
+				url:          url,
+				origin:       origin,
+				header:       header,
+				protocols:    protocols,
+				pingInterval: pingInterval,
+				readDeadline: readDeadline,
+				errChan:      errChan,
+			}
 
 			// block on connect
 			select {
@@ -255,10 +517,12 @@ func wsClientConnect() Spec {
 	}
 }
 
+// wsClientReceive emits each message received by a wsClient. Binary messages
+// are emitted as {"type": "binary", "data": base64}.
 func wsClientReceive() Spec {
 	return Spec{
 		Name:    "wsClientReceive",
-		Outputs: []Pin{Pin{"msg", STRING}},
+		Outputs: []Pin{Pin{"msg", ANY}},
 		Source:  WSCLIENT,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
 			ws := s.(*wsClient)
@@ -270,7 +534,7 @@ func wsClientReceive() Spec {
 			if f != nil {
 				return f
 			}
-			out[0] = string(msg)
+			out[0] = msg
 			return nil
 		},
 	}
@@ -0,0 +1,263 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+func WebsocketServer() SourceSpec {
+	return SourceSpec{
+		Name: "wsServer",
+		Type: WSSERVER,
+		New:  NewWsServer,
+	}
+}
+
+const (
+	defaultWsServerPath    = "/ws"
+	defaultWsServerBuffer  = 64
+	defaultWsServerMaxSize = 64 * 1024
+)
+
+var wsServerUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+type wsServerClient struct {
+	id   string
+	conn *websocket.Conn
+	send chan []byte
+}
+
+type wsServerMsg struct {
+	id  string
+	msg string
+}
+
+// wsServer accepts websocket connections on its path. Each client has its own
+// buffered queue, and messages for a client whose queue is full are dropped so
+// that a slow client can't stall the pattern. A client that sends a message
+// larger than maxSize bytes is disconnected. Changes to maxSize apply to
+// clients that connect afterwards.
+type wsServer struct {
+	mu          sync.Mutex
+	path        string
+	bufferSize  int
+	maxSize     int
+	lastID      int
+	clients     map[string]*wsServerClient
+	fromClients chan wsServerMsg
+	quit        chan struct{}
+}
+
+func NewWsServer() Source {
+	return &wsServer{
+		path:        defaultWsServerPath,
+		bufferSize:  defaultWsServerBuffer,
+		maxSize:     defaultWsServerMaxSize,
+		clients:     make(map[string]*wsServerClient),
+		fromClients: make(chan wsServerMsg),
+		quit:        make(chan struct{}),
+	}
+}
+
+func (ws *wsServer) GetType() SourceType {
+	return WSSERVER
+}
+
+func (ws *wsServer) SetSourceParameter(name, value string) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	switch name {
+	case "path":
+		if !strings.HasPrefix(value, "/") {
+			return
+		}
+		ws.path = value
+	case "bufferSize":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return
+		}
+		ws.bufferSize = n
+	case "maxSize":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return
+		}
+		ws.maxSize = n
+	}
+}
+
+func (ws *wsServer) Describe() []map[string]string {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return []map[string]string{
+		{"name": "path", "value": ws.path},
+		{"name": "bufferSize", "value": strconv.Itoa(ws.bufferSize)},
+		{"name": "maxSize", "value": strconv.Itoa(ws.maxSize)},
+	}
+}
+
+// Path is the path that the server should mount the websocket on
+func (ws *wsServer) Path() string {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.path
+}
+
+func (ws *wsServer) Serve() {
+	<-ws.quit
+}
+
+func (ws *wsServer) Stop() {
+	close(ws.quit)
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for id, c := range ws.clients {
+		delete(ws.clients, id)
+		close(c.send)
+		c.conn.Close()
+	}
+}
+
+// ServeHTTP upgrades the request to a websocket and serves the client until
+// it disconnects or the source is stopped.
+func (ws *wsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := wsServerUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	ws.mu.Lock()
+	select {
+	case <-ws.quit:
+		ws.mu.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	ws.lastID++
+	c := &wsServerClient{
+		id:   strconv.Itoa(ws.lastID),
+		conn: conn,
+		send: make(chan []byte, ws.bufferSize),
+	}
+	ws.clients[c.id] = c
+	conn.SetReadLimit(int64(ws.maxSize))
+	ws.mu.Unlock()
+
+	go ws.writePump(c)
+	ws.readPump(c)
+}
+
+func (ws *wsServer) readPump(c *wsServerClient) {
+	defer func() {
+		ws.mu.Lock()
+		if _, ok := ws.clients[c.id]; ok {
+			delete(ws.clients, c.id)
+			close(c.send)
+		}
+		ws.mu.Unlock()
+		c.conn.Close()
+	}()
+	for {
+		_, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		select {
+		case ws.fromClients <- wsServerMsg{c.id, string(msg)}:
+		case <-ws.quit:
+			return
+		}
+	}
+}
+
+func (ws *wsServer) writePump(c *wsServerClient) {
+	for msg := range c.send {
+		err := c.conn.WriteMessage(websocket.TextMessage, msg)
+		if err != nil {
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// Broadcast queues msg for every connected client, dropping it for clients
+// whose queues are full.
+func (ws *wsServer) Broadcast(msg []byte) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for _, c := range ws.clients {
+		select {
+		case c.send <- msg:
+		default:
+		}
+	}
+}
+
+func (ws *wsServer) ReceiveMessage(i chan Interrupt) (wsServerMsg, Interrupt) {
+	select {
+	case msg := <-ws.fromClients:
+		return msg, nil
+	case f := <-i:
+		return wsServerMsg{}, f
+	}
+}
+
+func wsServerSend() Spec {
+	return Spec{
+		Name:    "wsServerSend",
+		Inputs:  []Pin{Pin{"msg", ANY}},
+		Outputs: []Pin{Pin{"sent", BOOLEAN}},
+		Source:  WSSERVER,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			ws := s.(*wsServer)
+
+			// strings are sent as they are, everything else as JSON
+			var msg []byte
+			if m, ok := in[0].(string); ok {
+				msg = []byte(m)
+			} else {
+				m, err := json.Marshal(in[0])
+				if err != nil {
+					out[0] = NewError("wsServerSend could not marshal msg")
+					return nil
+				}
+				msg = m
+			}
+
+			ws.Broadcast(msg)
+			out[0] = true
+			return nil
+		},
+	}
+}
+
+func wsServerReceive() Spec {
+	return Spec{
+		Name:    "wsServerReceive",
+		Outputs: []Pin{Pin{"msg", OBJECT}},
+		Source:  WSSERVER,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			ws := s.(*wsServer)
+			msg, f := ws.ReceiveMessage(i)
+			if f != nil {
+				return f
+			}
+			out[0] = map[string]interface{}{
+				"client": msg.id,
+				"msg":    msg.msg,
+			}
+			return nil
+		},
+	}
+}
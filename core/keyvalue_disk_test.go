@@ -0,0 +1,187 @@
+package core
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPersistentKeyValue(t *testing.T) {
+	log.Println("testing persistent key value")
+
+	dir, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kv := NewPersistentKeyValue().(*KeyValue)
+	if kv.GetType() != KEY_VALUE {
+		t.Fatal("persistent key value should be a key_value source")
+	}
+	kv.SetSourceParameter("directory", dir)
+	kv.SetSourceParameter("snapshotInterval", "0s")
+	kv.SetSourceParameter("snapshotRetain", "2")
+	kv.SetSourceParameter("snapshotRetain", "0")
+	if kv.Describe()[2]["value"] != "2" {
+		t.Error("persistent key value accepted an invalid snapshotRetain", kv.Describe())
+	}
+	go kv.Serve()
+
+	// a directory that can't be opened leaves the store where it was
+	kv.SetSourceParameter("directory", filepath.Join(dir, kvFile, "nested"))
+	if kv.Describe()[0]["value"] != dir {
+		t.Error("directory changed to one that couldn't be opened", kv.Describe())
+	}
+	if _, ok := kv.State()["error"].(string); !ok {
+		t.Error("expected an error in the state", kv.State())
+	}
+	select {
+	case <-kv.StateChanges():
+	default:
+		t.Error("expected a state change")
+	}
+
+	send := linkBlocks(t, kv, make(chan Message), "kvSet", "kvGet", "kvDelete", "kvClear", "fsm")
+
+	if r := send("kvSet", "a", 1.0); r != true {
+		t.Error("expected new key", r)
+	}
+	if r := send("kvSet", "b", []interface{}{"x"}); r != true {
+		t.Error("expected new key", r)
+	}
+	if r := send("kvDelete", "a"); r != true {
+		t.Error("expected key to be deleted", r)
+	}
+
+	snapshot := func(k *KeyValue) time.Time {
+		k.Lock()
+		defer k.Unlock()
+		at, err := k.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return at
+	}
+	restore := func(k *KeyValue, at time.Time) (time.Time, error) {
+		k.Lock()
+		defer k.Unlock()
+		return k.Restore(at)
+	}
+
+	first := snapshot(kv)
+	if r := send("kvClear", true); r != true {
+		t.Error("kvClear failed", r)
+	}
+	if r := send("kvSet", "c", "later"); r != true {
+		t.Error("expected new key", r)
+	}
+	second := snapshot(kv)
+	send("kvSet", "d", "latest")
+	table := map[string]interface{}{
+		"initial": "new",
+		"transitions": map[string]interface{}{
+			"new":  map[string]interface{}{"go": "gone"},
+			"gone": map[string]interface{}{"go": "new"},
+		},
+	}
+	if r, ok := send("fsm", "e", "go", table).(map[string]interface{}); !ok || r["to"] != "gone" {
+		t.Error("unexpected fsm transition", r)
+	}
+	kv.Lock()
+	kv.disk.db.Close()
+	kv.Unlock()
+	if _, ok := send("fsm", "f", "go", table).(*stcoreError); !ok {
+		t.Error("expected fsm error when the database is closed")
+	}
+	kv.Lock()
+	kv.disk.open(dir)
+	kv.setTTL("e", "gone", time.Nanosecond)
+	kv.Unlock()
+	time.Sleep(time.Millisecond)
+	if r, ok := send("fsm", "e", "go", table).(map[string]interface{}); !ok || r["from"] != "new" {
+		t.Error("fsm used an expired state", r)
+	}
+
+	for _, r := range []struct {
+		at       time.Time
+		snapshot time.Time
+		expected map[string]interface{}
+	}{
+		{first, first, map[string]interface{}{"b": []interface{}{"x"}}},
+		{second.Add(-time.Nanosecond), first, map[string]interface{}{"b": []interface{}{"x"}}},
+		{time.Now(), second, map[string]interface{}{"c": "later"}},
+	} {
+		at, err := restore(kv, r.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !at.Equal(r.snapshot) {
+			t.Error("restored snapshot from", at, "expected", r.snapshot)
+		}
+		if v := kv.Get(); !reflect.DeepEqual(v, r.expected) {
+			t.Error("unexpected store after restore", v)
+		}
+	}
+	if _, err := restore(kv, first.Add(-time.Nanosecond)); err == nil {
+		t.Error("expected error restoring before the first snapshot")
+	}
+	if r := send("kvGet", "c"); r != "later" {
+		t.Error("kvGet did not see the restored store", r)
+	}
+
+	// the store is read back from disk by a new source, along with its TTLs
+	kv.Lock()
+	kv.setTTL("t", "ttl", time.Hour)
+	kv.Unlock()
+	kv.Stop()
+	reopened := NewPersistentKeyValue().(*KeyValue)
+	reopened.SetSourceParameter("directory", dir)
+	reopened.SetSourceParameter("snapshotRetain", "2")
+	defer reopened.Stop()
+	if v := reopened.Get(); !reflect.DeepEqual(v, map[string]interface{}{"c": "later", "t": "ttl"}) {
+		t.Error("unexpected store after reopening", v)
+	}
+	if ttls := reopened.TTLs(); len(ttls) != 1 || ttls["t"] <= 59*time.Minute || ttls["t"] > time.Hour {
+		t.Error("unexpected TTLs after reopening", ttls)
+	}
+
+	// only the latest two snapshots are kept
+	third := snapshot(reopened)
+	reopened.Lock()
+	snapshots, err := reopened.Snapshots()
+	reopened.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || !snapshots[0].Equal(second) || !snapshots[1].Equal(third) {
+		t.Error("expected the oldest snapshot to be removed", snapshots)
+	}
+	if _, err := restore(reopened, first); err == nil {
+		t.Error("expected error restoring a removed snapshot")
+	}
+
+	// snapshots are also taken every snapshotInterval
+	reopened.SetSourceParameter("snapshotInterval", "10ms")
+	go reopened.Serve()
+	for j := 0; ; j++ {
+		reopened.Lock()
+		snapshots, _ = reopened.Snapshots()
+		reopened.Unlock()
+		if snapshots[1].After(third) {
+			break
+		}
+		if j == 100 {
+			t.Fatal("no periodic snapshot was taken")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := NewKeyValue().(*KeyValue).Snapshot(); err == nil {
+		t.Error("expected error taking a snapshot of an in memory key value store")
+	}
+}
@@ -0,0 +1,209 @@
+package core
+
+import (
+	"log"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeyValueTTL(t *testing.T) {
+	log.Println("testing key value TTLs")
+
+	defer func(interval time.Duration) {
+		kvEvictInterval = interval
+	}(kvEvictInterval)
+	kvEvictInterval = 10 * time.Millisecond
+
+	kv := NewKeyValue().(*KeyValue)
+	kv.SetSourceParameter("defaultTTL", "forever")
+	if kv.Describe()[0]["value"] != "0s" {
+		t.Error("key value accepted an invalid defaultTTL", kv.Describe())
+	}
+	go kv.Serve()
+	defer kv.Stop()
+
+	send := linkBlocks(t, kv, make(chan Message), "kvSet", "kvSetTTL", "kvGet", "kvDump")
+	expired := make(chan Message)
+	kvExpired := linkBlock(t, kv, expired, "kvExpired")
+	nextExpired := func() Message {
+		select {
+		case m := <-expired:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("kvExpired never emitted")
+		}
+		return nil
+	}
+
+	if r := send("kvSetTTL", "session", "a", "200ms"); r != true {
+		t.Error("expected new key", r)
+	}
+	if r := send("kvSetTTL", "forever", "b", "0s"); r != true {
+		t.Error("expected new key", r)
+	}
+	if _, ok := send("kvSetTTL", "bad", "c", "soon").(*stcoreError); !ok {
+		t.Error("expected error setting an invalid ttl")
+	}
+	kv.Lock()
+	ttls := kv.TTLs()
+	kv.Unlock()
+	if _, ok := ttls["forever"]; ok || ttls["session"] <= 0 || ttls["session"] > 200*time.Millisecond {
+		t.Error("unexpected TTLs", ttls)
+	}
+	if r := send("kvGet", "session"); r != "a" {
+		t.Error("unexpected value before expiry", r)
+	}
+
+	// the entry is evicted by the periodic sweep
+	e := nextExpired()
+	if !reflect.DeepEqual(e, map[string]interface{}{"key": "session", "value": "a"}) {
+		t.Error("unexpected expired entry", e)
+	}
+	if _, ok := send("kvGet", "session").(*stcoreError); !ok {
+		t.Error("expected expired key not to be found")
+	}
+
+	// the default TTL applies to kvSet, and expired entries are evicted
+	// as soon as they are used
+	kv.SetSourceParameter("defaultTTL", "1ms")
+	if r := send("kvSet", "default", "d"); r != true {
+		t.Error("expected new key", r)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if r := send("kvSet", "default", "e"); r != true {
+		t.Error("expected expired key to be set as new", r)
+	}
+	e = nextExpired()
+	if !reflect.DeepEqual(e, map[string]interface{}{"key": "default", "value": "d"}) {
+		t.Error("unexpected expired entry", e)
+	}
+	nextExpired()
+	if r := send("kvDump", true); !reflect.DeepEqual(r, map[string]interface{}{"forever": "b"}) {
+		t.Error("unexpected dump after expiry", r)
+	}
+
+	// only the latest evictions are kept until a kvExpired block takes them
+	kvExpired.Stop()
+	defer func(max int) {
+		kvExpiredMax = max
+	}(kvExpiredMax)
+	kvExpiredMax = 2
+	kv.Lock()
+	for _, key := range []string{"x", "y", "z"} {
+		kv.setTTL(key, key, time.Nanosecond)
+	}
+	time.Sleep(time.Millisecond)
+	kv.evict()
+	if len(kv.expired) != 2 {
+		t.Error("expected two expired entries to be kept", kv.expired)
+	}
+	kv.Unlock()
+}
+
+func TestKeyValueReadExpired(t *testing.T) {
+	log.Println("testing key value reads of expired entries")
+
+	// without Serve, nothing is evicted until the store is read
+	kv := NewKeyValue().(*KeyValue)
+	kv.Lock()
+	defer kv.Unlock()
+	kv.setTTL("gone", 1.0, time.Nanosecond)
+	kv.setTTL("kept", 2.0, time.Hour)
+	time.Sleep(time.Millisecond)
+
+	if ttls := kv.TTLs(); len(ttls) != 1 || ttls["kept"] <= 0 {
+		t.Error("unexpected TTLs", ttls)
+	}
+	kv.setTTL("gone", 1.0, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if v := kv.Get(); !reflect.DeepEqual(v, map[string]interface{}{"kept": 2.0}) {
+		t.Error("unexpected value", v)
+	}
+	if len(kv.expired) != 2 {
+		t.Error("expected expired entries to be queued for kvExpired", kv.expired)
+	}
+}
+
+func TestKeyValueAtomic(t *testing.T) {
+	log.Println("testing atomic key value blocks")
+
+	kv := NewKeyValue().(*KeyValue)
+	out := make(chan Message)
+	send := linkBlocks(t, kv, out, "kvIncrement", "kvCompareAndSet", "kvGetOrDefault", "kvKeys", "kvSize", "kvUpdatePath", "kvGet")
+
+	// two blocks counting the same key at once don't lose increments
+	counters := []*Block{linkBlock(t, kv, out, "kvIncrement"), linkBlock(t, kv, out, "kvIncrement")}
+	for _, b := range counters {
+		go func(b *Block) {
+			key, _ := b.GetInput(0)
+			delta, _ := b.GetInput(1)
+			for j := 0; j < 100; j++ {
+				key.C <- "count"
+				delta.C <- 1.0
+			}
+		}(b)
+	}
+	max := 0.0
+	for j := 0; j < 200; j++ {
+		if n := (<-out).(float64); n > max {
+			max = n
+		}
+	}
+	if max != 200 || kv.kv["count"] != 200.0 {
+		t.Error("increments were lost", max, kv.kv["count"])
+	}
+	if r := send("kvIncrement", "count", -0.5); r != 199.5 {
+		t.Error("unexpected value after decrement", r)
+	}
+
+	if r := send("kvCompareAndSet", "lock", nil, "a"); r != true {
+		t.Error("expected missing key to be set", r)
+	}
+	if r := send("kvCompareAndSet", "lock", nil, "b"); r != false {
+		t.Error("expected existing key not to be set", r)
+	}
+	if r := send("kvCompareAndSet", "lock", "a", "c"); r != true {
+		t.Error("expected matching key to be set", r)
+	}
+	if _, ok := send("kvIncrement", "lock", 1.0).(*stcoreError); !ok {
+		t.Error("expected error incrementing a string")
+	}
+
+	if r := send("kvGetOrDefault", "missing", 7.0); r != 7.0 {
+		t.Error("expected default", r)
+	}
+	if r := send("kvGetOrDefault", "lock", 7.0); r != "c" {
+		t.Error("expected stored value", r)
+	}
+
+	if r := send("kvUpdatePath", "user", "visits.total", 1.0); !reflect.DeepEqual(r, map[string]interface{}{
+		"visits": map[string]interface{}{"total": 1.0},
+	}) {
+		t.Error("unexpected value after creating a path", r)
+	}
+	kv.kv["list"] = map[string]interface{}{"items": []interface{}{map[string]interface{}{"n": 1.0}}}
+	emitted := send("kvGet", "list")
+	expected := map[string]interface{}{"items": []interface{}{map[string]interface{}{"n": 2.0}}}
+	if r := send("kvUpdatePath", "list", "items.0.n", 2.0); !reflect.DeepEqual(r, expected) {
+		t.Error("unexpected value after updating an array element", r)
+	}
+	if !reflect.DeepEqual(kv.kv["list"], expected) {
+		t.Error("kvUpdatePath did not store the updated value", kv.kv["list"])
+	}
+	if emitted.(map[string]interface{})["items"].([]interface{})[0].(map[string]interface{})["n"] != 1.0 {
+		t.Error("kvUpdatePath changed a value that had already been emitted")
+	}
+	for _, path := range []string{"items.1.n", "items.0.n.x", ""} {
+		if _, ok := send("kvUpdatePath", "list", path, 0.0).(*stcoreError); !ok {
+			t.Error("expected error updating path", path)
+		}
+	}
+
+	if r := send("kvKeys", true); !reflect.DeepEqual(r, []interface{}{"count", "list", "lock", "user"}) {
+		t.Error("unexpected keys", r)
+	}
+	if r := send("kvSize", true); r != 4.0 {
+		t.Error("unexpected size", r)
+	}
+}
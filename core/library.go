@@ -31,6 +31,9 @@ func GetLibrary() map[string]Spec {
 		Gate(),
 		Identity(),
 		Timestamp(),
+		StreamMerge(),
+		Switch(),
+		Watchdog(),
 
 		// object
 		Set(),
@@ -87,9 +90,18 @@ func GetLibrary() map[string]Spec {
 		// key value
 		kvGet(),
 		kvSet(),
+		kvSetTTL(),
+		kvExpired(),
 		kvClear(),
 		kvDump(),
 		kvDelete(),
+		kvIncrement(),
+		kvCompareAndSet(),
+		kvGetOrDefault(),
+		kvKeys(),
+		kvSize(),
+		kvUpdatePath(),
+		FSM(),
 
 		// parsers
 		ParseJSON(),
@@ -97,6 +109,10 @@ func GetLibrary() map[string]Spec {
 		// NSQ interface
 		NSQConsumerConnect(),
 		NSQConsumerReceive(),
+		NSQConsumerDisconnect(),
+		NSQAck(),
+		NSQRequeue(),
+		NSQProducerPublish(),
 
 		// primitive value
 		ValueGet(),
@@ -109,9 +125,31 @@ func GetLibrary() map[string]Spec {
 		listAppend(),
 		listPop(),
 		listDump(),
+		listLen(),
+		listInsert(),
+		listRange(),
+		listRemove(),
+		listTrim(),
+
+		// set
+		setAdd(),
+		setRemove(),
+		setHas(),
+		setSize(),
+		setMembers(),
+		setUnion(),
+		setIntersection(),
+		setDifference(),
+		setSymmetricDifference(),
+
+		// bloom
+		bloomAdd(),
+		bloomTest(),
 
 		// priority queue
 		pqPush(),
+		pqPushMany(),
+		pqPopUntil(),
 		pqPop(),
 		pqPeek(),
 		pqLen(),
@@ -145,9 +183,35 @@ func GetLibrary() map[string]Spec {
 		wsClientConnect(),
 		wsClientReceive(),
 		wsClientSend(),
+		wsServerSend(),
+		wsServerReceive(),
 
 		// stdin
 		StdinReceive(),
+
+		// files
+		FileTailReceive(),
+		Write(),
+
+		// exec
+		ExecSend(),
+		ExecReceive(),
+
+		// sql
+		SQLQuery(),
+		SQLExec(),
+
+		// http ingress
+		HTTPReceive(),
+		HTTPRespond(),
+
+		// sockets
+		TCPListenerReceive(),
+		TCPListenerSend(),
+		TCPDialerReceive(),
+		TCPDialerSend(),
+		UDPReceive(),
+		UDPSend(),
 	}
 
 	library := make(map[string]Spec)
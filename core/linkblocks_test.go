@@ -0,0 +1,33 @@
+package core
+
+import "testing"
+
+// linkBlock starts a block from the library, linked to s, with its first
+// output connected to out
+func linkBlock(t *testing.T, s Source, out chan Message, name string) *Block {
+	b := NewBlock(GetLibrary()[name])
+	go b.Serve()
+	go DummyMonitor(b.Monitor)
+	if err := b.SetSource(s); err != nil {
+		t.Fatal(err)
+	}
+	b.Connect(0, out)
+	return b
+}
+
+// linkBlocks starts a block for each name, as linkBlock does, and returns a
+// function that sends msgs to the named block's inputs in order and returns
+// the next message on out
+func linkBlocks(t *testing.T, s Source, out chan Message, names ...string) func(name string, msgs ...Message) Message {
+	blocks := make(map[string]*Block)
+	for _, name := range names {
+		blocks[name] = linkBlock(t, s, out, name)
+	}
+	return func(name string, msgs ...Message) Message {
+		for j, m := range msgs {
+			in, _ := blocks[name].GetInput(RouteIndex(j))
+			in.C <- m
+		}
+		return <-out
+	}
+}
@@ -2,21 +2,21 @@ package core
 
 func And() Spec {
 	return Spec{
-		Name:    "and",
-		Inputs:  []Pin{Pin{"in", BOOLEAN}, Pin{"in", BOOLEAN}},
-		Outputs: []Pin{Pin{"out", BOOLEAN}},
+		Name:     "and",
+		Inputs:   []Pin{Pin{"in", BOOLEAN}, Pin{"in", BOOLEAN}},
+		Outputs:  []Pin{Pin{"out", BOOLEAN}},
+		Variadic: &Variadic{Start: 0, Min: 2, Max: 64},
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
-			x, ok := in[0].(bool)
-			if !ok {
-				out[0] = NewError("need boolean")
-				return nil
-			}
-			y, ok := in[1].(bool)
-			if !ok {
-				out[0] = NewError("need boolean")
-				return nil
+			result := true
+			for j := 0; j < len(in); j++ {
+				x, ok := in[RouteIndex(j)].(bool)
+				if !ok {
+					out[0] = NewError("need boolean")
+					return nil
+				}
+				result = result && x
 			}
-			out[0] = x && y
+			out[0] = result
 			return nil
 		},
 	}
@@ -24,21 +24,21 @@ func And() Spec {
 
 func Or() Spec {
 	return Spec{
-		Name:    "or",
-		Inputs:  []Pin{Pin{"in", BOOLEAN}, Pin{"in", BOOLEAN}},
-		Outputs: []Pin{Pin{"out", BOOLEAN}},
+		Name:     "or",
+		Inputs:   []Pin{Pin{"in", BOOLEAN}, Pin{"in", BOOLEAN}},
+		Outputs:  []Pin{Pin{"out", BOOLEAN}},
+		Variadic: &Variadic{Start: 0, Min: 2, Max: 64},
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
-			x, ok := in[0].(bool)
-			if !ok {
-				out[0] = NewError("need boolean")
-				return nil
-			}
-			y, ok := in[1].(bool)
-			if !ok {
-				out[0] = NewError("need boolean")
-				return nil
+			result := false
+			for j := 0; j < len(in); j++ {
+				x, ok := in[RouteIndex(j)].(bool)
+				if !ok {
+					out[0] = NewError("need boolean")
+					return nil
+				}
+				result = result || x
 			}
-			out[0] = x || y
+			out[0] = result
 			return nil
 		},
 	}
@@ -1,33 +1,62 @@
 package core
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"strings"
 	"time"
 )
 
-// HTTPResponse makes an HTTP request to the specified URL, emitting the response as a string.
+type httpResult struct {
+	resp *http.Response
+	body []byte
+	err  error
+}
+
+// HTTPRequest makes an HTTP request to the specified URL, emitting the response's status,
+// headers and body. If the response is JSON, the parsed body is emitted as json, and if
+// its status is 4xx or 5xx, an error carrying the status is emitted as error.
+// Requests that fail or receive a 5xx are retried, waiting backoff before the first
+// retry and doubling the wait after each one. Only idempotent methods are retried
+// unless retryAll is set, as retrying a POST or PATCH could repeat its effect.
 func HTTPRequest() Spec {
 	return Spec{
-		Name:    "HTTPRequest",
-		Inputs:  []Pin{Pin{"URL", STRING}, Pin{"header", OBJECT}, Pin{"method", STRING}, Pin{"body", STRING}},
-		Outputs: []Pin{Pin{"response", STRING}},
+		Name: "HTTPRequest",
+		Inputs: []Pin{
+			Pin{"URL", STRING},
+			Pin{"header", OBJECT},
+			Pin{"method", STRING},
+			Pin{"body", STRING},
+			Pin{"timeout", STRING},
+			Pin{"retries", NUMBER},
+			Pin{"backoff", STRING},
+			Pin{"skipVerify", BOOLEAN},
+			Pin{"retryAll", BOOLEAN},
+		},
+		Outputs: []Pin{Pin{"response", OBJECT}},
+		Defaults: map[RouteIndex]Message{
+			4: "0s",
+			5: float64(0),
+			6: "1s",
+			7: false,
+			8: false,
+		},
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
 
 			url, ok := in[0].(string)
 			if !ok {
-				out[0] = NewError("HTTPResponse requires url to be a string")
+				out[0] = NewError("HTTPRequest requires url to be a string")
 				return nil
 			}
 
 			// header should be provided as a map like {"Content-Type": "application/x-www-form-urlencoded"}
-			// TODO
 			header, ok := in[1].(map[string]interface{})
 			if !ok {
-				out[0] = NewError("HTTPResponse requres headers to be an object")
+				out[0] = NewError("HTTPRequest requires headers to be an object")
 				return nil
 			}
 			method, ok := in[2].(string)
@@ -51,79 +80,165 @@ func HTTPRequest() Spec {
 			requestBody, ok := in[3].(string)
 			if !ok {
 				out[0] = NewError("HTTPRequest requires a string body")
+				return nil
 			}
 
-			// let's only make one client. We'll store it in the internal state
-			var client http.Client
-			clientInterface, ok := internal[0]
-			if ok {
-				client, ok = clientInterface.(http.Client)
-				if !ok {
-					log.Fatal("found non-client in the internal state")
-				}
-			} else {
-				// TODO do we want to specify timeout as a Pin here? Would we have to ditch the idea of reusing the client?
-				transport := http.Transport{
-					Dial: func(network, addr string) (net.Conn, error) {
-						return net.DialTimeout(network, addr, time.Duration(10*time.Second))
-					},
-				}
-				client = http.Client{
-					Transport: &transport,
-				}
-				internal[0] = client
+			timeoutString, ok := in[4].(string)
+			if !ok {
+				out[0] = NewError("HTTPRequest requires timeout to be a string")
+				return nil
+			}
+			timeout, err := time.ParseDuration(timeoutString)
+			if err != nil {
+				out[0] = NewError("HTTPRequest could not parse timeout")
+				return nil
 			}
 
-			req, err := http.NewRequest(method, url, strings.NewReader(requestBody))
+			retries, ok := in[5].(float64)
+			if !ok || retries < 0 {
+				out[0] = NewError("HTTPRequest requires retries to be a non-negative number")
+				return nil
+			}
+
+			backoffString, ok := in[6].(string)
+			if !ok {
+				out[0] = NewError("HTTPRequest requires backoff to be a string")
+				return nil
+			}
+			backoff, err := time.ParseDuration(backoffString)
 			if err != nil {
-				out[0] = NewError("Could not build request")
+				out[0] = NewError("HTTPRequest could not parse backoff")
 				return nil
 			}
-			for key, value := range header {
-				vstring, ok := value.(string)
-				if !ok {
-					out[0] = NewError("Header values must be strings")
-					return nil
+
+			skipVerify, ok := in[7].(bool)
+			if !ok {
+				out[0] = NewError("HTTPRequest requires skipVerify to be a boolean")
+				return nil
+			}
+
+			retryAll, ok := in[8].(bool)
+			if !ok {
+				out[0] = NewError("HTTPRequest requires retryAll to be a boolean")
+				return nil
+			}
+			if !retryAll {
+				switch method {
+				case "POST", "PATCH":
+					retries = 0
 				}
-				if key == "Host" {
-					req.Host = vstring
-				} else {
-					req.Header.Set(key, vstring)
+			}
+
+			// let's only make one client for each TLS setting. We'll store it in the internal state.
+			// Dialing is bounded by the request's context, so it shares the request's timeout.
+			client, ok := internal[0].(*http.Client)
+			if !ok || internal[1] != skipVerify {
+				transport := &http.Transport{
+					DialContext:     (&net.Dialer{}).DialContext,
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: skipVerify},
+				}
+				client = &http.Client{
+					Transport: transport,
 				}
+				internal[0] = client
+				internal[1] = skipVerify
 			}
-			errChan := make(chan error)
-			respChan := make(chan *http.Response)
-			go func() {
-				resp, err := client.Do(req)
-				if err != nil {
-					errChan <- err
+
+			var result httpResult
+			wait := backoff
+			for attempt := 0; attempt <= int(retries); attempt++ {
+				if attempt > 0 {
+					select {
+					case <-time.After(wait):
+					case f := <-i:
+						return f
+					}
+					wait *= 2
 				}
-				respChan <- resp
-			}()
 
-			select {
-			case err := <-errChan:
-				out[0] = err
-				return nil
-			case resp := <-respChan:
-				defer resp.Body.Close()
-				responseBody, err := ioutil.ReadAll(resp.Body)
+				// a zero timeout means no timeout
+				var ctx context.Context
+				var cancel context.CancelFunc
+				if timeout > 0 {
+					ctx, cancel = context.WithTimeout(context.Background(), timeout)
+				} else {
+					ctx, cancel = context.WithCancel(context.Background())
+				}
+				req, err := http.NewRequest(method, url, strings.NewReader(requestBody))
 				if err != nil {
-					out[0] = err
+					cancel()
+					out[0] = NewError("HTTPRequest could not build request")
 					return nil
 				}
-				out[0] = string(responseBody)
+				req = req.WithContext(ctx)
+				for key, value := range header {
+					vstring, ok := value.(string)
+					if !ok {
+						cancel()
+						out[0] = NewError("HTTPRequest header values must be strings")
+						return nil
+					}
+					if key == "Host" {
+						req.Host = vstring
+					} else {
+						req.Header.Set(key, vstring)
+					}
+				}
+
+				resultChan := make(chan httpResult, 1)
+				go func() {
+					resp, err := client.Do(req)
+					if err != nil {
+						resultChan <- httpResult{err: err}
+						return
+					}
+					defer resp.Body.Close()
+					body, err := ioutil.ReadAll(resp.Body)
+					resultChan <- httpResult{resp, body, err}
+				}()
+
+				select {
+				case result = <-resultChan:
+					cancel()
+				case f := <-i:
+					cancel()
+					return f
+				}
+
+				if result.err == nil && result.resp.StatusCode < 500 {
+					break
+				}
+			}
+
+			if result.err != nil {
+				out[0] = NewError("HTTPRequest failed with: " + result.err.Error())
 				return nil
-			case f := <-i:
-				t := client.Transport
-				transport := t.(*http.Transport)
-				transport.CancelRequest(req)
-				return f
+			}
 
+			headers := make(map[string]interface{})
+			for k, v := range result.resp.Header {
+				headers[k] = strings.Join(v, ", ")
 			}
 
-			return nil
+			response := map[string]interface{}{
+				"status":  float64(result.resp.StatusCode),
+				"headers": headers,
+				"body":    string(result.body),
+			}
+
+			if result.resp.StatusCode >= 400 {
+				response["error"] = "HTTPRequest received status " + result.resp.Status + " from " + url
+			}
 
+			if strings.Contains(result.resp.Header.Get("Content-Type"), "json") {
+				var parsed interface{}
+				if err := json.Unmarshal(result.body, &parsed); err == nil {
+					response["json"] = parsed
+				}
+			}
+
+			out[0] = response
+			return nil
 		},
 	}
 }
@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/bitly/go-nsq"
 	"github.com/nsqio/nsq/nsqd"
 	"github.com/nsqio/nsq/nsqlookupd"
 )
@@ -120,6 +122,8 @@ func TestNSQConsumer(t *testing.T) {
 	topic := InputValue{topicName}
 	channel := InputValue{"testChannel"}
 	maxInFlight := InputValue{1.0}
+	nsqdAddr := InputValue{""}
+	manualAck := InputValue{false}
 	err = blocks["connect"].SetInput(0, &topic)
 	if err != nil {
 		t.Fatal(err)
@@ -132,6 +136,14 @@ func TestNSQConsumer(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	err = blocks["connect"].SetInput(4, &nsqdAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blocks["connect"].SetInput(5, &manualAck)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	in, err := blocks["connect"].GetInput(2)
 	if err != nil {
@@ -154,3 +166,175 @@ func TestNSQConsumer(t *testing.T) {
 	nsq.Stop()
 
 }
+
+func TestNSQConsumerManualAck(t *testing.T) {
+
+	log.Println("testing nsq consumer manual ack")
+
+	nsqd := newFakeNSQD(t)
+	defer nsqd.Close()
+
+	nsqSource := NewNSQConsumer()
+	nsq := nsqSource.(*NSQConsumer)
+	go nsq.Serve()
+	defer nsq.Stop()
+
+	if nsq.State()["status"] != "disconnected" {
+		t.Fatal("nsq consumer should start disconnected")
+	}
+
+	library := GetLibrary()
+	blocks := map[string]*Block{
+		"connect":    NewBlock(library["NSQConsumerConnect"]),
+		"disconnect": NewBlock(library["NSQConsumerDisconnect"]),
+		"recv":       NewBlock(library["NSQConsumerReceive"]),
+		"ack":        NewBlock(library["NSQAck"]),
+		"requeue":    NewBlock(library["NSQRequeue"]),
+	}
+
+	for _, v := range blocks {
+		go v.Serve()
+		go DummyMonitor(v.Monitor)
+		err := v.SetSource(nsq)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	connected := make(chan Message)
+	blocks["connect"].Connect(0, connected)
+	for route, v := range []interface{}{"test", "testChannel", "", 1.0, nsqd.Addr()} {
+		blocks["connect"].SetInput(RouteIndex(route), &InputValue{v})
+	}
+	manualAck, _ := blocks["connect"].GetInput(5)
+	manualAck.C <- true
+	if m := <-connected; m != true {
+		t.Fatal("expected true from connect", m)
+	}
+	if nsq.State()["status"] != "connected" {
+		t.Error("nsq consumer should report connected", nsq.State())
+	}
+
+	msgs := make(chan Message)
+	handles := make(chan Message)
+	blocks["recv"].Connect(0, msgs)
+	blocks["recv"].Connect(1, handles)
+
+	acked := make(chan Message)
+	blocks["ack"].Connect(0, acked)
+	ackIn, _ := blocks["ack"].GetInput(0)
+
+	requeued := make(chan Message)
+	blocks["requeue"].Connect(0, requeued)
+	blocks["requeue"].SetInput(1, &InputValue{"1s"})
+	requeueIn, _ := blocks["requeue"].GetInput(0)
+
+	// nothing is finished until the pattern acks it
+	nsqd.messages <- "first"
+	if m := <-msgs; m != "first" {
+		t.Fatal("received incorrect message", m)
+	}
+	handle := <-handles
+	select {
+	case cmd := <-nsqd.commands:
+		t.Fatal("message was responded to before ack", cmd)
+	case <-time.After(50 * time.Millisecond):
+	}
+	ackIn.C <- handle
+	if <-acked != true {
+		t.Fatal("ack failed")
+	}
+	if cmd := <-nsqd.commands; cmd.name != "FIN" || cmd.params[0] != handle {
+		t.Error("expected FIN for acked message", cmd)
+	}
+
+	// acking twice fails
+	ackIn.C <- handle
+	if _, ok := (<-acked).(*stcoreError); !ok {
+		t.Error("expected error acking a message twice")
+	}
+
+	nsqd.messages <- "second"
+	<-msgs
+	requeueIn.C <- <-handles
+	if <-requeued != true {
+		t.Fatal("requeue failed")
+	}
+	if cmd := <-nsqd.commands; cmd.name != "REQ" || cmd.params[1] != "1000" {
+		t.Error("expected REQ for requeued message", cmd)
+	}
+
+	disconnected := make(chan Message)
+	blocks["disconnect"].Connect(0, disconnected)
+	disconnectIn, _ := blocks["disconnect"].GetInput(0)
+	disconnectIn.C <- true
+	if <-disconnected != true {
+		t.Fatal("disconnect failed")
+	}
+	if nsq.State()["status"] != "disconnected" {
+		t.Error("nsq consumer should report disconnected", nsq.State())
+	}
+}
+
+func TestNSQConsumerReconnect(t *testing.T) {
+
+	log.Println("testing nsq consumer reconnect")
+
+	defer func(base, max, poll time.Duration) {
+		reconnectBase, reconnectMax, reconnectPoll = base, max, poll
+	}(reconnectBase, reconnectMax, reconnectPoll)
+	reconnectBase, reconnectMax, reconnectPoll = 100*time.Millisecond, 200*time.Millisecond, 10*time.Millisecond
+
+	// find a free address, and leave nothing listening on it
+	nsqd := newFakeNSQD(t)
+	addr := nsqd.Addr()
+	nsqd.Close()
+
+	consumer := NewNSQConsumer().(*NSQConsumer)
+	go consumer.Serve()
+	defer consumer.Stop()
+
+	waitFor := func(status string) {
+		for {
+			select {
+			case <-consumer.StateChanges():
+				if consumer.State()["status"] == status {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("nsq consumer never reached status", status, consumer.State())
+			}
+		}
+	}
+
+	errChan := make(chan *stcoreError, 1)
+	consumer.connectChan <- NSQConf{
+		conf:     nsq.NewConfig(),
+		topic:    "test",
+		channel:  "testChannel",
+		nsqdAddr: addr,
+		errChan:  errChan,
+	}
+	if err := <-errChan; err == nil {
+		t.Fatal("expected connect to fail with nothing listening")
+	}
+	waitFor(STATUS_RETRYING)
+
+	// start nsqd, and the consumer should find it
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("could not listen on", addr)
+	}
+	nsqd = serveFakeNSQD(l)
+	waitFor(STATUS_CONNECTED)
+	if consumer.State()["nsqdAddr"] != addr {
+		t.Error("nsq consumer state should include nsqdAddr", consumer.State())
+	}
+
+	nsqd.messages <- "after reconnect"
+	msg, _, _ := consumer.ReceiveMessage(make(chan Interrupt))
+	if msg.msg != "after reconnect" {
+		t.Error("received incorrect message", msg)
+	}
+	nsqd.Close()
+}
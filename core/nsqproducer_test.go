@@ -0,0 +1,87 @@
+package core
+
+import (
+	"log"
+	"testing"
+)
+
+func TestNSQProducer(t *testing.T) {
+	log.Println("testing nsq producer")
+
+	nsqd := newFakeNSQD(t)
+	defer nsqd.Close()
+	commands := nsqd.commands
+
+	nsqSource := NewNSQProducer()
+	nsq, ok := nsqSource.(Interface)
+	if !ok {
+		t.Fatal("could not assert nsq producer to Interface")
+	}
+	go nsq.Serve()
+	defer nsq.Stop()
+	if nsq.GetType() != NSQPRODUCER {
+		t.Fatal("nsq producer returns wrong type")
+	}
+
+	p := nsqSource.(*NSQProducer)
+	p.SetSourceParameter("nsqd", nsqd.Addr())
+	p.SetSourceParameter("client_id", "st-core")
+	p.SetSourceParameter("not_an_option", "1")
+	params := p.Describe()
+	if len(params) != 2 || params[1]["name"] != "client_id" {
+		t.Error("nsq producer kept unexpected parameters", params)
+	}
+
+	block := NewBlock(GetLibrary()["NSQProducerPublish"])
+	go block.Serve()
+	go DummyMonitor(block.Monitor)
+	err := block.SetSource(nsq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := make(chan Message)
+	block.Connect(0, out)
+	topic, _ := block.GetInput(0)
+	msg, _ := block.GetInput(1)
+	delay, _ := block.GetInput(2)
+
+	publish := func(tp string, m interface{}, d string) Message {
+		topic.C <- tp
+		msg.C <- m
+		delay.C <- d
+		return <-out
+	}
+
+	if r := publish("test", "hello", "0s"); r != true {
+		t.Fatal("publish failed", r)
+	}
+	cmd := <-commands
+	if cmd.name != "PUB" || cmd.params[0] != "test" || cmd.bodies[0] != "hello" {
+		t.Error("unexpected publish", cmd)
+	}
+
+	if r := publish("test", map[string]interface{}{"a": 1.0}, "1s"); r != true {
+		t.Fatal("deferred publish failed", r)
+	}
+	cmd = <-commands
+	if cmd.name != "DPUB" || cmd.params[1] != "1000" || cmd.bodies[0] != `{"a":1}` {
+		t.Error("unexpected deferred publish", cmd)
+	}
+
+	if r := publish("test", []interface{}{"one", 2.0}, "0s"); r != true {
+		t.Fatal("multi publish failed", r)
+	}
+	cmd = <-commands
+	if cmd.name != "MPUB" || len(cmd.bodies) != 2 || cmd.bodies[0] != "one" || cmd.bodies[1] != "2" {
+		t.Error("unexpected multi publish", cmd)
+	}
+
+	if _, ok := publish("bad", "hello", "0s").(*stcoreError); !ok {
+		t.Error("expected error publishing to bad topic")
+	}
+
+	if _, ok := publish("test", []interface{}{"one", "two"}, "1s").(*stcoreError); !ok {
+		t.Error("expected error deferring multiple messages")
+	}
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// the range of waits between reconnection attempts, and how often sources
+// that have to poll check their connections. These are variables so that
+// tests can shorten them.
+var (
+	reconnectBase = 500 * time.Millisecond
+	reconnectMax  = 30 * time.Second
+	reconnectPoll = time.Second
+)
+
+const (
+	STATUS_DISCONNECTED = "disconnected"
+	STATUS_CONNECTING   = "connecting"
+	STATUS_CONNECTED    = "connected"
+	STATUS_RETRYING     = "retrying"
+)
+
+// reconnectDelay returns how long to wait before the given retry. The wait
+// doubles with each retry up to reconnectMax, and is jittered by up to half
+// so that many sources don't reconnect in lockstep.
+func reconnectDelay(retry int) time.Duration {
+	d := reconnectMax
+	if retry < 32 && reconnectBase<<uint(retry) < reconnectMax {
+		d = reconnectBase << uint(retry)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// connState tracks the connection state of an interface source, and signals
+// on changes whenever it moves to a new state.
+type connState struct {
+	stateMu sync.Mutex
+	status  string
+	retries int
+	err     string
+	changes chan struct{}
+}
+
+func newConnState() connState {
+	return connState{
+		status:  STATUS_DISCONNECTED,
+		changes: make(chan struct{}, 1),
+	}
+}
+
+func (c *connState) setStatus(status string, retries int, err string) {
+	c.stateMu.Lock()
+	if c.status == status && c.retries == retries && c.err == err {
+		c.stateMu.Unlock()
+		return
+	}
+	c.status, c.retries, c.err = status, retries, err
+	c.stateMu.Unlock()
+
+	// changes only needs to hold one signal, as State always reports the
+	// latest state
+	select {
+	case c.changes <- struct{}{}:
+	default:
+	}
+}
+
+func (c *connState) getStatus() string {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	return c.status
+}
+
+func (c *connState) connState() map[string]interface{} {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+	state := map[string]interface{}{
+		"status":  c.status,
+		"retries": float64(c.retries),
+	}
+	if c.err != "" {
+		state["error"] = c.err
+	}
+	return state
+}
+
+func (c *connState) StateChanges() chan struct{} {
+	return c.changes
+}
@@ -0,0 +1,159 @@
+package core
+
+import (
+	"log"
+	"reflect"
+	"testing"
+
+	"github.com/alicebob/miniredis"
+)
+
+func TestRedis(t *testing.T) {
+	log.Println("testing redis")
+
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	// two sources sharing one server stand in for two st-core instances
+	newRedis := func() *Redis {
+		r := NewRedis().(*Redis)
+		r.SetSourceParameter("address", server.Addr())
+		r.SetSourceParameter("key", "test")
+		r.SetSourceParameter("db", "-1")
+		go r.Serve()
+		return r
+	}
+	a, b := newRedis(), newRedis()
+	defer a.Stop()
+	defer b.Stop()
+	if a.Describe()[2]["value"] != "0" {
+		t.Error("redis source accepted an invalid db", a.Describe())
+	}
+
+	// the password is masked, and setting the mask keeps it
+	p := NewRedis().(*Redis)
+	if p.Describe()[1]["value"] != "" {
+		t.Error("expected no password", p.Describe())
+	}
+	p.SetSourceParameter("password", "secret")
+	if p.Describe()[1]["value"] != redisPasswordMask {
+		t.Error("password was not masked", p.Describe())
+	}
+	p.SetSourceParameter("password", redisPasswordMask)
+	if p.password != "secret" {
+		t.Error("setting the mask changed the password", p.password)
+	}
+
+	library := GetLibrary()
+	out := make(chan Message)
+	block := func(name string, r *Redis) *Block {
+		b := NewBlock(library[name])
+		go b.Serve()
+		go DummyMonitor(b.Monitor)
+		if err := b.SetSource(r); err != nil {
+			t.Fatal(err)
+		}
+		b.Connect(0, out)
+		return b
+	}
+	kvSet := block("kvSet", a)
+	kvGet := block("kvGet", b)
+	kvDelete := block("kvDelete", b)
+	listAppend := block("listAppend", a)
+	listPop := block("listPop", b)
+
+	// the blocks still link to their own stores, but not to each other's, and
+	// blocks that need more than redis offers don't link to it
+	if err := kvGet.SetSource(NewKeyValue()); err != nil {
+		t.Error("kvGet should link to a key_value source", err)
+	}
+	if err := kvGet.SetSource(NewList()); err == nil {
+		t.Error("kvGet should not link to a list source")
+	}
+	if err := listPop.SetSource(NewList()); err != nil {
+		t.Error("listPop should link to a list source", err)
+	}
+	if err := listPop.SetSource(NewKeyValue()); err == nil {
+		t.Error("listPop should not link to a key_value source")
+	}
+	setTTL := NewBlock(library["kvSetTTL"])
+	go setTTL.Serve()
+	go DummyMonitor(setTTL.Monitor)
+	if err := setTTL.SetSource(a); err == nil {
+		t.Error("kvSetTTL should not link to a redis source")
+	}
+	kvGet.SetSource(b)
+	listPop.SetSource(b)
+
+	send := func(b *Block, msgs ...Message) Message {
+		for j, m := range msgs {
+			in, _ := b.GetInput(RouteIndex(j))
+			in.C <- m
+		}
+		return <-out
+	}
+
+	if r := send(kvSet, "foo", map[string]interface{}{"n": 1.0}); r != true {
+		t.Error("expected new key", r)
+	}
+	if r := send(kvSet, "foo", "bar"); r != false {
+		t.Error("expected existing key", r)
+	}
+	if r := send(kvGet, "foo"); r != "bar" {
+		t.Error("unexpected value", r)
+	}
+	if r := send(kvDelete, "foo"); r != true {
+		t.Error("expected key to be deleted", r)
+	}
+	if r := send(kvDelete, "foo"); r != false {
+		t.Error("expected missing key not to be deleted", r)
+	}
+	if _, ok := send(kvGet, "foo").(*stcoreError); !ok {
+		t.Error("expected error getting missing key")
+	}
+
+	for _, e := range []Message{1.0, "two"} {
+		if r := send(listAppend, e); r != true {
+			t.Error("listAppend failed", r)
+		}
+	}
+	if r := send(listPop, nil); r != "two" {
+		t.Error("unexpected element", r)
+	}
+
+	// the whole store can be read and replaced through either source
+	err = b.Set(map[string]interface{}{
+		"kv":   map[string]interface{}{"x": []interface{}{true}},
+		"list": []interface{}{"a", "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"kv":   map[string]interface{}{"x": []interface{}{true}},
+		"list": []interface{}{"a", "b"},
+	}
+	if v := a.Get(); !reflect.DeepEqual(v, expected) {
+		t.Error("unexpected store value", v)
+	}
+	if a.Set([]interface{}{}) == nil || a.Set(map[string]interface{}{"list": "a"}) == nil {
+		t.Error("expected error setting store to an invalid value")
+	}
+	if r := send(listPop, nil); r != "b" {
+		t.Error("unexpected element after set", r)
+	}
+
+	server.Close()
+	if _, ok := send(kvGet, "x").(*stcoreError); !ok {
+		t.Error("expected error once the server is gone")
+	}
+	if _, ok := a.Get().(error); !ok {
+		t.Error("expected Get to return an error once the server is gone")
+	}
+	if a.Set(map[string]interface{}{"list": []interface{}{}}) == nil {
+		t.Error("expected Set to return an error once the server is gone")
+	}
+}
@@ -17,6 +17,18 @@ func TestSimpleBlocks(t *testing.T) {
 			in:       MessageMap{0: 1.0, 1: 2.0},
 			expected: MessageMap{0: 3.0},
 		},
+		"concat": blockTest{
+			in:       MessageMap{0: "a", 1: "b", 2: "c"},
+			expected: MessageMap{0: "abc"},
+		},
+		"and": blockTest{
+			in:       MessageMap{0: true, 1: true, 2: false},
+			expected: MessageMap{0: false},
+		},
+		"or": blockTest{
+			in:       MessageMap{0: false, 1: false, 2: true},
+			expected: MessageMap{0: true},
+		},
 		"-": blockTest{
 			in:       MessageMap{0: 1.0, 1: 2.0},
 			expected: MessageMap{0: -1.0},
@@ -0,0 +1,307 @@
+package core
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FRAMING_NEWLINE  = "newline"
+	FRAMING_LENGTH   = "length"
+	FRAMING_DATAGRAM = "datagram"
+
+	defaultSocketMaxSize = 64 * 1024
+)
+
+// how long socket sources wait on dials and writes before giving up
+var (
+	socketDialTimeout  = 10 * time.Second
+	socketWriteTimeout = 10 * time.Second
+)
+
+var errSocketTooLarge = errors.New("message is larger than maxSize")
+
+type socketMsg struct {
+	addr string
+	msg  string
+}
+
+type socketReceiver interface {
+	ReceiveMessage(chan Interrupt) (socketMsg, Interrupt)
+}
+
+type closerFunc func() error
+
+func (c closerFunc) Close() error {
+	return c()
+}
+
+// socketFraming splits a stream into messages, either one per line or each
+// prefixed by its length as a 4 byte big endian integer.
+type socketFraming struct {
+	framing string
+	maxSize int
+}
+
+func (f socketFraming) read(r *bufio.Reader) ([]byte, error) {
+	if f.framing == FRAMING_LENGTH {
+		var size uint32
+		err := binary.Read(r, binary.BigEndian, &size)
+		if err != nil {
+			return nil, err
+		}
+		if int64(size) > int64(f.maxSize) {
+			return nil, errSocketTooLarge
+		}
+		msg := make([]byte, size)
+		_, err = io.ReadFull(r, msg)
+		return msg, err
+	}
+
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > f.maxSize+2 {
+			return nil, errSocketTooLarge
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = line[:len(line)-1]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		if len(line) > f.maxSize {
+			return nil, errSocketTooLarge
+		}
+		return line, nil
+	}
+}
+
+// frame returns msg as it should be written
+func (f socketFraming) frame(msg []byte) ([]byte, error) {
+	if len(msg) > f.maxSize {
+		return nil, errSocketTooLarge
+	}
+	switch f.framing {
+	case FRAMING_LENGTH:
+		framed := make([]byte, 4, 4+len(msg))
+		binary.BigEndian.PutUint32(framed, uint32(len(msg)))
+		return append(framed, msg...), nil
+	case FRAMING_NEWLINE:
+		if strings.ContainsAny(string(msg), "\r\n") {
+			return nil, errors.New("message contains a newline")
+		}
+		return append(msg, '\n'), nil
+	}
+	return msg, nil
+}
+
+// socketMessage returns strings as they are and anything else as JSON
+func socketMessage(m Message) ([]byte, error) {
+	if s, ok := m.(string); ok {
+		return []byte(s), nil
+	}
+	return json.Marshal(m)
+}
+
+// socket holds what the TCP and UDP sources have in common: an address to
+// listen on or dial, how to frame messages, and a loop that keeps the socket
+// open, retrying with backoff, until the source is stopped. Changing any
+// parameter reopens the socket, so that reads and writes always agree on the
+// framing.
+type socket struct {
+	connState
+	mu       sync.Mutex
+	address  string
+	framings []string
+	socketFraming
+	restart  chan struct{}
+	messages chan socketMsg
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+func newSocket(framings ...string) socket {
+	return socket{
+		connState:     newConnState(),
+		framings:      framings,
+		socketFraming: socketFraming{framings[0], defaultSocketMaxSize},
+		restart:       make(chan struct{}, 1),
+		messages:      make(chan socketMsg),
+		quit:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+func (s *socket) SetSourceParameter(name, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch name {
+	case "address":
+		if value == s.address {
+			return
+		}
+		s.address = value
+	case "framing":
+		if value == s.framing {
+			return
+		}
+		valid := false
+		for _, f := range s.framings {
+			valid = valid || f == value
+		}
+		if !valid {
+			return
+		}
+		s.framing = value
+	case "maxSize":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n == s.maxSize {
+			return
+		}
+		s.maxSize = n
+	default:
+		return
+	}
+	select {
+	case s.restart <- struct{}{}:
+	default:
+	}
+}
+
+func (s *socket) Describe() []map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return []map[string]string{
+		{"name": "address", "value": s.address},
+		{"name": "framing", "value": s.framing},
+		{"name": "maxSize", "value": strconv.Itoa(s.maxSize)},
+	}
+}
+
+func (s *socket) State() map[string]interface{} {
+	state := s.connState.connState()
+	s.mu.Lock()
+	state["address"] = s.address
+	s.mu.Unlock()
+	return state
+}
+
+func (s *socket) config() (string, socketFraming) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.address, s.socketFraming
+}
+
+// serve calls open to open the socket at the current address. open returns
+// something to close the socket with, and a channel that receives when the
+// socket fails. An empty address leaves the socket closed.
+func (s *socket) serve(open func(address string, f socketFraming) (io.Closer, <-chan error, error)) {
+	defer close(s.done)
+
+	// parameters set before serving don't need a restart
+	select {
+	case <-s.restart:
+	default:
+	}
+
+	retries := 0
+	for {
+		address, f := s.config()
+		if address == "" {
+			s.setStatus(STATUS_DISCONNECTED, 0, "")
+			select {
+			case <-s.restart:
+				continue
+			case <-s.quit:
+				return
+			}
+		}
+
+		s.setStatus(STATUS_CONNECTING, retries, "")
+		c, failed, err := open(address, f)
+		if err == nil {
+			retries = 0
+			s.setStatus(STATUS_CONNECTED, 0, "")
+			select {
+			case err = <-failed:
+				c.Close()
+			case <-s.restart:
+				c.Close()
+				continue
+			case <-s.quit:
+				c.Close()
+				s.setStatus(STATUS_DISCONNECTED, 0, "")
+				return
+			}
+		}
+
+		s.setStatus(STATUS_RETRYING, retries, err.Error())
+		select {
+		case <-time.After(reconnectDelay(retries)):
+			retries++
+		case <-s.restart:
+			retries = 0
+		case <-s.quit:
+			s.setStatus(STATUS_DISCONNECTED, 0, "")
+			return
+		}
+	}
+}
+
+func (s *socket) Stop() {
+	close(s.quit)
+	<-s.done
+}
+
+// deliver passes a received message on to the receive blocks
+func (s *socket) deliver(msg socketMsg) bool {
+	select {
+	case s.messages <- msg:
+		return true
+	case <-s.quit:
+		return false
+	}
+}
+
+func (s *socket) ReceiveMessage(i chan Interrupt) (socketMsg, Interrupt) {
+	select {
+	case msg := <-s.messages:
+		return msg, nil
+	case f := <-i:
+		return socketMsg{}, f
+	}
+}
+
+// socketReceive returns the spec of a block that emits each message received
+// by a socket source of type t
+func socketReceive(name string, t SourceType) Spec {
+	return Spec{
+		Name:    name,
+		Outputs: []Pin{Pin{"msg", OBJECT}},
+		Source:  t,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			msg, f := s.(socketReceiver).ReceiveMessage(i)
+			if f != nil {
+				return f
+			}
+			out[0] = map[string]interface{}{
+				"addr": msg.addr,
+				"msg":  msg.msg,
+			}
+			return nil
+		},
+	}
+}
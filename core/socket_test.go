@@ -0,0 +1,268 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// freeAddr returns a local address that nothing is listening on
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func waitForStatus(t *testing.T, s Stateful, status string) {
+	for s.State()["status"] != status {
+		select {
+		case <-s.StateChanges():
+		case <-time.After(5 * time.Second):
+			t.Fatal("source never reached status", status, s.State())
+		}
+	}
+}
+
+func TestSocketFraming(t *testing.T) {
+	log.Println("testing socket framing")
+
+	for _, framing := range []string{FRAMING_NEWLINE, FRAMING_LENGTH} {
+		f := socketFraming{framing, 5}
+		var buf bytes.Buffer
+		for _, msg := range []string{"one", "", "three"} {
+			framed, err := f.frame([]byte(msg))
+			if err != nil {
+				t.Fatal(framing, err)
+			}
+			buf.Write(framed)
+		}
+		if _, err := f.frame([]byte("toolong")); err != errSocketTooLarge {
+			t.Error(framing, "framing should reject messages larger than maxSize")
+		}
+		r := bufio.NewReader(&buf)
+		for _, expected := range []string{"one", "", "three"} {
+			msg, err := f.read(r)
+			if err != nil || string(msg) != expected {
+				t.Error(framing, "read unexpected message", string(msg), err)
+			}
+		}
+	}
+
+	f := socketFraming{FRAMING_NEWLINE, 5}
+	if _, err := f.frame([]byte("a\nb")); err == nil {
+		t.Error("newline framing should reject messages containing newlines")
+	}
+	msg, err := f.read(bufio.NewReader(bytes.NewBufferString("crlf\r\n")))
+	if err != nil || string(msg) != "crlf" {
+		t.Error("newline framing should strip carriage returns", string(msg), err)
+	}
+	if _, err := f.read(bufio.NewReader(bytes.NewBufferString("toolong\n"))); err != errSocketTooLarge {
+		t.Error("newline framing should reject lines larger than maxSize")
+	}
+}
+
+func TestTCPSockets(t *testing.T) {
+	log.Println("testing tcp listener and dialer")
+
+	defer func(base, max time.Duration) {
+		reconnectBase, reconnectMax = base, max
+	}(reconnectBase, reconnectMax)
+	reconnectBase, reconnectMax = 10*time.Millisecond, 50*time.Millisecond
+
+	addr := freeAddr(t)
+
+	listener := NewTCPListener().(*tcpListener)
+	listener.SetSourceParameter("address", addr)
+	listener.SetSourceParameter("framing", FRAMING_LENGTH)
+	listener.SetSourceParameter("framing", "smoke signals")
+	if listener.Describe()[1]["value"] != FRAMING_LENGTH {
+		t.Error("tcp listener accepted an unknown framing", listener.Describe())
+	}
+	go listener.Serve()
+	defer listener.Stop()
+	waitForStatus(t, listener, STATUS_CONNECTED)
+
+	// the dialer idles until it has an address
+	dialer := NewTCPDialer().(*tcpDialer)
+	go dialer.Serve()
+	defer dialer.Stop()
+	dialer.SetSourceParameter("framing", FRAMING_LENGTH)
+	dialer.SetSourceParameter("address", addr)
+	waitForStatus(t, dialer, STATUS_CONNECTED)
+
+	library := GetLibrary()
+	blocks := map[string]*Block{}
+	sources := map[string]Source{
+		"tcpListenerReceive": listener,
+		"tcpListenerSend":    listener,
+		"tcpDialerReceive":   dialer,
+		"tcpDialerSend":      dialer,
+	}
+	outs := map[string]chan Message{}
+	for name, s := range sources {
+		b := NewBlock(library[name])
+		go b.Serve()
+		go DummyMonitor(b.Monitor)
+		if err := b.SetSource(s); err != nil {
+			t.Fatal(err)
+		}
+		outs[name] = make(chan Message)
+		b.Connect(0, outs[name])
+		blocks[name] = b
+	}
+
+	dialerSend, _ := blocks["tcpDialerSend"].GetInput(0)
+	dialerSend.C <- map[string]interface{}{"metric": "cpu"}
+	if r := <-outs["tcpDialerSend"]; r != true {
+		t.Fatal("tcpDialerSend failed", r)
+	}
+	m := (<-outs["tcpListenerReceive"]).(map[string]interface{})
+	if m["msg"] != `{"metric":"cpu"}` || m["addr"] == "" {
+		t.Fatal("tcpListenerReceive emitted unexpected message", m)
+	}
+
+	listenerMsg, _ := blocks["tcpListenerSend"].GetInput(0)
+	listenerAddr, _ := blocks["tcpListenerSend"].GetInput(1)
+	listenerMsg.C <- "ack"
+	listenerAddr.C <- m["addr"]
+	if r := <-outs["tcpListenerSend"]; r != true {
+		t.Fatal("tcpListenerSend failed", r)
+	}
+	m = (<-outs["tcpDialerReceive"]).(map[string]interface{})
+	if m["msg"] != "ack" || m["addr"] != addr {
+		t.Error("tcpDialerReceive emitted unexpected message", m)
+	}
+
+	listenerMsg.C <- "ack"
+	listenerAddr.C <- "127.0.0.1:1"
+	if _, ok := (<-outs["tcpListenerSend"]).(*stcoreError); !ok {
+		t.Error("expected error sending to an unknown connection")
+	}
+
+	// moving the listener drops the dialer, which retries until it moves too
+	listener.SetSourceParameter("address", freeAddr(t))
+	waitForStatus(t, dialer, STATUS_RETRYING)
+	dialer.SetSourceParameter("address", listener.State()["address"].(string))
+	waitForStatus(t, dialer, STATUS_CONNECTED)
+	dialerSend.C <- "after move"
+	<-outs["tcpDialerSend"]
+	m = (<-outs["tcpListenerReceive"]).(map[string]interface{})
+	if m["msg"] != "after move" {
+		t.Error("tcpListenerReceive emitted unexpected message after move", m)
+	}
+
+	// changing the framing reopens the socket, so both ends of a connection
+	// always agree on it
+	listener.SetSourceParameter("framing", FRAMING_NEWLINE)
+	listener.SetSourceParameter("maxSize", "67108864")
+	waitForStatus(t, dialer, STATUS_RETRYING)
+	dialer.SetSourceParameter("framing", FRAMING_NEWLINE)
+	waitForStatus(t, dialer, STATUS_CONNECTED)
+	dialerSend.C <- "by line"
+	<-outs["tcpDialerSend"]
+	m = (<-outs["tcpListenerReceive"]).(map[string]interface{})
+	if m["msg"] != "by line" {
+		t.Error("tcpListenerReceive emitted unexpected message after changing framing", m)
+	}
+
+	// a peer that stops reading doesn't hold up the rest of the source
+	defer func(timeout time.Duration) {
+		socketWriteTimeout = timeout
+	}(socketWriteTimeout)
+	socketWriteTimeout = 2 * time.Second
+	stuck, err := net.Dial("tcp", listener.State()["address"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	for {
+		listener.mu.Lock()
+		_, ok := listener.conns[stuck.LocalAddr().String()]
+		listener.mu.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	sent := make(chan error)
+	go func() {
+		sent <- listener.Send("", bytes.Repeat([]byte("x"), 64*1024*1024))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	described := make(chan struct{})
+	go func() {
+		listener.Describe()
+		close(described)
+	}()
+	select {
+	case <-described:
+	case <-time.After(time.Second):
+		t.Error("Describe waited on a send to a peer that isn't reading")
+	}
+	<-sent
+}
+
+func TestUDPSocket(t *testing.T) {
+	log.Println("testing udp listener")
+
+	udp := NewUDPListener().(*udpListener)
+	udp.SetSourceParameter("framing", FRAMING_NEWLINE)
+	udp.SetSourceParameter("maxSize", "24")
+	udp.SetSourceParameter("address", "127.0.0.1:0")
+	go udp.Serve()
+	defer udp.Stop()
+	waitForStatus(t, udp, STATUS_CONNECTED)
+	udp.mu.Lock()
+	addr := udp.conn.LocalAddr().String()
+	udp.mu.Unlock()
+
+	library := GetLibrary()
+	receive := NewBlock(library["udpReceive"])
+	send := NewBlock(library["udpSend"])
+	received := make(chan Message)
+	sent := make(chan Message)
+	for b, out := range map[*Block]chan Message{receive: received, send: sent} {
+		go b.Serve()
+		go DummyMonitor(b.Monitor)
+		if err := b.SetSource(udp); err != nil {
+			t.Fatal(err)
+		}
+		b.Connect(0, out)
+	}
+
+	client, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// the oversized datagram is dropped
+	client.Write([]byte("this datagram is too large\n"))
+	client.Write([]byte("gauge:1|g\ncount:2|c\n"))
+	for _, expected := range []string{"gauge:1|g", "count:2|c"} {
+		m := (<-received).(map[string]interface{})
+		if m["msg"] != expected || m["addr"] != client.LocalAddr().String() {
+			t.Error("udpReceive emitted unexpected message", m)
+		}
+	}
+
+	msg, _ := send.GetInput(0)
+	to, _ := send.GetInput(1)
+	msg.C <- "pong"
+	to.C <- client.LocalAddr().String()
+	if r := <-sent; r != true {
+		t.Fatal("udpSend failed", r)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 16)
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "pong\n" {
+		t.Error("udp client received unexpected datagram", string(buf[:n]), err)
+	}
+}
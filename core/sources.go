@@ -3,12 +3,27 @@ package core
 func GetSources() map[string]SourceSpec {
 	sources := []SourceSpec{
 		NSQConsumerInterface(),
+		NSQProducerInterface(),
 		KeyValueStore(),
+		PersistentKeyValueStore(),
 		ValueStore(),
 		PriorityQueueStore(),
 		ListStore(),
+		SetStore(),
+		BloomStore(),
+		RedisStore(),
 		WebsocketClient(),
+		WebsocketServer(),
 		StdinInterface(),
+		HTTPIngressInterface(),
+		TCPListenerInterface(),
+		TCPDialerInterface(),
+		UDPListenerInterface(),
+		FileTailInterface(),
+		FileWriterInterface(),
+		StdWriterInterface(),
+		ExecInterface(),
+		SQLInterface(),
 	}
 
 	library := make(map[string]SourceSpec)
@@ -1,8 +1,10 @@
 package core
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -267,3 +269,417 @@ func TestPriorityQueue(t *testing.T) {
 	}
 
 }
+
+func TestFSM(t *testing.T) {
+	log.Println("testing fsm")
+	kv := NewKeyValue()
+	block := NewBlock(GetLibrary()["fsm"])
+	go DummyMonitor(block.Monitor)
+	go block.Serve()
+	err := block.SetSource(kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var table interface{}
+	json.Unmarshal([]byte(`{
+		"initial": "new",
+		"transitions": {
+			"new": {"login": "active"},
+			"active": {"logout": "new"}
+		}
+	}`), &table)
+	block.SetInput(2, &InputValue{table})
+
+	transition := make(chan Message)
+	invalid := make(chan Message)
+	block.Connect(0, transition)
+	block.Connect(1, invalid)
+
+	key, _ := block.GetInput(0)
+	event, _ := block.GetInput(1)
+
+	key.C <- "alice"
+	event.C <- "login"
+	m := (<-transition).(map[string]interface{})
+	if m["key"] != "alice" || m["from"] != "new" || m["to"] != "active" || m["event"] != "login" {
+		t.Error("fsm emitted unexpected transition", m)
+	}
+
+	key.C <- "alice"
+	event.C <- "login"
+	m = (<-invalid).(map[string]interface{})
+	if m["from"] != "active" || m["event"] != "login" {
+		t.Error("fsm emitted unexpected invalid transition", m)
+	}
+
+	// other keys are tracked separately
+	key.C <- "bob"
+	event.C <- "logout"
+	m = (<-invalid).(map[string]interface{})
+	if m["key"] != "bob" || m["from"] != "new" {
+		t.Error("fsm did not start new key in the initial state", m)
+	}
+
+	// a new table replaces the one the block has already parsed
+	json.Unmarshal([]byte(`{"initial": "new", "transitions": {"new": {"logout": "gone"}}}`), &table)
+	block.SetInput(2, &InputValue{table})
+	key.C <- "bob"
+	event.C <- "logout"
+	m = (<-transition).(map[string]interface{})
+	if m["to"] != "gone" {
+		t.Error("fsm did not use the new table", m)
+	}
+
+	if state := kv.(*KeyValue).Get().(map[string]interface{}); state["alice"] != "active" {
+		t.Error("fsm did not store state in the key value source")
+	}
+
+	block.Stop()
+}
+
+func TestListRangeAndCap(t *testing.T) {
+	log.Println("testing list ranges and capped lists")
+	l := NewList().(*List)
+	l.SetSourceParameter("maxLength", "-1")
+	l.SetSourceParameter("maxLength", "4")
+	if l.Describe()[0]["value"] != "4" {
+		t.Error("list kept unexpected maxLength", l.Describe())
+	}
+
+	send := linkBlocks(t, l, make(chan Message),
+		"listAppend", "listShift", "listLen", "listInsert", "listRange", "listRemove", "listTrim", "listDump")
+	expect := func(expected ...interface{}) {
+		if r := send("listDump", true); !reflect.DeepEqual(r, expected) {
+			t.Error("unexpected list", r, "expected", expected)
+		}
+	}
+
+	// the oldest elements are evicted once the list is full
+	for _, e := range []float64{1, 2, 3, 4, 5, 6} {
+		send("listAppend", e)
+	}
+	expect(3.0, 4.0, 5.0, 6.0)
+	if r := send("listLen", true); r != 4.0 {
+		t.Error("unexpected length", r)
+	}
+
+	for _, r := range []struct {
+		start, end float64
+		expected   []interface{}
+	}{
+		{0, -1, []interface{}{3.0, 4.0, 5.0, 6.0}},
+		{-2, -1, []interface{}{5.0, 6.0}},
+		{1, 2, []interface{}{4.0, 5.0}},
+		{2, 100, []interface{}{5.0, 6.0}},
+		{-100, 0, []interface{}{3.0}},
+		{3, 1, []interface{}{}},
+	} {
+		if v := send("listRange", r.start, r.end); !reflect.DeepEqual(v, r.expected) {
+			t.Error("unexpected range", r.start, r.end, v)
+		}
+	}
+
+	if r := send("listInsert", 1.0, "x"); r != true {
+		t.Error("listInsert failed", r)
+	}
+	// inserting into a full list also evicts from the head
+	expect("x", 4.0, 5.0, 6.0)
+	if _, ok := send("listInsert", 5.0, "y").(*stcoreError); !ok {
+		t.Error("expected error inserting out of range")
+	}
+	send("listInsert", 3.0, "x")
+	expect(4.0, 5.0, "x", 6.0)
+	// a new head would be evicted straight away, so it isn't added
+	if r := send("listInsert", 0.0, "y"); r != false {
+		t.Error("expected listInsert to report the element wasn't added", r)
+	}
+	if r := send("listShift", "y"); r != false {
+		t.Error("expected listShift to report the element wasn't added", r)
+	}
+	expect(4.0, 5.0, "x", 6.0)
+
+	if r := send("listRemove", "x", false); r != 1.0 {
+		t.Error("expected one element removed", r)
+	}
+	send("listAppend", "x")
+	send("listInsert", 1.0, "x")
+	expect("x", 5.0, 6.0, "x")
+	if r := send("listRemove", "x", false); r != 2.0 {
+		t.Error("expected two elements removed", r)
+	}
+	expect(5.0, 6.0)
+	if r := send("listRemove", 0.0, true); r != 5.0 {
+		t.Error("expected removed element", r)
+	}
+	if _, ok := send("listRemove", 1.0, true).(*stcoreError); !ok {
+		t.Error("expected error removing out of range")
+	}
+
+	for _, e := range []float64{7, 8, 9} {
+		send("listAppend", e)
+	}
+	if r := send("listTrim", 1.0, -2.0); r != true {
+		t.Error("listTrim failed", r)
+	}
+	expect(7.0, 8.0)
+
+	// lowering maxLength evicts straight away
+	send("listAppend", 10.0)
+	l.SetSourceParameter("maxLength", "1")
+	expect(10.0)
+}
+
+func TestPriorityQueueOrder(t *testing.T) {
+	log.Println("testing priority queue order, pqPushMany and pqPopUntil")
+	pq := NewPriorityQueue().(*PriorityQueue)
+
+	send := linkBlocks(t, pq, make(chan Message), "pqPush", "pqPushMany", "pqPopUntil")
+	entry := func(v interface{}, p float64) interface{} {
+		return map[string]interface{}{"value": v, "priority": p}
+	}
+
+	// fractional priorities are kept, and equal priorities pop in the
+	// order they were pushed
+	send("pqPush", "b", 1.5)
+	send("pqPush", "a", 1.25)
+	if r := send("pqPushMany", []interface{}{entry("c", 2.0), entry("d", 1.5)}); r != true {
+		t.Error("pqPushMany failed", r)
+	}
+	if _, ok := send("pqPushMany", []interface{}{entry("e", 0.0), "f"}).(*stcoreError); !ok {
+		t.Error("expected error pushing a malformed entry")
+	}
+	expected := []interface{}{entry("a", 1.25), entry("b", 1.5), entry("d", 1.5), entry("c", 2.0)}
+	if v := pq.Get(); !reflect.DeepEqual(v, expected) {
+		t.Error("unexpected queue", v)
+	}
+
+	if r := send("pqPopUntil", 1.5); !reflect.DeepEqual(r, expected[:3]) {
+		t.Error("unexpected messages popped", r)
+	}
+	if r := send("pqPopUntil", 1.5); !reflect.DeepEqual(r, []interface{}{}) {
+		t.Error("expected nothing to pop", r)
+	}
+
+	// the queue can be seeded, and popped highest first
+	if err := pq.Set([]interface{}{entry("x", 1), entry("y", 3), entry("z", 2)}); err != nil {
+		t.Fatal(err)
+	}
+	if pq.Set([]interface{}{entry("x", 1), map[string]interface{}{"value": "y"}}) == nil {
+		t.Error("expected error setting an entry without a priority")
+	}
+	pq.SetSourceParameter("order", "sideways")
+	pq.SetSourceParameter("order", "max")
+	if pq.Describe()[0]["value"] != "max" {
+		t.Error("unexpected order", pq.Describe())
+	}
+	if v := pq.Get(); !reflect.DeepEqual(v, []interface{}{entry("y", 3.0), entry("z", 2.0), entry("x", 1.0)}) {
+		t.Error("unexpected max queue", v)
+	}
+	if r := send("pqPopUntil", 2.0); !reflect.DeepEqual(r, []interface{}{entry("y", 3.0), entry("z", 2.0)}) {
+		t.Error("unexpected messages popped from max queue", r)
+	}
+}
+
+func TestSet(t *testing.T) {
+	log.Println("testing set")
+	today := NewMemberSet().(*MemberSet)
+	yesterday := NewMemberSet().(*MemberSet)
+	if today.GetType() != SET {
+		t.Fatal("set returns inaccurate type")
+	}
+
+	out := make(chan Message)
+	send := linkBlocks(t, today, out, "setAdd", "setRemove", "setHas", "setSize", "setMembers")
+
+	for _, m := range []struct {
+		member Message
+		isNew  bool
+	}{
+		{"ada", true},
+		{"grace", true},
+		{"ada", false},
+		{map[string]interface{}{"id": 1.0, "name": "linus"}, true},
+		{map[string]interface{}{"name": "linus", "id": 1.0}, false},
+	} {
+		if r := send("setAdd", m.member); r != m.isNew {
+			t.Error("setAdd emitted", r, "for", m.member)
+		}
+	}
+	if r := send("setHas", "grace"); r != true {
+		t.Error("expected set to have member", r)
+	}
+	if r := send("setRemove", "grace"); r != true {
+		t.Error("expected member to be removed", r)
+	}
+	if r := send("setRemove", "grace"); r != false {
+		t.Error("expected missing member not to be removed", r)
+	}
+	if r := send("setHas", "grace"); r != false {
+		t.Error("expected set not to have removed member", r)
+	}
+	if r := send("setSize", true); r != 2.0 {
+		t.Error("unexpected size", r)
+	}
+	linus := map[string]interface{}{"id": 1.0, "name": "linus"}
+	if r := send("setMembers", true); !reflect.DeepEqual(r, []interface{}{"ada", linus}) {
+		t.Error("unexpected members", r)
+	}
+
+	// combine with the members of a second set
+	if err := yesterday.Set([]interface{}{"ada", "ken", "ken"}); err != nil {
+		t.Fatal(err)
+	}
+	if yesterday.Set("ada") == nil {
+		t.Error("expected error setting a set to something other than an array")
+	}
+	if v := yesterday.Get(); !reflect.DeepEqual(v, []interface{}{"ada", "ken"}) {
+		t.Error("unexpected value of set", v)
+	}
+	for name, expected := range map[string][]interface{}{
+		"setUnion":               {"ada", "ken", linus},
+		"setIntersection":        {"ada"},
+		"setDifference":          {linus},
+		"setSymmetricDifference": {"ken", linus},
+	} {
+		b := linkBlock(t, today, out, name)
+		if err := b.SetSourceAt(1, yesterday); err != nil {
+			t.Fatal(err)
+		}
+		in, _ := b.GetInput(0)
+		in.C <- true
+		if r := <-out; !reflect.DeepEqual(r, expected) {
+			t.Error(name, "emitted", r, "expected", expected)
+		}
+	}
+
+	// the second source has to be a set, and a set can be combined with itself
+	b := linkBlock(t, today, out, "setUnion")
+	if b.SetSourceAt(1, NewList()) == nil || b.SetSourceAt(2, yesterday) == nil {
+		t.Error("expected error linking setUnion to something other than a second set")
+	}
+	if err := b.SetSourceAt(1, today); err != nil {
+		t.Fatal(err)
+	}
+	in, _ := b.GetInput(0)
+	in.C <- true
+	select {
+	case r := <-out:
+		if !reflect.DeepEqual(r, []interface{}{"ada", linus}) {
+			t.Error("unexpected union of a set with itself", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("setUnion of a set with itself never emitted")
+	}
+}
+
+func TestSetOperationLocks(t *testing.T) {
+	log.Println("testing set operations linked to the same sets in a different order")
+	a := NewMemberSet().(*MemberSet)
+	b := NewMemberSet().(*MemberSet)
+	a.Set([]interface{}{"x"})
+	b.Set([]interface{}{"y"})
+
+	done := make(chan struct{})
+	for _, sets := range [][]*MemberSet{{a, b}, {b, a}} {
+		out := make(chan Message)
+		op := linkBlock(t, sets[0], out, "setIntersection")
+		if err := op.SetSourceAt(1, sets[1]); err != nil {
+			t.Fatal(err)
+		}
+		in, _ := op.GetInput(0)
+		go func() {
+			for j := 0; j < 1000; j++ {
+				in.C <- true
+				<-out
+			}
+			done <- struct{}{}
+		}()
+	}
+	for j := 0; j < 2; j++ {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("set operations deadlocked")
+		}
+	}
+}
+
+func TestBloom(t *testing.T) {
+	log.Println("testing bloom")
+	b := NewBloom().(*Bloom)
+	if b.GetType() != BLOOM {
+		t.Fatal("bloom returns inaccurate type")
+	}
+	b.SetSourceParameter("expectedItems", "1000")
+	b.SetSourceParameter("falsePositiveRate", "0.01")
+	b.SetSourceParameter("falsePositiveRate", "1.5")
+	// this would need more than bloomMaxBits
+	b.SetSourceParameter("expectedItems", "200000000")
+	if b.Describe()[0]["value"] != "1000" || b.Describe()[1]["value"] != "0.01" {
+		t.Error("unexpected parameters", b.Describe())
+	}
+
+	send := linkBlocks(t, b, make(chan Message), "bloomAdd", "bloomTest")
+
+	if r := send("bloomAdd", map[string]interface{}{"id": 1.0, "name": "ada"}); r != true {
+		t.Error("expected new member", r)
+	}
+	if r := send("bloomAdd", map[string]interface{}{"name": "ada", "id": 1.0}); r != false {
+		t.Error("expected member to have been added", r)
+	}
+	if r := send("bloomTest", map[string]interface{}{"id": 1.0, "name": "ada"}); r != true {
+		t.Error("expected member to be present", r)
+	}
+	if r := send("bloomTest", "grace"); r != false {
+		t.Error("expected member not to be present", r)
+	}
+
+	// the false positive rate is close to the one the filter was sized for
+	for j := 0; j < 1000; j++ {
+		send("bloomAdd", fmt.Sprintf("member %d", j))
+	}
+	positives := 0
+	for j := 0; j < 10000; j++ {
+		if send("bloomTest", fmt.Sprintf("stranger %d", j)) == true {
+			positives++
+		}
+	}
+	if positives > 300 {
+		t.Error("too many false positives", positives)
+	}
+
+	// the filter can be exported as JSON and restored into another source
+	exported, err := json.Marshal(b.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	json.Unmarshal(exported, &v)
+	restored := NewBloom().(*Bloom)
+	if err := restored.Set(v); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.Get(), b.Get()) {
+		t.Error("restored filter differs", restored.Describe())
+	}
+	for j := 0; j < 1000; j++ {
+		if present, _ := restored.test(fmt.Sprintf("member %d", j)); !present {
+			t.Fatal("restored filter lost member", j)
+		}
+	}
+	v.(map[string]interface{})["expectedItems"] = 2000.0
+	if restored.Set(v) == nil || restored.Set("bits") == nil {
+		t.Error("expected error setting bloom to an invalid value")
+	}
+	v.(map[string]interface{})["expectedItems"] = 200000000.0
+	if restored.Set(v) == nil {
+		t.Error("expected error setting bloom bigger than bloomMaxBits")
+	}
+
+	// resizing the filter empties it
+	b.SetSourceParameter("expectedItems", "2000")
+	if r := send("bloomTest", "member 0"); r != false {
+		t.Error("expected resized filter to be empty", r)
+	}
+}
@@ -0,0 +1,102 @@
+package core
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSQL(t *testing.T) {
+	log.Println("testing sql")
+
+	dir, err := ioutil.TempDir("", "sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := NewSQL().(*sqlSource)
+	db.SetSourceParameter("driver", "sqlite3")
+	db.SetSourceParameter("dsn", filepath.Join(dir, "test.db"))
+	db.SetSourceParameter("maxOpenConns", "1")
+	db.SetSourceParameter("connMaxLifetime", "forever")
+	if db.Describe()[4]["value"] != "0s" {
+		t.Error("sql source accepted an invalid connMaxLifetime", db.Describe())
+	}
+	go db.Serve()
+	defer db.Stop()
+
+	library := GetLibrary()
+	exec := NewBlock(library["sqlExec"])
+	query := NewBlock(library["sqlQuery"])
+	executed := make(chan Message)
+	queried := make(chan Message)
+	for b, out := range map[*Block]chan Message{exec: executed, query: queried} {
+		go b.Serve()
+		go DummyMonitor(b.Monitor)
+		if err := b.SetSource(db); err != nil {
+			t.Fatal(err)
+		}
+		b.Connect(0, out)
+	}
+
+	execQuery, _ := exec.GetInput(0)
+	execArgs, _ := exec.GetInput(1)
+	run := func(q string, args ...interface{}) Message {
+		execQuery.C <- q
+		execArgs.C <- args
+		return <-executed
+	}
+
+	if _, ok := run("CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, score REAL)").(*stcoreError); ok {
+		t.Fatal("could not create table")
+	}
+	for _, u := range [][]interface{}{{"ada", 3.5}, {"grace", 4.0}, {"linus", 1.0}} {
+		if r := run("INSERT INTO users (name, score) VALUES (?, ?)", u...); r != 1.0 {
+			t.Fatal("expected one row affected by insert", r)
+		}
+	}
+	if r := run("UPDATE users SET score = score + 1 WHERE score > ?", 2.0); r != 2.0 {
+		t.Error("expected two rows affected by update", r)
+	}
+	if _, ok := run("INSERT INTO nowhere VALUES (1)").(*stcoreError); !ok {
+		t.Error("expected error inserting into a missing table")
+	}
+
+	q := InputValue{"SELECT name, score FROM users WHERE score > ? ORDER BY id"}
+	query.SetInput(0, &q)
+	queryArgs, _ := query.GetInput(1)
+	perRow, _ := query.GetInput(2)
+
+	perRow.C <- false
+	queryArgs.C <- []interface{}{2.0}
+	rows := <-queried
+	expected := []interface{}{
+		map[string]interface{}{"name": "ada", "score": 4.5},
+		map[string]interface{}{"name": "grace", "score": 5.0},
+	}
+	if !reflect.DeepEqual(rows, expected) {
+		t.Error("sqlQuery emitted unexpected rows", rows)
+	}
+
+	perRow.C <- true
+	queryArgs.C <- []interface{}{0.0}
+	for _, name := range []string{"ada", "grace", "linus"} {
+		row := (<-queried).(map[string]interface{})
+		if row["name"] != name {
+			t.Error("sqlQuery emitted unexpected row", row, "expected", name)
+		}
+	}
+
+	// no rows means no messages
+	queryArgs.C <- []interface{}{100.0}
+	queryArgs.C <- []interface{}{4.6}
+	if row := (<-queried).(map[string]interface{}); row["name"] != "grace" {
+		t.Error("sqlQuery emitted unexpected row", row)
+	}
+}
@@ -0,0 +1,266 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"sync"
+)
+
+func BloomStore() SourceSpec {
+	return SourceSpec{
+		Name: "bloom",
+		Type: BLOOM,
+		New:  NewBloom,
+	}
+}
+
+// Bloom is a bloom filter. It holds a fixed number of bits however many
+// members are added, at the cost of sometimes reporting that a member was
+// added when it wasn't. Members are compared by their JSON, like a set.
+type Bloom struct {
+	expectedItems     int
+	falsePositiveRate float64
+	hashes            int
+	bits              []byte
+	items             int
+	sync.Mutex
+}
+
+func NewBloom() Source {
+	b := &Bloom{
+		expectedItems:     100000,
+		falsePositiveRate: 0.01,
+	}
+	b.reset()
+	return b
+}
+
+func (b *Bloom) GetType() SourceType {
+	return BLOOM
+}
+
+// the most bits a filter can hold, 128MiB, enough for about 100 million
+// items with a false positive rate of 0.01
+const bloomMaxBits = 1 << 30
+
+// bloomSize returns the number of bits and hashes a filter needs to hold n
+// items with a false positive rate of p, or an error if that is more than
+// bloomMaxBits
+func bloomSize(n int, p float64) (int, int, error) {
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	if m > bloomMaxBits {
+		return 0, 0, errors.New("bloom filter would need more than " + strconv.Itoa(bloomMaxBits) + " bits")
+	}
+	k := int(math.Round(m / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return int(m), k, nil
+}
+
+// reset empties the filter, sizing it for its parameters, which must already
+// have been checked by bloomSize
+func (b *Bloom) reset() {
+	m, k, _ := bloomSize(b.expectedItems, b.falsePositiveRate)
+	b.bits = make([]byte, (m+7)/8)
+	b.hashes = k
+	b.items = 0
+}
+
+// locations returns the bits that represent a member
+func (b *Bloom) locations(member interface{}) ([]uint64, error) {
+	key, err := setKey(member)
+	if err != nil {
+		return nil, err
+	}
+	h := fnv.New128a()
+	h.Write([]byte(key))
+	sum := h.Sum(nil)
+	h1 := binary.BigEndian.Uint64(sum[:8])
+	h2 := binary.BigEndian.Uint64(sum[8:])
+	m := uint64(len(b.bits) * 8)
+	locations := make([]uint64, b.hashes)
+	for j := range locations {
+		locations[j] = (h1 + uint64(j)*h2) % m
+	}
+	return locations, nil
+}
+
+// add sets the bits of a member, and returns true if any weren't already set
+func (b *Bloom) add(member interface{}) (bool, error) {
+	locations, err := b.locations(member)
+	if err != nil {
+		return false, err
+	}
+	added := false
+	for _, l := range locations {
+		if b.bits[l/8]&(1<<(l%8)) == 0 {
+			b.bits[l/8] |= 1 << (l % 8)
+			added = true
+		}
+	}
+	if added {
+		b.items++
+	}
+	return added, nil
+}
+
+// test returns true if all the bits of a member are set
+func (b *Bloom) test(member interface{}) (bool, error) {
+	locations, err := b.locations(member)
+	if err != nil {
+		return false, err
+	}
+	for _, l := range locations {
+		if b.bits[l/8]&(1<<(l%8)) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Get returns the parameters of the filter, the number of members added, and
+// its bits encoded as base64
+func (b *Bloom) Get() interface{} {
+	return map[string]interface{}{
+		"expectedItems":     float64(b.expectedItems),
+		"falsePositiveRate": b.falsePositiveRate,
+		"items":             float64(b.items),
+		"bits":              base64.StdEncoding.EncodeToString(b.bits),
+	}
+}
+
+// Set replaces the filter with one returned by Get
+func (b *Bloom) Set(v interface{}) error {
+	filter, ok := v.(map[string]interface{})
+	if !ok {
+		return errors.New("not an object")
+	}
+	n, ok := filter["expectedItems"].(float64)
+	if !ok || n < 1 || n != math.Trunc(n) {
+		return errors.New("expectedItems must be a positive integer")
+	}
+	p, ok := filter["falsePositiveRate"].(float64)
+	if !ok || p <= 0 || p >= 1 {
+		return errors.New("falsePositiveRate must be between 0 and 1")
+	}
+	items, ok := filter["items"].(float64)
+	if !ok || items < 0 {
+		return errors.New("items must be a number")
+	}
+	m, k, err := bloomSize(int(n), p)
+	if err != nil {
+		return err
+	}
+	encoded, ok := filter["bits"].(string)
+	if !ok {
+		return errors.New("bits must be a base64 string")
+	}
+	bits, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	if len(bits) != (m+7)/8 {
+		return errors.New("bits do not match expectedItems and falsePositiveRate")
+	}
+	b.expectedItems = int(n)
+	b.falsePositiveRate = p
+	b.hashes = k
+	b.bits = bits
+	b.items = int(items)
+	return nil
+}
+
+// SetSourceParameter sets expectedItems or falsePositiveRate. Resizing the
+// filter empties it. Values that would make the filter bigger than
+// bloomMaxBits are ignored.
+func (b *Bloom) SetSourceParameter(name, value string) {
+	b.Lock()
+	defer b.Unlock()
+	switch name {
+	case "expectedItems":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n == b.expectedItems {
+			return
+		}
+		if _, _, err := bloomSize(n, b.falsePositiveRate); err != nil {
+			return
+		}
+		b.expectedItems = n
+		b.reset()
+	case "falsePositiveRate":
+		p, err := strconv.ParseFloat(value, 64)
+		if err != nil || p <= 0 || p >= 1 || p == b.falsePositiveRate {
+			return
+		}
+		if _, _, err := bloomSize(b.expectedItems, p); err != nil {
+			return
+		}
+		b.falsePositiveRate = p
+		b.reset()
+	}
+}
+
+func (b *Bloom) Describe() []map[string]string {
+	b.Lock()
+	defer b.Unlock()
+	return []map[string]string{
+		{"name": "expectedItems", "value": strconv.Itoa(b.expectedItems)},
+		{"name": "falsePositiveRate", "value": strconv.FormatFloat(b.falsePositiveRate, 'g', -1, 64)},
+	}
+}
+
+// bloomAdd adds a member to the filter, and emits true if it is new. A new
+// member is sometimes mistaken for one already added, but an added member is
+// never new.
+func bloomAdd() Spec {
+	return Spec{
+		Name: "bloomAdd",
+		Inputs: []Pin{
+			Pin{"member", ANY},
+		},
+		Outputs: []Pin{
+			Pin{"new", BOOLEAN},
+		},
+		Source: BLOOM,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			b := s.(*Bloom)
+			added, err := b.add(in[0])
+			if err != nil {
+				out[0] = NewError("bloomAdd could not marshal member")
+				return nil
+			}
+			out[0] = added
+			return nil
+		},
+	}
+}
+
+// bloomTest emits false if a member was never added to the filter, and true
+// if it probably was
+func bloomTest() Spec {
+	return Spec{
+		Name: "bloomTest",
+		Inputs: []Pin{
+			Pin{"member", ANY},
+		},
+		Outputs: []Pin{
+			Pin{"present", BOOLEAN},
+		},
+		Source: BLOOM,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			b := s.(*Bloom)
+			present, err := b.test(in[0])
+			if err != nil {
+				out[0] = NewError("bloomTest could not marshal member")
+				return nil
+			}
+			out[0] = present
+			return nil
+		},
+	}
+}
@@ -2,7 +2,12 @@ package core
 
 import (
 	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 func KeyValueStore() SourceSpec {
@@ -15,34 +20,345 @@ func KeyValueStore() SourceSpec {
 
 func NewKeyValue() Source {
 	return &KeyValue{
-		kv:   make(map[string]interface{}),
-		quit: make(chan bool),
+		kv:            make(map[string]interface{}),
+		expires:       make(map[string]time.Time),
+		expiredSignal: make(chan struct{}, 1),
+		quit:          make(chan bool),
 	}
 }
 
-func (k KeyValue) GetType() SourceType {
+func (k *KeyValue) GetType() SourceType {
 	return KEY_VALUE
 }
 
+var (
+	// how often expired entries are evicted from a key value store
+	kvEvictInterval = time.Second
+	// how many evicted entries are kept for kvExpired blocks
+	kvExpiredMax = 1024
+)
+
+// KeyValue is a map held in memory. If disk is set, as it is for a
+// persistent_key_value source, every change is also written to disk.
+//
+// An entry can be given a TTL, after which it is evicted when it is next used,
+// when the store is read, or by Serve, whichever comes first. Evicted entries are queued
+// for kvExpired blocks, dropping the oldest once kvExpiredMax are waiting.
+// A persistent store keeps when each entry expires on disk too.
 type KeyValue struct {
-	kv   map[string]interface{}
-	quit chan bool
+	kv            map[string]interface{}
+	expires       map[string]time.Time
+	ttl           time.Duration
+	expired       []kvEntry
+	expiredSignal chan struct{}
+	disk          *kvDisk
+	quit          chan bool
 	sync.Mutex
 }
 
+type kvEntry struct {
+	key   string
+	value interface{}
+}
+
+// Get returns the store, evicting any entries that have expired first
 func (k *KeyValue) Get() interface{} {
+	k.evict()
 	return k.kv
 }
 
+// Set replaces the store, giving every entry the default TTL
 func (k *KeyValue) Set(v interface{}) error {
 	kv, ok := v.(map[string]interface{})
 	if !ok {
 		return errors.New("not a map")
 	}
+	expires := make(map[string]time.Time)
+	if k.ttl > 0 {
+		t := time.Now().Add(k.ttl)
+		for key := range kv {
+			expires[key] = t
+		}
+	}
+	return k.replace(kv, expires)
+}
+
+// replace replaces the store and when its entries expire
+func (k *KeyValue) replace(kv map[string]interface{}, expires map[string]time.Time) error {
+	if k.disk != nil {
+		if err := k.disk.replace(kv, expires); err != nil {
+			return err
+		}
+	}
 	k.kv = kv
+	k.expires = expires
+	return nil
+}
+
+// TTLs returns how long each entry that has a TTL has left. Entries that have
+// expired are evicted first, and any that couldn't be are left out.
+func (k *KeyValue) TTLs() map[string]time.Duration {
+	k.evict()
+	now := time.Now()
+	ttls := make(map[string]time.Duration)
+	for key, expires := range k.expires {
+		if ttl := expires.Sub(now); ttl > 0 {
+			ttls[key] = ttl
+		}
+	}
+	return ttls
+}
+
+// set sets an entry with the default TTL
+func (k *KeyValue) set(key string, value interface{}) error {
+	return k.setTTL(key, value, k.ttl)
+}
+
+// setTTL sets an entry that expires after ttl, or never if ttl is 0
+func (k *KeyValue) setTTL(key string, value interface{}, ttl time.Duration) error {
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+	if k.disk != nil {
+		if err := k.disk.put(key, value, expires); err != nil {
+			return err
+		}
+	}
+	k.kv[key] = value
+	if ttl > 0 {
+		k.expires[key] = expires
+	} else {
+		delete(k.expires, key)
+	}
 	return nil
 }
 
+// update changes the value of an entry, keeping its TTL. A new entry is given
+// the default TTL.
+func (k *KeyValue) update(key string, value interface{}) error {
+	if _, ok := k.kv[key]; !ok {
+		return k.set(key, value)
+	}
+	if k.disk != nil {
+		if err := k.disk.put(key, value, k.expires[key]); err != nil {
+			return err
+		}
+	}
+	k.kv[key] = value
+	return nil
+}
+
+func (k *KeyValue) delete(key string) error {
+	if k.disk != nil {
+		if err := k.disk.delete(key); err != nil {
+			return err
+		}
+	}
+	delete(k.kv, key)
+	delete(k.expires, key)
+	return nil
+}
+
+// GetKey returns the value of key, evicting it first if it has expired
+func (k *KeyValue) GetKey(key string, i chan Interrupt) (interface{}, bool, Interrupt, error) {
+	k.expire(key, time.Now())
+	value, ok := k.kv[key]
+	return value, ok, nil, nil
+}
+
+// SetKey sets key to value with the default TTL, and reports whether the key
+// is new
+func (k *KeyValue) SetKey(key string, value interface{}, i chan Interrupt) (bool, Interrupt, error) {
+	k.expire(key, time.Now())
+	_, exists := k.kv[key]
+	if err := k.set(key, value); err != nil {
+		return false, nil, err
+	}
+	return !exists, nil, nil
+}
+
+// DeleteKey deletes key, and reports whether it was there to delete
+func (k *KeyValue) DeleteKey(key string, i chan Interrupt) (bool, Interrupt, error) {
+	k.expire(key, time.Now())
+	if _, ok := k.kv[key]; !ok {
+		return false, nil, nil
+	}
+	if err := k.delete(key); err != nil {
+		return false, nil, err
+	}
+	return true, nil, nil
+}
+
+func (k *KeyValue) clear() error {
+	return k.Set(make(map[string]interface{}))
+}
+
+// expire evicts key if it has expired, and reports whether it did
+func (k *KeyValue) expire(key string, now time.Time) bool {
+	expires, ok := k.expires[key]
+	if !ok || now.Before(expires) {
+		return false
+	}
+	value := k.kv[key]
+	if k.delete(key) != nil {
+		return false
+	}
+	if len(k.expired) == kvExpiredMax {
+		k.expired = k.expired[1:]
+	}
+	k.expired = append(k.expired, kvEntry{key, value})
+	select {
+	case k.expiredSignal <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// evict evicts every entry that has expired
+func (k *KeyValue) evict() {
+	now := time.Now()
+	for key := range k.expires {
+		k.expire(key, now)
+	}
+}
+
+// receiveExpired waits for an evicted entry. It must be called without the
+// store locked.
+func (k *KeyValue) receiveExpired(i chan Interrupt) (kvEntry, Interrupt) {
+	for {
+		k.Lock()
+		if len(k.expired) > 0 {
+			e := k.expired[0]
+			k.expired = k.expired[1:]
+			if len(k.expired) > 0 {
+				// wake up any other kvExpired block
+				select {
+				case k.expiredSignal <- struct{}{}:
+				default:
+				}
+			}
+			k.Unlock()
+			return e, nil
+		}
+		k.Unlock()
+
+		select {
+		case <-k.expiredSignal:
+		case f := <-i:
+			return kvEntry{}, f
+		}
+	}
+}
+
+func (k *KeyValue) SetSourceParameter(name, value string) {
+	k.Lock()
+	defer k.Unlock()
+	if name == "defaultTTL" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return
+		}
+		k.ttl = d
+		return
+	}
+	if k.disk != nil {
+		k.setDiskParameter(name, value)
+	}
+}
+
+func (k *KeyValue) Describe() []map[string]string {
+	k.Lock()
+	defer k.Unlock()
+	params := []map[string]string{}
+	if k.disk != nil {
+		params = append(params, k.disk.describe()...)
+	}
+	return append(params, map[string]string{"name": "defaultTTL", "value": k.ttl.String()})
+}
+
+// State reports the directory of a persistent store, and why it couldn't be
+// opened if it couldn't. An in memory store has no state.
+func (k *KeyValue) State() map[string]interface{} {
+	k.Lock()
+	defer k.Unlock()
+	if k.disk == nil {
+		return map[string]interface{}{}
+	}
+	return k.disk.state()
+}
+
+// StateChanges returns nil for an in memory store, as its state never changes
+func (k *KeyValue) StateChanges() chan struct{} {
+	if k.disk == nil {
+		return nil
+	}
+	return k.disk.changes
+}
+
+// Serve evicts expired entries every kvEvictInterval and, if the store is
+// persistent, takes a snapshot every snapshotInterval
+func (k *KeyValue) Serve() {
+	evict := time.NewTicker(kvEvictInterval)
+	defer evict.Stop()
+
+	var reset chan struct{}
+	if k.disk != nil {
+		reset = k.disk.reset
+	}
+	var snapshot *time.Timer
+	resetSnapshot := func() {
+		if snapshot != nil {
+			snapshot.Stop()
+			snapshot = nil
+		}
+		k.Lock()
+		if k.disk != nil && k.disk.interval > 0 {
+			snapshot = time.NewTimer(k.disk.interval)
+		}
+		k.Unlock()
+	}
+	resetSnapshot()
+	defer func() {
+		if snapshot != nil {
+			snapshot.Stop()
+		}
+	}()
+
+	for {
+		var snapshotC <-chan time.Time
+		if snapshot != nil {
+			snapshotC = snapshot.C
+		}
+
+		select {
+		case <-evict.C:
+			k.Lock()
+			k.evict()
+			k.Unlock()
+		case <-snapshotC:
+			k.Lock()
+			k.disk.snapshot()
+			k.Unlock()
+			resetSnapshot()
+		case <-reset:
+			resetSnapshot()
+		case <-k.quit:
+			return
+		}
+	}
+}
+
+func (k *KeyValue) Stop() {
+	close(k.quit)
+	if k.disk == nil {
+		return
+	}
+	k.Lock()
+	k.disk.close()
+	k.Unlock()
+}
+
 // retrieves a value from the key value store
 func kvGet() Spec {
 	return Spec{
@@ -53,20 +369,28 @@ func kvGet() Spec {
 		Outputs: []Pin{
 			Pin{"value", ANY},
 		},
-		Source: KEY_VALUE,
+		Source: ANY_KEY_VALUE,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
-			kv := s.(*KeyValue)
+			kv := s.(KeyValueSource)
 			key, ok := in[0].(string)
 			if !ok {
 				out[0] = NewError("Key is not type string")
 				return nil
 			}
 
-			if value, ok := kv.kv[key]; !ok {
+			value, ok, f, err := kv.GetKey(key, i)
+			if f != nil {
+				return f
+			}
+			if err != nil {
+				out[0] = NewError("kvGet failed with: " + err.Error())
+				return nil
+			}
+			if !ok {
 				out[0] = NewError("Key not found")
-			} else {
-				out[0] = value
+				return nil
 			}
+			out[0] = value
 			return nil
 		},
 	}
@@ -84,6 +408,43 @@ func kvSet() Spec {
 		Outputs: []Pin{
 			Pin{"new", BOOLEAN},
 		},
+		Source: ANY_KEY_VALUE,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			kv := s.(KeyValueSource)
+			key, ok := in[0].(string)
+			if !ok {
+				out[0] = NewError("Key is not type string")
+				return nil
+			}
+
+			isNew, f, err := kv.SetKey(key, in[1], i)
+			if f != nil {
+				return f
+			}
+			if err != nil {
+				out[0] = NewError("kvSet failed with: " + err.Error())
+				return nil
+			}
+			out[0] = isNew
+			return nil
+		},
+	}
+}
+
+// kvSetTTL sets an entry in a key value store that expires after ttl, a
+// duration such as "30m". A ttl of "0s" means the entry never expires.
+// if the entry is new, emits true
+func kvSetTTL() Spec {
+	return Spec{
+		Name: "kvSetTTL",
+		Inputs: []Pin{
+			Pin{"key", STRING},
+			Pin{"value", ANY},
+			Pin{"ttl", STRING},
+		},
+		Outputs: []Pin{
+			Pin{"new", BOOLEAN},
+		},
 		Source: KEY_VALUE,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
 			kv := s.(*KeyValue)
@@ -92,14 +453,24 @@ func kvSet() Spec {
 				out[0] = NewError("Key is not type string")
 				return nil
 			}
-
-			if _, ok := kv.kv[key]; !ok {
-				out[0] = true
-			} else {
-				out[0] = false
+			ttlString, ok := in[2].(string)
+			if !ok {
+				out[0] = NewError("ttl is not type string")
+				return nil
+			}
+			ttl, err := time.ParseDuration(ttlString)
+			if err != nil || ttl < 0 {
+				out[0] = NewError("ttl is not a valid duration")
+				return nil
 			}
 
-			kv.kv[in[0].(string)] = in[1]
+			kv.expire(key, time.Now())
+			_, exists := kv.kv[key]
+			if err := kv.setTTL(key, in[1], ttl); err != nil {
+				out[0] = NewError("kvSetTTL failed with: " + err.Error())
+				return nil
+			}
+			out[0] = !exists
 			return nil
 		},
 	}
@@ -120,7 +491,10 @@ func kvClear() Spec {
 		Source: KEY_VALUE,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
 			kv := s.(*KeyValue)
-			kv.kv = make(map[string]interface{})
+			if err := kv.clear(); err != nil {
+				out[0] = NewError("kvClear failed with: " + err.Error())
+				return nil
+			}
 			out[0] = true
 			return nil
 		},
@@ -143,6 +517,7 @@ func kvDump() Spec {
 		Source: KEY_VALUE,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
 			kv := s.(*KeyValue)
+			kv.evict()
 			outMap := make(map[string]interface{})
 			for k, v := range kv.kv {
 				outMap[k] = v
@@ -163,6 +538,69 @@ func kvDelete() Spec {
 		Outputs: []Pin{
 			Pin{"deleted", BOOLEAN},
 		},
+		Source: ANY_KEY_VALUE,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			kv := s.(KeyValueSource)
+			key, ok := in[0].(string)
+			if !ok {
+				out[0] = NewError("Key is not type string")
+				return nil
+			}
+
+			deleted, f, err := kv.DeleteKey(key, i)
+			if f != nil {
+				return f
+			}
+			if err != nil {
+				out[0] = NewError("kvDelete failed with: " + err.Error())
+				return nil
+			}
+			out[0] = deleted
+			return nil
+		},
+	}
+}
+
+// kvExpired emits each entry evicted from a key value store once its TTL has
+// passed, as an object with key and value
+func kvExpired() Spec {
+	return Spec{
+		Name: "kvExpired",
+		Outputs: []Pin{
+			Pin{"expired", OBJECT},
+		},
+		Source: KEY_VALUE,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			kv := s.(*KeyValue)
+			// the block locks the store while the kernel runs, so let
+			// other blocks use it while waiting
+			kv.Unlock()
+			e, f := kv.receiveExpired(i)
+			kv.Lock()
+			if f != nil {
+				return f
+			}
+			out[0] = map[string]interface{}{
+				"key":   e.key,
+				"value": e.value,
+			}
+			return nil
+		},
+	}
+}
+
+// kvIncrement adds delta to the number stored against key, and emits the new
+// number. A missing key counts as 0.
+func kvIncrement() Spec {
+	return Spec{
+		Name: "kvIncrement",
+		Inputs: []Pin{
+			Pin{"key", STRING},
+			Pin{"delta", NUMBER},
+		},
+		Outputs: []Pin{
+			Pin{"value", NUMBER},
+		},
 		Source: KEY_VALUE,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
 			kv := s.(*KeyValue)
@@ -171,13 +609,222 @@ func kvDelete() Spec {
 				out[0] = NewError("Key is not type string")
 				return nil
 			}
+			delta, ok := in[1].(float64)
+			if !ok {
+				out[0] = NewError("delta is not type number")
+				return nil
+			}
 
-			if _, ok := kv.kv[key]; !ok {
+			kv.expire(key, time.Now())
+			var n float64
+			if value, ok := kv.kv[key]; ok {
+				n, ok = value.(float64)
+				if !ok {
+					out[0] = NewError("value is not type number")
+					return nil
+				}
+			}
+			n += delta
+			if err := kv.update(key, n); err != nil {
+				out[0] = NewError("kvIncrement failed with: " + err.Error())
+				return nil
+			}
+			out[0] = n
+			return nil
+		},
+	}
+}
+
+// kvCompareAndSet sets key to value only if it is currently equal to
+// expected, and emits whether it did. A missing key is equal to null.
+func kvCompareAndSet() Spec {
+	return Spec{
+		Name: "kvCompareAndSet",
+		Inputs: []Pin{
+			Pin{"key", STRING},
+			Pin{"expected", ANY},
+			Pin{"value", ANY},
+		},
+		Outputs: []Pin{
+			Pin{"swapped", BOOLEAN},
+		},
+		Source: KEY_VALUE,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			kv := s.(*KeyValue)
+			key, ok := in[0].(string)
+			if !ok {
+				out[0] = NewError("Key is not type string")
+				return nil
+			}
+
+			kv.expire(key, time.Now())
+			if !reflect.DeepEqual(kv.kv[key], in[1]) {
 				out[0] = false
+				return nil
+			}
+			if err := kv.set(key, in[2]); err != nil {
+				out[0] = NewError("kvCompareAndSet failed with: " + err.Error())
+				return nil
+			}
+			out[0] = true
+			return nil
+		},
+	}
+}
+
+// kvGetOrDefault emits the value stored against key, or default if there
+// isn't one
+func kvGetOrDefault() Spec {
+	return Spec{
+		Name: "kvGetOrDefault",
+		Inputs: []Pin{
+			Pin{"key", STRING},
+			Pin{"default", ANY},
+		},
+		Outputs: []Pin{
+			Pin{"value", ANY},
+		},
+		Source: KEY_VALUE,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			kv := s.(*KeyValue)
+			key, ok := in[0].(string)
+			if !ok {
+				out[0] = NewError("Key is not type string")
+				return nil
+			}
+
+			kv.expire(key, time.Now())
+			if value, ok := kv.kv[key]; ok {
+				out[0] = value
 			} else {
-				delete(kv.kv, key)
-				out[0] = true
+				out[0] = in[1]
+			}
+			return nil
+		},
+	}
+}
+
+// kvKeys emits the keys of a key value store in order
+func kvKeys() Spec {
+	return Spec{
+		Name: "kvKeys",
+		Inputs: []Pin{
+			Pin{"trigger", ANY},
+		},
+		Outputs: []Pin{
+			Pin{"keys", ARRAY},
+		},
+		Source: KEY_VALUE,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			kv := s.(*KeyValue)
+			kv.evict()
+			keys := make([]string, 0, len(kv.kv))
+			for k := range kv.kv {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			outKeys := make([]interface{}, len(keys))
+			for j, k := range keys {
+				outKeys[j] = k
+			}
+			out[0] = outKeys
+			return nil
+		},
+	}
+}
+
+// kvSize emits the number of entries in a key value store
+func kvSize() Spec {
+	return Spec{
+		Name: "kvSize",
+		Inputs: []Pin{
+			Pin{"trigger", ANY},
+		},
+		Outputs: []Pin{
+			Pin{"size", NUMBER},
+		},
+		Source: KEY_VALUE,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			kv := s.(*KeyValue)
+			kv.evict()
+			out[0] = float64(len(kv.kv))
+			return nil
+		},
+	}
+}
+
+// setPath returns v with the field at path set to value. Missing objects
+// along the path are created.
+func setPath(v interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	switch t := v.(type) {
+	case nil:
+		return setPath(map[string]interface{}{}, path, value)
+	case map[string]interface{}:
+		field, err := setPath(t[path[0]], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		t[path[0]] = field
+		return t, nil
+	case []interface{}:
+		index, err := strconv.Atoi(path[0])
+		if err != nil || index < 0 || index >= len(t) {
+			return nil, errors.New("array index " + path[0] + " is out of range")
+		}
+		element, err := setPath(t[index], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		t[index] = element
+		return t, nil
+	}
+	return nil, errors.New(path[0] + " is not in an object or array")
+}
+
+// kvUpdatePath sets the field at path in the value stored against key, and
+// emits the updated value. path is a list of fields separated by dots, such
+// as "user.visits" or "items.0.count", where numbers index arrays.
+func kvUpdatePath() Spec {
+	return Spec{
+		Name: "kvUpdatePath",
+		Inputs: []Pin{
+			Pin{"key", STRING},
+			Pin{"path", STRING},
+			Pin{"value", ANY},
+		},
+		Outputs: []Pin{
+			Pin{"value", ANY},
+		},
+		Source: KEY_VALUE,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			kv := s.(*KeyValue)
+			key, ok := in[0].(string)
+			if !ok {
+				out[0] = NewError("Key is not type string")
+				return nil
+			}
+			path, ok := in[1].(string)
+			if !ok || path == "" {
+				out[0] = NewError("path is not a non-empty string")
+				return nil
+			}
+
+			kv.expire(key, time.Now())
+			// the stored value may already have been emitted, so it is
+			// copied rather than changed under another block
+			value, err := setPath(Copy(kv.kv[key]), strings.Split(path, "."), in[2])
+			if err != nil {
+				out[0] = NewError("kvUpdatePath failed with: " + err.Error())
+				return nil
+			}
+			if err := kv.update(key, value); err != nil {
+				out[0] = NewError("kvUpdatePath failed with: " + err.Error())
+				return nil
 			}
+			out[0] = value
 			return nil
 		},
 	}
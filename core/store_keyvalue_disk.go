@@ -0,0 +1,399 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func PersistentKeyValueStore() SourceSpec {
+	return SourceSpec{
+		Name: "persistent_key_value",
+		Type: KEY_VALUE,
+		New:  NewPersistentKeyValue,
+	}
+}
+
+// NewPersistentKeyValue returns a key value store that is written through to
+// a bolt database in its directory, so that it survives a restart. It is a
+// KeyValue, so it works with all the key value blocks.
+func NewPersistentKeyValue() Source {
+	k := NewKeyValue().(*KeyValue)
+	k.disk = &kvDisk{
+		interval: time.Hour,
+		retain:   24,
+		changes:  make(chan struct{}, 1),
+		reset:    make(chan struct{}, 1),
+	}
+	return k
+}
+
+const (
+	kvFile         = "kv.db"
+	kvSnapshotDir  = "snapshots"
+	kvSnapshotTime = "20060102T150405.000000000"
+)
+
+var (
+	kvBucket = []byte("kv")
+	// kvExpiresBucket holds when each entry that has a TTL expires
+	kvExpiresBucket = []byte("expires")
+)
+
+// kvDisk keeps a persistent key value store in directory/kv.db, and its
+// snapshots in directory/snapshots. Until directory is set the store is only
+// kept in memory. If a directory can't be opened, the store stays where it
+// was and the error is reported in the source's state.
+type kvDisk struct {
+	directory string
+	interval  time.Duration
+	retain    int
+	db        *bolt.DB
+	err       string
+	changes   chan struct{}
+	reset     chan struct{}
+}
+
+// open opens the database in directory and returns what it holds
+func (d *kvDisk) open(directory string) (map[string]interface{}, map[string]time.Time, error) {
+	err := os.MkdirAll(filepath.Join(directory, kvSnapshotDir), 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := bolt.Open(filepath.Join(directory, kvFile), 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(kvBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(kvExpiresBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	kv, expires, err := kvRead(db)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	d.close()
+	d.directory = directory
+	d.db = db
+	return kv, expires, nil
+}
+
+func (d *kvDisk) close() {
+	if d.db == nil {
+		return
+	}
+	d.db.Close()
+	d.db = nil
+}
+
+// kvRead reads the whole store, and when its entries expire, from db. A
+// database written before TTLs were kept on disk has no expiries.
+func kvRead(db *bolt.DB) (map[string]interface{}, map[string]time.Time, error) {
+	kv := make(map[string]interface{})
+	expires := make(map[string]time.Time)
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(kvBucket)
+		if b == nil {
+			return errors.New("database has no key value bucket")
+		}
+		err := b.ForEach(func(k, v []byte) error {
+			var value interface{}
+			err := json.Unmarshal(v, &value)
+			kv[string(k)] = value
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		e := tx.Bucket(kvExpiresBucket)
+		if e == nil {
+			return nil
+		}
+		return e.ForEach(func(k, v []byte) error {
+			var t time.Time
+			err := t.UnmarshalText(v)
+			if _, ok := kv[string(k)]; ok {
+				expires[string(k)] = t
+			}
+			return err
+		})
+	})
+	return kv, expires, err
+}
+
+// putExpires records when key expires, or that it doesn't if expires is zero
+func putExpires(b *bolt.Bucket, key string, expires time.Time) error {
+	if expires.IsZero() {
+		return b.Delete([]byte(key))
+	}
+	t, err := expires.MarshalText()
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), t)
+}
+
+// put writes an entry and when it expires, or zero if it doesn't
+func (d *kvDisk) put(key string, value interface{}, expires time.Time) error {
+	if d.db == nil {
+		return nil
+	}
+	v, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(kvBucket).Put([]byte(key), v)
+		if err != nil {
+			return err
+		}
+		return putExpires(tx.Bucket(kvExpiresBucket), key, expires)
+	})
+}
+
+func (d *kvDisk) delete(key string) error {
+	if d.db == nil {
+		return nil
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(kvBucket).Delete([]byte(key))
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(kvExpiresBucket).Delete([]byte(key))
+	})
+}
+
+// replace replaces everything on disk with kv and its expiries in one
+// transaction
+func (d *kvDisk) replace(kv map[string]interface{}, expires map[string]time.Time) error {
+	if d.db == nil {
+		return nil
+	}
+	return d.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{kvBucket, kvExpiresBucket} {
+			err := tx.DeleteBucket(name)
+			if err != nil {
+				return err
+			}
+		}
+		b, err := tx.CreateBucket(kvBucket)
+		if err != nil {
+			return err
+		}
+		e, err := tx.CreateBucket(kvExpiresBucket)
+		if err != nil {
+			return err
+		}
+		for k, value := range kv {
+			v, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(k), v)
+			if err != nil {
+				return err
+			}
+			err = putExpires(e, k, expires[k])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *kvDisk) snapshotPath(t time.Time) string {
+	return filepath.Join(d.directory, kvSnapshotDir, t.UTC().Format(kvSnapshotTime)+".db")
+}
+
+// snapshot copies the database to a new snapshot, and removes the oldest
+// snapshots beyond the number retained
+func (d *kvDisk) snapshot() (time.Time, error) {
+	if d.db == nil {
+		return time.Time{}, errors.New("persistent_key_value has no directory")
+	}
+	t := time.Now().UTC()
+	path := d.snapshotPath(t)
+	err := d.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path+".tmp", 0644)
+	})
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return time.Time{}, err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	snapshots, err := d.snapshots()
+	if err != nil {
+		return t, err
+	}
+	for len(snapshots) > d.retain {
+		os.Remove(d.snapshotPath(snapshots[0]))
+		snapshots = snapshots[1:]
+	}
+	return t, nil
+}
+
+// snapshots lists the times of the snapshots on disk, oldest first
+func (d *kvDisk) snapshots() ([]time.Time, error) {
+	if d.db == nil {
+		return []time.Time{}, nil
+	}
+	paths, err := filepath.Glob(filepath.Join(d.directory, kvSnapshotDir, "*.db"))
+	if err != nil {
+		return nil, err
+	}
+	times := []time.Time{}
+	for _, p := range paths {
+		t, err := time.Parse(kvSnapshotTime, strings.TrimSuffix(filepath.Base(p), ".db"))
+		if err != nil {
+			continue
+		}
+		times = append(times, t)
+	}
+	sort.Slice(times, func(a, b int) bool { return times[a].Before(times[b]) })
+	return times, nil
+}
+
+// read returns the contents and expiries of the latest snapshot taken at or
+// before t, and the time it was taken
+func (d *kvDisk) read(t time.Time) (map[string]interface{}, map[string]time.Time, time.Time, error) {
+	snapshots, err := d.snapshots()
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	var at time.Time
+	for _, s := range snapshots {
+		if s.After(t) {
+			break
+		}
+		at = s
+	}
+	if at.IsZero() {
+		return nil, nil, time.Time{}, errors.New("no snapshot at or before " + t.Format(time.RFC3339Nano))
+	}
+
+	db, err := bolt.Open(d.snapshotPath(at), 0644, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	defer db.Close()
+	kv, expires, err := kvRead(db)
+	return kv, expires, at, err
+}
+
+func (k *KeyValue) setDiskParameter(name, value string) {
+	switch name {
+	case "directory":
+		if value == "" || value == k.disk.directory {
+			return
+		}
+		kv, expires, err := k.disk.open(value)
+		k.disk.setError(err)
+		if err != nil {
+			return
+		}
+		k.kv = kv
+		k.expires = expires
+	case "snapshotInterval":
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return
+		}
+		k.disk.interval = d
+		select {
+		case k.disk.reset <- struct{}{}:
+		default:
+		}
+	case "snapshotRetain":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return
+		}
+		k.disk.retain = n
+	}
+}
+
+// setError records the error from opening a directory, clearing it on nil
+func (d *kvDisk) setError(err error) {
+	d.err = ""
+	if err != nil {
+		d.err = err.Error()
+	}
+	select {
+	case d.changes <- struct{}{}:
+	default:
+	}
+}
+
+func (d *kvDisk) state() map[string]interface{} {
+	state := map[string]interface{}{
+		"directory": d.directory,
+	}
+	if d.err != "" {
+		state["error"] = d.err
+	}
+	return state
+}
+
+func (d *kvDisk) describe() []map[string]string {
+	return []map[string]string{
+		{"name": "directory", "value": d.directory},
+		{"name": "snapshotInterval", "value": d.interval.String()},
+		{"name": "snapshotRetain", "value": strconv.Itoa(d.retain)},
+	}
+}
+
+// Snapshot saves a copy of a persistent store and returns when it was taken
+func (k *KeyValue) Snapshot() (time.Time, error) {
+	if k.disk == nil {
+		return time.Time{}, errors.New("key_value is not persistent")
+	}
+	return k.disk.snapshot()
+}
+
+// Snapshots returns when each saved snapshot was taken, oldest first
+func (k *KeyValue) Snapshots() ([]time.Time, error) {
+	if k.disk == nil {
+		return nil, errors.New("key_value is not persistent")
+	}
+	return k.disk.snapshots()
+}
+
+// Restore replaces the store with the latest snapshot taken at or before t,
+// and returns when that snapshot was taken. Entries expire when they would
+// have at the time of the snapshot.
+func (k *KeyValue) Restore(t time.Time) (time.Time, error) {
+	if k.disk == nil {
+		return time.Time{}, errors.New("key_value is not persistent")
+	}
+	kv, expires, at, err := k.disk.read(t)
+	if err != nil {
+		return time.Time{}, err
+	}
+	err = k.replace(kv, expires)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return at, nil
+}
@@ -2,6 +2,8 @@ package core
 
 import (
 	"errors"
+	"reflect"
+	"strconv"
 	"sync"
 )
 
@@ -20,13 +22,16 @@ func NewList() Source {
 	}
 }
 
+// List is a list held in memory. If maxLength is set, elements are evicted
+// from the head of the list whenever it grows longer.
 type List struct {
-	list []interface{}
-	quit chan bool
+	list      []interface{}
+	maxLength int
+	quit      chan bool
 	sync.Mutex
 }
 
-func (k List) GetType() SourceType {
+func (l *List) GetType() SourceType {
 	return LIST
 }
 
@@ -40,9 +45,97 @@ func (l *List) Set(v interface{}) error {
 		return errors.New("not a slice")
 	}
 	l.list = list
+	l.trimToMax()
 	return nil
 }
 
+func (l *List) SetSourceParameter(name, value string) {
+	l.Lock()
+	defer l.Unlock()
+	switch name {
+	case "maxLength":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return
+		}
+		l.maxLength = n
+		l.trimToMax()
+	}
+}
+
+func (l *List) Describe() []map[string]string {
+	l.Lock()
+	defer l.Unlock()
+	return []map[string]string{
+		{"name": "maxLength", "value": strconv.Itoa(l.maxLength)},
+	}
+}
+
+// trimToMax evicts elements from the head of the list until it is no longer
+// than maxLength
+func (l *List) trimToMax() {
+	if l.maxLength == 0 || len(l.list) <= l.maxLength {
+		return
+	}
+	l.list = append([]interface{}{}, l.list[len(l.list)-l.maxLength:]...)
+}
+
+// insert inserts element before index, evicting from the head of the list if
+// it grows longer than maxLength. It returns false, leaving the list as it
+// was, if element would be evicted straight away.
+func (l *List) insert(index int, element interface{}) bool {
+	if l.maxLength > 0 && index < len(l.list)+1-l.maxLength {
+		return false
+	}
+	newList := make([]interface{}, len(l.list)+1)
+	copy(newList, l.list[:index])
+	newList[index] = element
+	copy(newList[index+1:], l.list[index:])
+	l.list = newList
+	l.trimToMax()
+	return true
+}
+
+// Append adds element to the end of the list, evicting from its head if it
+// grows longer than maxLength
+func (l *List) Append(element interface{}, i chan Interrupt) (Interrupt, error) {
+	l.list = append(l.list, element)
+	l.trimToMax()
+	return nil, nil
+}
+
+// Pop takes the last element off the list, and reports whether there was one
+func (l *List) Pop(i chan Interrupt) (interface{}, bool, Interrupt, error) {
+	if len(l.list) == 0 {
+		return nil, false, nil, nil
+	}
+	element := l.list[len(l.list)-1]
+	l.list = l.list[:len(l.list)-1]
+	return element, true, nil, nil
+}
+
+// listBounds converts start and end, either of which counts back from the
+// end of a list of length n if negative, to a slice of that list. end is
+// inclusive, and both are clamped to the list.
+func listBounds(start, end, n int) (int, int) {
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= n {
+		end = n - 1
+	}
+	if start > end {
+		return 0, 0
+	}
+	return start, end + 1
+}
+
 // retrieves an element from the list by index
 func listGet() Spec {
 	return Spec{
@@ -134,11 +227,18 @@ func listAppend() Spec {
 		Outputs: []Pin{
 			Pin{"out", BOOLEAN},
 		},
-		Source: LIST,
+		Source: ANY_LIST,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
-			l := s.(*List)
+			l := s.(ListSource)
+			f, err := l.Append(in[0], i)
+			if f != nil {
+				return f
+			}
+			if err != nil {
+				out[0] = NewError("listAppend failed with: " + err.Error())
+				return nil
+			}
 			out[0] = true
-			l.list = append(l.list, in[0])
 			return nil
 		},
 	}
@@ -154,20 +254,30 @@ func listPop() Spec {
 		Outputs: []Pin{
 			Pin{"element", ANY},
 		},
-		Source: LIST,
+		Source: ANY_LIST,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
-			l := s.(*List)
-			if len(l.list) == 0 {
+			l := s.(ListSource)
+			element, ok, f, err := l.Pop(i)
+			if f != nil {
+				return f
+			}
+			if err != nil {
+				out[0] = NewError("listPop failed with: " + err.Error())
+				return nil
+			}
+			if !ok {
 				out[0] = NewError("empty list")
 				return nil
 			}
-			out[0], l.list = l.list[len(l.list)-1], l.list[:len(l.list)-1]
+			out[0] = element
 			return nil
 		},
 	}
 }
 
-// listShift adds an element to the front of a list
+// listShift adds an element to the front of a list, and emits true. If the
+// list is already at its maxLength, the element would be evicted straight
+// away, so the list is left as it is and false is emitted.
 func listShift() Spec {
 	return Spec{
 		Name: "listShift",
@@ -180,11 +290,7 @@ func listShift() Spec {
 		Source: LIST,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
 			l := s.(*List)
-			newList := make([]interface{}, len(l.list)+1)
-			newList[0] = in[0]
-			copy(newList[1:], l.list)
-			l.list = newList
-			out[0] = true
+			out[0] = l.insert(0, in[0])
 			return nil
 		},
 	}
@@ -204,3 +310,164 @@ func listDump() Spec {
 		},
 	}
 }
+
+// listLen emits the length of the list
+func listLen() Spec {
+	return Spec{
+		Name:    "listLen",
+		Inputs:  []Pin{Pin{"trigger", ANY}},
+		Outputs: []Pin{Pin{"length", NUMBER}},
+		Source:  LIST,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			l := s.(*List)
+			out[0] = float64(len(l.list))
+			return nil
+		},
+	}
+}
+
+// listInsert inserts an element into the list before index, and emits true.
+// An index equal to the length of the list appends the element. If the
+// element would be evicted straight away from a list at its maxLength, the
+// list is left as it is and false is emitted.
+func listInsert() Spec {
+	return Spec{
+		Name: "listInsert",
+		Inputs: []Pin{
+			Pin{"index", NUMBER}, Pin{"element", ANY},
+		},
+		Outputs: []Pin{
+			Pin{"out", BOOLEAN},
+		},
+		Source: LIST,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			l := s.(*List)
+			indexFloat, ok := in[0].(float64)
+			if !ok {
+				out[0] = NewError("List index is not a Number ")
+				return nil
+			}
+			index := int(indexFloat)
+			if index < 0 || index > len(l.list) {
+				out[0] = NewError("List index out of range")
+				return nil
+			}
+			out[0] = l.insert(index, in[1])
+			return nil
+		},
+	}
+}
+
+// listRange emits the elements of the list from start to end inclusive.
+// Negative indices count back from the end of the list, so that start -10
+// and end -1 are the last ten elements.
+func listRange() Spec {
+	return Spec{
+		Name: "listRange",
+		Inputs: []Pin{
+			Pin{"start", NUMBER}, Pin{"end", NUMBER},
+		},
+		Outputs: []Pin{
+			Pin{"list", ARRAY},
+		},
+		Source: LIST,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			l := s.(*List)
+			start, ok := in[0].(float64)
+			if !ok {
+				out[0] = NewError("start is not a Number")
+				return nil
+			}
+			end, ok := in[1].(float64)
+			if !ok {
+				out[0] = NewError("end is not a Number")
+				return nil
+			}
+			from, to := listBounds(int(start), int(end), len(l.list))
+			out[0] = append([]interface{}{}, l.list[from:to]...)
+			return nil
+		},
+	}
+}
+
+// listRemove removes elements from the list. If byIndex is true, target is
+// an index and the element removed from there is emitted. Otherwise every
+// element equal to target is removed and the number removed is emitted.
+func listRemove() Spec {
+	return Spec{
+		Name: "listRemove",
+		Inputs: []Pin{
+			Pin{"target", ANY}, Pin{"byIndex", BOOLEAN},
+		},
+		Outputs: []Pin{
+			Pin{"removed", ANY},
+		},
+		Source: LIST,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			l := s.(*List)
+			byIndex, ok := in[1].(bool)
+			if !ok {
+				out[0] = NewError("byIndex is not a Boolean")
+				return nil
+			}
+
+			if byIndex {
+				indexFloat, ok := in[0].(float64)
+				if !ok {
+					out[0] = NewError("List index is not a Number ")
+					return nil
+				}
+				index := int(indexFloat)
+				if index < 0 || index >= len(l.list) {
+					out[0] = NewError("List index out of range")
+					return nil
+				}
+				out[0] = l.list[index]
+				l.list = append(l.list[:index:index], l.list[index+1:]...)
+				return nil
+			}
+
+			kept := make([]interface{}, 0, len(l.list))
+			for _, e := range l.list {
+				if !reflect.DeepEqual(e, in[0]) {
+					kept = append(kept, e)
+				}
+			}
+			out[0] = float64(len(l.list) - len(kept))
+			l.list = kept
+			return nil
+		},
+	}
+}
+
+// listTrim keeps only the elements of the list from start to end inclusive,
+// counting negative indices back from the end as listRange does
+func listTrim() Spec {
+	return Spec{
+		Name: "listTrim",
+		Inputs: []Pin{
+			Pin{"start", NUMBER}, Pin{"end", NUMBER},
+		},
+		Outputs: []Pin{
+			Pin{"out", BOOLEAN},
+		},
+		Source: LIST,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			l := s.(*List)
+			start, ok := in[0].(float64)
+			if !ok {
+				out[0] = NewError("start is not a Number")
+				return nil
+			}
+			end, ok := in[1].(float64)
+			if !ok {
+				out[0] = NewError("end is not a Number")
+				return nil
+			}
+			from, to := listBounds(int(start), int(end), len(l.list))
+			l.list = append([]interface{}{}, l.list[from:to]...)
+			out[0] = true
+			return nil
+		},
+	}
+}
@@ -1,21 +1,64 @@
 package core
 
 import (
+	"container/heap"
+	"errors"
+	"sort"
 	"sync"
-
-	"github.com/oleiade/lane"
 )
 
-type queue []*PQMessage
+// queue is a heap of messages ordered by priority, lowest first unless max is
+// set. Messages of equal priority are kept in the order they were pushed.
+type queue struct {
+	messages []*PQMessage
+	max      bool
+}
+
+func (q *queue) Len() int {
+	return len(q.messages)
+}
+
+func (q *queue) Less(a, b int) bool {
+	ma, mb := q.messages[a], q.messages[b]
+	if ma.t != mb.t {
+		return (ma.t < mb.t) != q.max
+	}
+	return ma.seq < mb.seq
+}
+
+func (q *queue) Swap(a, b int) {
+	q.messages[a], q.messages[b] = q.messages[b], q.messages[a]
+	q.messages[a].index = a
+	q.messages[b].index = b
+}
+
+func (q *queue) Push(x interface{}) {
+	m := x.(*PQMessage)
+	m.index = len(q.messages)
+	q.messages = append(q.messages, m)
+}
+
+func (q *queue) Pop() interface{} {
+	n := len(q.messages)
+	m := q.messages[n-1]
+	q.messages[n-1] = nil
+	q.messages = q.messages[:n-1]
+	m.index = -1
+	return m
+}
 
+// PriorityQueue is a queue of messages that pop in order of priority. Its
+// order parameter is either "min", for lowest priority first, or "max".
 type PriorityQueue struct {
-	queue *lane.PQueue
+	queue *queue
+	seq   uint64
 	sync.Mutex
 }
 
 type PQMessage struct {
 	val   interface{}
-	t     int
+	t     float64
+	seq   uint64
 	index int
 }
 
@@ -28,16 +71,116 @@ func PriorityQueueStore() SourceSpec {
 }
 
 func NewPriorityQueue() Source {
-	var pq *lane.PQueue = lane.NewPQueue(lane.MINPQ)
 	return &PriorityQueue{
-		queue: pq,
+		queue: &queue{},
 	}
 }
 
-func (pq PriorityQueue) GetType() SourceType {
+func (pq *PriorityQueue) GetType() SourceType {
 	return PRIORITY
 }
 
+func (pq *PriorityQueue) SetSourceParameter(name, value string) {
+	pq.Lock()
+	defer pq.Unlock()
+	switch name {
+	case "order":
+		if value != "min" && value != "max" {
+			return
+		}
+		pq.queue.max = value == "max"
+		heap.Init(pq.queue)
+	}
+}
+
+func (pq *PriorityQueue) Describe() []map[string]string {
+	pq.Lock()
+	defer pq.Unlock()
+	order := "min"
+	if pq.queue.max {
+		order = "max"
+	}
+	return []map[string]string{
+		{"name": "order", "value": order},
+	}
+}
+
+func (pq *PriorityQueue) push(val interface{}, priority float64) {
+	pq.seq++
+	heap.Push(pq.queue, &PQMessage{val: val, t: priority, seq: pq.seq})
+}
+
+func (pq *PriorityQueue) pop() *PQMessage {
+	return heap.Pop(pq.queue).(*PQMessage)
+}
+
+func (pq *PriorityQueue) head() *PQMessage {
+	return pq.queue.messages[0]
+}
+
+// before reports whether a message of priority t pops before one of priority
+// until, or is equal to it
+func (pq *PriorityQueue) before(t, until float64) bool {
+	if pq.queue.max {
+		return t >= until
+	}
+	return t <= until
+}
+
+func pqEntry(m *PQMessage) map[string]interface{} {
+	return map[string]interface{}{
+		"value":    m.val,
+		"priority": m.t,
+	}
+}
+
+// pqEntries reads an array of {"value", "priority"} objects
+func pqEntries(v interface{}) ([]*PQMessage, error) {
+	entries, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("not an array")
+	}
+	messages := make([]*PQMessage, len(entries))
+	for j, e := range entries {
+		entry, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("entry is not an object")
+		}
+		priority, ok := entry["priority"].(float64)
+		if !ok {
+			return nil, errors.New("entry priority is not a number")
+		}
+		messages[j] = &PQMessage{val: entry["value"], t: priority}
+	}
+	return messages, nil
+}
+
+// Get returns the queue as an array of {"value", "priority"} objects, in the
+// order they would pop
+func (pq *PriorityQueue) Get() interface{} {
+	messages := append([]*PQMessage{}, pq.queue.messages...)
+	q := &queue{messages, pq.queue.max}
+	sort.Slice(messages, func(a, b int) bool { return q.Less(a, b) })
+	entries := make([]interface{}, len(messages))
+	for j, m := range messages {
+		entries[j] = pqEntry(m)
+	}
+	return entries
+}
+
+// Set replaces the queue with an array of {"value", "priority"} objects
+func (pq *PriorityQueue) Set(v interface{}) error {
+	messages, err := pqEntries(v)
+	if err != nil {
+		return err
+	}
+	pq.queue.messages = nil
+	for _, m := range messages {
+		pq.push(m.val, m.t)
+	}
+	return nil
+}
+
 func pqPush() Spec {
 	return Spec{
 		Name: "pqPush",
@@ -56,13 +199,72 @@ func pqPush() Spec {
 				out[0] = NewError("pqPush needs a Number for a priority")
 				return nil
 			}
-			pq.queue.Push(in[0], int(priority))
+			pq.push(in[0], priority)
+			out[0] = true
+			return nil
+		},
+	}
+}
+
+// pqPushMany pushes an array of {"value", "priority"} objects, or none of
+// them if any is malformed
+func pqPushMany() Spec {
+	return Spec{
+		Name: "pqPushMany",
+		Inputs: []Pin{
+			Pin{"in", ARRAY},
+		},
+		Outputs: []Pin{
+			Pin{"out", BOOLEAN},
+		},
+		Source: PRIORITY,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			pq := s.(*PriorityQueue)
+			messages, err := pqEntries(in[0])
+			if err != nil {
+				out[0] = NewError("pqPushMany needs an array of objects with a value and a Number priority")
+				return nil
+			}
+			for _, m := range messages {
+				pq.push(m.val, m.t)
+			}
 			out[0] = true
 			return nil
 		},
 	}
 }
 
+// pqPopUntil pops every message that comes before priority, or has that
+// priority, and emits them in order as an array of {"value", "priority"}
+// objects. With priorities as timestamps, this releases every message that
+// is due.
+func pqPopUntil() Spec {
+	return Spec{
+		Name: "pqPopUntil",
+		Inputs: []Pin{
+			Pin{"priority", NUMBER},
+		},
+		Outputs: []Pin{
+			Pin{"out", ARRAY},
+		},
+		Source: PRIORITY,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			pq := s.(*PriorityQueue)
+			until, ok := in[0].(float64)
+			if !ok {
+				out[0] = NewError("pqPopUntil needs a Number for a priority")
+				return nil
+			}
+			popped := []interface{}{}
+			for pq.queue.Len() > 0 && pq.before(pq.head().t, until) {
+				popped = append(popped, pqEntry(pq.pop()))
+			}
+			out[0] = popped
+			return nil
+		},
+	}
+}
+
 func pqPop() Spec {
 	return Spec{
 		Name: "pqPop",
@@ -76,13 +278,13 @@ func pqPop() Spec {
 		Source: PRIORITY,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
 			pq := s.(*PriorityQueue)
-			if pq.queue.Size() == 0 {
+			if pq.queue.Len() == 0 {
 				out[0] = NewError("empty PriorityQueue")
 				return nil
 			}
-			msg, priority := pq.queue.Pop()
-			out[0] = msg
-			out[1] = float64(priority)
+			m := pq.pop()
+			out[0] = m.val
+			out[1] = m.t
 			return nil
 		},
 	}
@@ -101,13 +303,13 @@ func pqPeek() Spec {
 		Source: PRIORITY,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
 			pq := s.(*PriorityQueue)
-			if pq.queue.Size() == 0 {
+			if pq.queue.Len() == 0 {
 				out[0] = NewError("empty PriorityQueue")
 				return nil
 			}
-			msg, priority := pq.queue.Head()
-			out[0] = msg
-			out[1] = float64(priority)
+			m := pq.head()
+			out[0] = m.val
+			out[1] = m.t
 			return nil
 		},
 	}
@@ -125,7 +327,7 @@ func pqLen() Spec {
 		Source: PRIORITY,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
 			pq := s.(*PriorityQueue)
-			out[0] = float64(pq.queue.Size())
+			out[0] = float64(pq.queue.Len())
 			return nil
 		},
 	}
@@ -143,9 +345,7 @@ func pqClear() Spec {
 		Source: PRIORITY,
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
 			pq := s.(*PriorityQueue)
-			for pq.queue.Size() != 0 {
-				_, _ = pq.queue.Pop()
-			}
+			pq.queue.messages = nil
 			out[0] = true
 			return nil
 		},
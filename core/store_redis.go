@@ -0,0 +1,346 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func RedisStore() SourceSpec {
+	return SourceSpec{
+		Name: "redis",
+		Type: REDIS,
+		New:  NewRedis,
+	}
+}
+
+// how long a redis command can take before it fails
+var redisTimeout = 5 * time.Second
+
+// redisPasswordMask is shown in place of a password that has been set.
+// Setting the password to it leaves the password as it is.
+const redisPasswordMask = "****"
+
+// Redis is a store kept in a Redis server, so that it can be shared between
+// st-core instances and survives a restart. The key value store is kept in a
+// hash named <key>:kv and the list in a list named <key>:list. Values are
+// stored as JSON.
+//
+// kvGet, kvSet, kvDelete, listAppend and listPop blocks can be linked to a
+// Redis source in place of a key_value or list store. The lock only
+// serialises blocks within this process; each block's command is atomic on
+// the server.
+//
+// The password is never shown by Describe, so it isn't saved with a pattern.
+type Redis struct {
+	address  string
+	password string
+	db       int
+	key      string
+	pool     *redis.Pool
+	quit     chan bool
+	sync.Mutex
+}
+
+func NewRedis() Source {
+	return &Redis{
+		address: "localhost:6379",
+		key:     "st-core",
+		quit:    make(chan bool),
+	}
+}
+
+func (r *Redis) GetType() SourceType {
+	return REDIS
+}
+
+func (r *Redis) SetSourceParameter(name, value string) {
+	r.Lock()
+	defer r.Unlock()
+	switch name {
+	case "address":
+		r.address = value
+	case "password":
+		if value == redisPasswordMask {
+			return
+		}
+		r.password = value
+	case "db":
+		db, err := strconv.Atoi(value)
+		if err != nil || db < 0 {
+			return
+		}
+		r.db = db
+	case "key":
+		if value == "" {
+			return
+		}
+		r.key = value
+		return
+	default:
+		return
+	}
+	r.close()
+}
+
+func (r *Redis) Describe() []map[string]string {
+	r.Lock()
+	defer r.Unlock()
+	password := ""
+	if r.password != "" {
+		password = redisPasswordMask
+	}
+	return []map[string]string{
+		{"name": "address", "value": r.address},
+		{"name": "password", "value": password},
+		{"name": "db", "value": strconv.Itoa(r.db)},
+		{"name": "key", "value": r.key},
+	}
+}
+
+func (r *Redis) Serve() {
+	<-r.quit
+}
+
+func (r *Redis) Stop() {
+	close(r.quit)
+	r.Lock()
+	r.close()
+	r.Unlock()
+}
+
+func (r *Redis) close() {
+	if r.pool == nil {
+		return
+	}
+	r.pool.Close()
+	r.pool = nil
+}
+
+func (r *Redis) kvKey() string {
+	return r.key + ":kv"
+}
+
+func (r *Redis) listKey() string {
+	return r.key + ":list"
+}
+
+// conn returns a connection from the pool, creating the pool if need be
+func (r *Redis) conn() redis.Conn {
+	if r.pool == nil {
+		address, password, db := r.address, r.password, r.db
+		r.pool = &redis.Pool{
+			MaxIdle:     2,
+			IdleTimeout: time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", address,
+					redis.DialPassword(password),
+					redis.DialDatabase(db),
+					redis.DialConnectTimeout(redisTimeout),
+					redis.DialReadTimeout(redisTimeout),
+					redis.DialWriteTimeout(redisTimeout),
+				)
+			},
+		}
+	}
+	return r.pool.Get()
+}
+
+// do runs a command, returning early if the block is interrupted
+func (r *Redis) do(i chan Interrupt, command string, args ...interface{}) (interface{}, Interrupt, error) {
+	conn := r.conn()
+	type result struct {
+		reply interface{}
+		err   error
+	}
+	c := make(chan result, 1)
+	go func() {
+		defer conn.Close()
+		reply, err := conn.Do(command, args...)
+		c <- result{reply, err}
+	}()
+
+	select {
+	case res := <-c:
+		return res.reply, nil, res.err
+	case f := <-i:
+		return nil, f, nil
+	}
+}
+
+// Get returns the store as an object with the key value store under "kv" and
+// the list under "list". If the server can't be read, it returns the error.
+func (r *Redis) Get() interface{} {
+	conn := r.conn()
+	defer conn.Close()
+
+	hash, err := redis.StringMap(conn.Do("HGETALL", r.kvKey()))
+	if err != nil {
+		return err
+	}
+	kv := make(map[string]interface{})
+	for k, v := range hash {
+		var value interface{}
+		if json.Unmarshal([]byte(v), &value) != nil {
+			value = v
+		}
+		kv[k] = value
+	}
+
+	elements, err := redis.Strings(conn.Do("LRANGE", r.listKey(), 0, -1))
+	if err != nil {
+		return err
+	}
+	list := make([]interface{}, len(elements))
+	for j, e := range elements {
+		if json.Unmarshal([]byte(e), &list[j]) != nil {
+			list[j] = e
+		}
+	}
+
+	return map[string]interface{}{
+		"kv":   kv,
+		"list": list,
+	}
+}
+
+// Set replaces the store with an object of the form returned by Get. Either
+// field can be left out to leave that part of the store as it is.
+func (r *Redis) Set(v interface{}) error {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return errors.New("not a map")
+	}
+
+	var kv map[string]interface{}
+	if k, ok := m["kv"]; ok {
+		kv, ok = k.(map[string]interface{})
+		if !ok {
+			return errors.New("kv is not a map")
+		}
+	}
+	var list []interface{}
+	if l, ok := m["list"]; ok {
+		list, ok = l.([]interface{})
+		if !ok {
+			return errors.New("list is not a slice")
+		}
+	}
+
+	// the values are marshalled before anything is sent, so that a value
+	// that can't be leaves the store as it is
+	type command struct {
+		name string
+		args []interface{}
+	}
+	commands := []command{}
+	if kv != nil {
+		commands = append(commands, command{"DEL", []interface{}{r.kvKey()}})
+		for k, value := range kv {
+			d, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			commands = append(commands, command{"HSET", []interface{}{r.kvKey(), k, d}})
+		}
+	}
+	if list != nil {
+		commands = append(commands, command{"DEL", []interface{}{r.listKey()}})
+		for _, e := range list {
+			d, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			commands = append(commands, command{"RPUSH", []interface{}{r.listKey(), d}})
+		}
+	}
+
+	conn := r.conn()
+	defer conn.Close()
+	if err := conn.Send("MULTI"); err != nil {
+		return err
+	}
+	for _, c := range commands {
+		if err := conn.Send(c.name, c.args...); err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// redisValue decodes a JSON value read from redis
+func redisValue(reply interface{}) (interface{}, error) {
+	d, err := redis.Bytes(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	err = json.Unmarshal(d, &value)
+	return value, err
+}
+
+// GetKey returns the value of key
+func (r *Redis) GetKey(key string, i chan Interrupt) (interface{}, bool, Interrupt, error) {
+	reply, f, err := r.do(i, "HGET", r.kvKey(), key)
+	if f != nil || err != nil || reply == nil {
+		return nil, false, f, err
+	}
+	value, err := redisValue(reply)
+	if err != nil {
+		return nil, false, nil, errors.New("could not decode value")
+	}
+	return value, true, nil, nil
+}
+
+// SetKey sets key to value, and reports whether the key is new
+func (r *Redis) SetKey(key string, value interface{}, i chan Interrupt) (bool, Interrupt, error) {
+	d, err := json.Marshal(value)
+	if err != nil {
+		return false, nil, errors.New("could not marshal value")
+	}
+	reply, f, err := r.do(i, "HSET", r.kvKey(), key, d)
+	if f != nil {
+		return false, f, nil
+	}
+	added, err := redis.Int(reply, err)
+	return added == 1, nil, err
+}
+
+// DeleteKey deletes key, and reports whether it was there to delete
+func (r *Redis) DeleteKey(key string, i chan Interrupt) (bool, Interrupt, error) {
+	reply, f, err := r.do(i, "HDEL", r.kvKey(), key)
+	if f != nil {
+		return false, f, nil
+	}
+	deleted, err := redis.Int(reply, err)
+	return deleted == 1, nil, err
+}
+
+// Append adds element to the end of the list
+func (r *Redis) Append(element interface{}, i chan Interrupt) (Interrupt, error) {
+	d, err := json.Marshal(element)
+	if err != nil {
+		return nil, errors.New("could not marshal element")
+	}
+	_, f, err := r.do(i, "RPUSH", r.listKey(), d)
+	return f, err
+}
+
+// Pop takes the last element off the list, and reports whether there was one
+func (r *Redis) Pop(i chan Interrupt) (interface{}, bool, Interrupt, error) {
+	reply, f, err := r.do(i, "RPOP", r.listKey())
+	if f != nil || err != nil || reply == nil {
+		return nil, false, f, err
+	}
+	element, err := redisValue(reply)
+	if err != nil {
+		return nil, false, nil, errors.New("could not decode element")
+	}
+	return element, true, nil, nil
+}
@@ -0,0 +1,271 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+)
+
+func SetStore() SourceSpec {
+	return SourceSpec{
+		Name: "set",
+		Type: SET,
+		New:  NewMemberSet,
+	}
+}
+
+// MemberSet is a set of messages. Members are compared by their JSON, so two
+// objects with the same fields are the same member.
+type MemberSet struct {
+	members map[string]interface{}
+	sync.Mutex
+}
+
+func NewMemberSet() Source {
+	return &MemberSet{
+		members: make(map[string]interface{}),
+	}
+}
+
+func (m *MemberSet) GetType() SourceType {
+	return SET
+}
+
+// setKey returns the JSON that identifies a member
+func setKey(member interface{}) (string, error) {
+	key, err := json.Marshal(member)
+	return string(key), err
+}
+
+// sortedMembers returns the members of a set, ordered by their JSON
+func sortedMembers(members map[string]interface{}) []interface{} {
+	keys := make([]string, 0, len(members))
+	for k := range members {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]interface{}, len(keys))
+	for j, k := range keys {
+		out[j] = members[k]
+	}
+	return out
+}
+
+// setFromArray makes a set from the elements of an array
+func setFromArray(v interface{}) (map[string]interface{}, error) {
+	elements, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("not an array")
+	}
+	members := make(map[string]interface{})
+	for _, e := range elements {
+		key, err := setKey(e)
+		if err != nil {
+			return nil, err
+		}
+		members[key] = e
+	}
+	return members, nil
+}
+
+// Get returns the members as an array
+func (m *MemberSet) Get() interface{} {
+	return sortedMembers(m.members)
+}
+
+// Set replaces the members with the elements of an array
+func (m *MemberSet) Set(v interface{}) error {
+	members, err := setFromArray(v)
+	if err != nil {
+		return err
+	}
+	m.members = members
+	return nil
+}
+
+// setAdd adds a member to the set, and emits true if it is new
+func setAdd() Spec {
+	return Spec{
+		Name: "setAdd",
+		Inputs: []Pin{
+			Pin{"member", ANY},
+		},
+		Outputs: []Pin{
+			Pin{"new", BOOLEAN},
+		},
+		Source: SET,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			set := s.(*MemberSet)
+			key, err := setKey(in[0])
+			if err != nil {
+				out[0] = NewError("setAdd could not marshal member")
+				return nil
+			}
+			_, exists := set.members[key]
+			set.members[key] = in[0]
+			out[0] = !exists
+			return nil
+		},
+	}
+}
+
+// setRemove removes a member from the set, and emits true if it was there
+func setRemove() Spec {
+	return Spec{
+		Name: "setRemove",
+		Inputs: []Pin{
+			Pin{"member", ANY},
+		},
+		Outputs: []Pin{
+			Pin{"removed", BOOLEAN},
+		},
+		Source: SET,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			set := s.(*MemberSet)
+			key, err := setKey(in[0])
+			if err != nil {
+				out[0] = NewError("setRemove could not marshal member")
+				return nil
+			}
+			_, exists := set.members[key]
+			delete(set.members, key)
+			out[0] = exists
+			return nil
+		},
+	}
+}
+
+// setHas emits whether the set has a member
+func setHas() Spec {
+	return Spec{
+		Name: "setHas",
+		Inputs: []Pin{
+			Pin{"member", ANY},
+		},
+		Outputs: []Pin{
+			Pin{"has", BOOLEAN},
+		},
+		Source: SET,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			set := s.(*MemberSet)
+			key, err := setKey(in[0])
+			if err != nil {
+				out[0] = NewError("setHas could not marshal member")
+				return nil
+			}
+			_, exists := set.members[key]
+			out[0] = exists
+			return nil
+		},
+	}
+}
+
+// setSize emits the number of members in the set
+func setSize() Spec {
+	return Spec{
+		Name:    "setSize",
+		Inputs:  []Pin{Pin{"trigger", ANY}},
+		Outputs: []Pin{Pin{"size", NUMBER}},
+		Source:  SET,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			set := s.(*MemberSet)
+			out[0] = float64(len(set.members))
+			return nil
+		},
+	}
+}
+
+// setMembers emits the members of the set as an array
+func setMembers() Spec {
+	return Spec{
+		Name:    "setMembers",
+		Inputs:  []Pin{Pin{"trigger", ANY}},
+		Outputs: []Pin{Pin{"members", ARRAY}},
+		Source:  SET,
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			set := s.(*MemberSet)
+			out[0] = sortedMembers(set.members)
+			return nil
+		},
+	}
+}
+
+// setOperation returns a block that combines the members of the two sets it is
+// linked to each time trigger arrives, and emits the result as an array. Both
+// sets are locked while they are read.
+func setOperation(name string, op func(a, b map[string]interface{}) map[string]interface{}) Spec {
+	return Spec{
+		Name:         name,
+		Inputs:       []Pin{Pin{"trigger", ANY}},
+		Outputs:      []Pin{Pin{"members", ARRAY}},
+		Source:       SET,
+		ExtraSources: []SourceType{SET},
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			sets := s.(Sources)
+			a := sets[0].(*MemberSet)
+			b := sets[1].(*MemberSet)
+			out[0] = sortedMembers(op(a.members, b.members))
+			return nil
+		},
+	}
+}
+
+// setUnion emits the members that are in either set, or both
+func setUnion() Spec {
+	return setOperation("setUnion", func(a, b map[string]interface{}) map[string]interface{} {
+		members := make(map[string]interface{})
+		for k, v := range a {
+			members[k] = v
+		}
+		for k, v := range b {
+			members[k] = v
+		}
+		return members
+	})
+}
+
+// setIntersection emits the members that are in both sets
+func setIntersection() Spec {
+	return setOperation("setIntersection", func(a, b map[string]interface{}) map[string]interface{} {
+		members := make(map[string]interface{})
+		for k, v := range a {
+			if _, ok := b[k]; ok {
+				members[k] = v
+			}
+		}
+		return members
+	})
+}
+
+// setDifference emits the members of the first set that aren't in the second
+func setDifference() Spec {
+	return setOperation("setDifference", func(a, b map[string]interface{}) map[string]interface{} {
+		members := make(map[string]interface{})
+		for k, v := range a {
+			if _, ok := b[k]; !ok {
+				members[k] = v
+			}
+		}
+		return members
+	})
+}
+
+// setSymmetricDifference emits the members that are in either set, but not
+// both
+func setSymmetricDifference() Spec {
+	return setOperation("setSymmetricDifference", func(a, b map[string]interface{}) map[string]interface{} {
+		members := make(map[string]interface{})
+		for k, v := range a {
+			if _, ok := b[k]; !ok {
+				members[k] = v
+			}
+		}
+		for k, v := range b {
+			if _, ok := a[k]; !ok {
+				members[k] = v
+			}
+		}
+		return members
+	})
+}
@@ -4,17 +4,21 @@ import "strings"
 
 func StringConcat() Spec {
 	return Spec{
-		Name:    "concat",
-		Inputs:  []Pin{Pin{"a", STRING}, Pin{"b", STRING}},
-		Outputs: []Pin{Pin{"a+b", STRING}},
+		Name:     "concat",
+		Inputs:   []Pin{Pin{"a", STRING}, Pin{"b", STRING}},
+		Outputs:  []Pin{Pin{"a+b", STRING}},
+		Variadic: &Variadic{Start: 0, Min: 2, Max: 64},
 		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
-			a, ok := in[0].(string)
-			b, ok := in[1].(string)
-			if !ok {
-				out[0] = NewError("concat requires string")
-				return nil
+			var result string
+			for j := 0; j < len(in); j++ {
+				a, ok := in[RouteIndex(j)].(string)
+				if !ok {
+					out[0] = NewError("concat requires string")
+					return nil
+				}
+				result += a
 			}
-			out[0] = a + b
+			out[0] = result
 			return nil
 		},
 	}
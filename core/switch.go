@@ -0,0 +1,165 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+)
+
+// a switchCase is a single test in a switch block's case list. A case is
+// written as one of {"equals": value}, {"regex": pattern} or
+// {"min": number, "max": number}, where either bound of a range can be
+// omitted. Ranges include min and exclude max.
+type switchCase struct {
+	equals    interface{}
+	hasEquals bool
+	regex     *regexp.Regexp
+	min       *float64
+	max       *float64
+}
+
+func (c switchCase) match(v interface{}) bool {
+	switch {
+	case c.hasEquals:
+		return reflect.DeepEqual(c.equals, v)
+	case c.regex != nil:
+		s, ok := v.(string)
+		return ok && c.regex.MatchString(s)
+	}
+	f, ok := v.(float64)
+	if !ok {
+		return false
+	}
+	if c.min != nil && f < *c.min {
+		return false
+	}
+	if c.max != nil && f >= *c.max {
+		return false
+	}
+	return true
+}
+
+// String describes the case, and is used to name the case's output
+func (c switchCase) String() string {
+	switch {
+	case c.hasEquals:
+		return fmt.Sprint("== ", c.equals)
+	case c.regex != nil:
+		return "~ " + c.regex.String()
+	}
+	min, max := "-inf", "inf"
+	if c.min != nil {
+		min = strconv.FormatFloat(*c.min, 'f', -1, 64)
+	}
+	if c.max != nil {
+		max = strconv.FormatFloat(*c.max, 'f', -1, 64)
+	}
+	return "[" + min + ", " + max + ")"
+}
+
+func parseSwitchCases(m interface{}) ([]switchCase, error) {
+	list, ok := m.([]interface{})
+	if !ok {
+		return nil, errors.New("switch cases must be an array")
+	}
+
+	cases := make([]switchCase, len(list), len(list))
+	for i, v := range list {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("switch case must be an object")
+		}
+
+		if equals, ok := obj["equals"]; ok {
+			cases[i] = switchCase{equals: equals, hasEquals: true}
+			continue
+		}
+
+		if pattern, ok := obj["regex"]; ok {
+			p, ok := pattern.(string)
+			if !ok {
+				return nil, errors.New("switch regex must be a string")
+			}
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, err
+			}
+			cases[i] = switchCase{regex: re}
+			continue
+		}
+
+		min, hasMin := obj["min"]
+		max, hasMax := obj["max"]
+		if !hasMin && !hasMax {
+			return nil, errors.New("switch case needs one of equals, regex, min or max")
+		}
+		if hasMin {
+			f, ok := min.(float64)
+			if !ok {
+				return nil, errors.New("switch min must be a number")
+			}
+			cases[i].min = &f
+		}
+		if hasMax {
+			f, ok := max.(float64)
+			if !ok {
+				return nil, errors.New("switch max must be a number")
+			}
+			cases[i].max = &f
+		}
+	}
+	return cases, nil
+}
+
+// Switch routes in to the output of the first case that matches value, or to
+// the default output if no case matches. The block has an output for each
+// case, so the case list should be set as a route value.
+func Switch() Spec {
+	return Spec{
+		Name:     "switch",
+		Category: []string{"mechanism"},
+		Inputs:   []Pin{Pin{"in", ANY}, Pin{"value", ANY}, Pin{"cases", ARRAY}},
+		Outputs:  []Pin{Pin{"default", ANY}},
+		Reshape: func(id RouteIndex, v *InputValue) ([]Pin, bool) {
+			if id != 2 {
+				return nil, false
+			}
+			pins := []Pin{Pin{"default", ANY}}
+			if v == nil {
+				return pins, true
+			}
+			cases, err := parseSwitchCases(v.Data)
+			if err != nil {
+				return nil, false
+			}
+			for _, c := range cases {
+				pins = append(pins, Pin{c.String(), ANY})
+			}
+			return pins, true
+		},
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			// parsing the cases compiles their regexes, so we only do it
+			// when the case list changes
+			if _, ok := internal[1]; !ok || !reflect.DeepEqual(internal[0], in[2]) {
+				cases, err := parseSwitchCases(in[2])
+				if err != nil {
+					out[0] = NewError(err.Error())
+					return nil
+				}
+				internal[0] = in[2]
+				internal[1] = cases
+			}
+
+			for j, c := range internal[1].([]switchCase) {
+				if c.match(in[1]) {
+					out[RouteIndex(j+1)] = in[0]
+					return nil
+				}
+			}
+			out[0] = in[0]
+			return nil
+		},
+	}
+}
@@ -13,3 +13,44 @@ func Timestamp() Spec {
 		},
 	}
 }
+
+// Watchdog passes its inbound messages through, and emits a timeout event if
+// no message arrives within duration of the previous one. The watchdog is
+// armed by the first message, and re-armed by every message after that.
+func Watchdog() Spec {
+	return Spec{
+		Name:     "watchdog",
+		Category: []string{"mechanism"},
+		Inputs:   []Pin{Pin{"in", ANY}, Pin{"duration", STRING}},
+		Outputs:  []Pin{Pin{"out", ANY}, Pin{"timeout", OBJECT}},
+		Triggers: []Trigger{HOT, COLD},
+		Kernel: func(in, out, internal MessageMap, s Source, i chan Interrupt) Interrupt {
+			durationString, ok := in[1].(string)
+			if !ok {
+				out[0] = NewError("watchdog requires string duration")
+				return nil
+			}
+			d, err := time.ParseDuration(durationString)
+			if err != nil {
+				out[0] = NewError(err.Error())
+				return nil
+			}
+
+			m, ok := in[0]
+			if !ok {
+				// no message arrived before the deadline
+				out[1] = map[string]interface{}{
+					"duration": durationString,
+					"last":     internal[0],
+				}
+				return nil
+			}
+
+			now := time.Now()
+			internal[0] = float64(now.UnixNano() / 1000000)
+			internal[DEADLINE] = now.Add(d)
+			out[0] = m
+			return nil
+		},
+	}
+}
@@ -15,6 +15,23 @@ const (
 	NSQCONSUMER
 	WSCLIENT
 	STDIN
+	HTTP_INGRESS
+	WSSERVER
+	NSQPRODUCER
+	TCPLISTENER
+	TCPDIALER
+	UDPLISTENER
+	FILETAIL
+	FILEWRITER
+	STDWRITER
+	ANY_WRITER
+	EXEC
+	SQL
+	REDIS
+	SET
+	BLOOM
+	ANY_KEY_VALUE
+	ANY_LIST
 )
 
 // JSONType defines the possible types that variables in core can take
@@ -32,6 +49,44 @@ const (
 	ERROR
 )
 
+// Trigger defines how a block's input participates in firing the block's kernel
+type Trigger uint8
+
+const (
+	// REQUIRED inputs must each receive a message before the kernel runs
+	REQUIRED Trigger = iota
+	// HOT inputs fire the kernel as soon as a message arrives on them
+	HOT
+	// COLD inputs never fire the kernel, but latch their latest message
+	COLD
+)
+
+func (t Trigger) MarshalJSON() ([]byte, error) {
+	switch t {
+	case REQUIRED:
+		return []byte(`"required"`), nil
+	case HOT:
+		return []byte(`"hot"`), nil
+	case COLD:
+		return []byte(`"cold"`), nil
+	}
+	return nil, errors.New("Unknown trigger")
+}
+
+func (t *Trigger) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case `"required"`:
+		*t = REQUIRED
+	case `"hot"`:
+		*t = HOT
+	case `"cold"`:
+		*t = COLD
+	default:
+		return errors.New("Error unmarshalling trigger")
+	}
+	return nil
+}
+
 // BlockAlert defines the possible messages a block can emit about its runnig state
 type BlockInfo uint8
 
@@ -69,6 +124,12 @@ type Message interface{}
 // RouteIndex is the index into a MessageMap. The 0th index corresponds to that block's 0th Input or Output
 type RouteIndex int
 
+// DEADLINE is a reserved key in a kernel's internal MessageMap. If a kernel of a
+// block with HOT inputs stores a time.Time under it, the block fires once that
+// time has passed even if no HOT input has received a message. The deadline
+// is removed when it fires.
+const DEADLINE RouteIndex = -1
+
 // SourceType is used to indicate what kind of source a block can connect to
 type SourceType int
 
@@ -91,6 +152,40 @@ func (s *SourceType) UnmarshalJSON(data []byte) error {
 		*s = SourceType(PRIORITY)
 	case `"stdin"`:
 		*s = SourceType(STDIN)
+	case `"httpIngress"`:
+		*s = SourceType(HTTP_INGRESS)
+	case `"wsServer"`:
+		*s = SourceType(WSSERVER)
+	case `"NSQProducer"`:
+		*s = SourceType(NSQPRODUCER)
+	case `"tcpListener"`:
+		*s = SourceType(TCPLISTENER)
+	case `"tcpDialer"`:
+		*s = SourceType(TCPDIALER)
+	case `"udpListener"`:
+		*s = SourceType(UDPLISTENER)
+	case `"fileTail"`:
+		*s = SourceType(FILETAIL)
+	case `"fileWriter"`:
+		*s = SourceType(FILEWRITER)
+	case `"stdWriter"`:
+		*s = SourceType(STDWRITER)
+	case `"writer"`:
+		*s = SourceType(ANY_WRITER)
+	case `"exec"`:
+		*s = SourceType(EXEC)
+	case `"sql"`:
+		*s = SourceType(SQL)
+	case `"redis"`:
+		*s = SourceType(REDIS)
+	case `"set"`:
+		*s = SourceType(SET)
+	case `"bloom"`:
+		*s = SourceType(BLOOM)
+	case `"keyValueStore"`:
+		*s = SourceType(ANY_KEY_VALUE)
+	case `"listStore"`:
+		*s = SourceType(ANY_LIST)
 	default:
 		return errors.New("Error unmarshalling source type")
 	}
@@ -115,6 +210,40 @@ func (s SourceType) MarshalJSON() ([]byte, error) {
 		return []byte(`"priority-queue"`), nil
 	case STDIN:
 		return []byte(`"stdin"`), nil
+	case HTTP_INGRESS:
+		return []byte(`"httpIngress"`), nil
+	case WSSERVER:
+		return []byte(`"wsServer"`), nil
+	case NSQPRODUCER:
+		return []byte(`"NSQProducer"`), nil
+	case TCPLISTENER:
+		return []byte(`"tcpListener"`), nil
+	case TCPDIALER:
+		return []byte(`"tcpDialer"`), nil
+	case UDPLISTENER:
+		return []byte(`"udpListener"`), nil
+	case FILETAIL:
+		return []byte(`"fileTail"`), nil
+	case FILEWRITER:
+		return []byte(`"fileWriter"`), nil
+	case STDWRITER:
+		return []byte(`"stdWriter"`), nil
+	case ANY_WRITER:
+		return []byte(`"writer"`), nil
+	case EXEC:
+		return []byte(`"exec"`), nil
+	case SQL:
+		return []byte(`"sql"`), nil
+	case REDIS:
+		return []byte(`"redis"`), nil
+	case SET:
+		return []byte(`"set"`), nil
+	case BLOOM:
+		return []byte(`"bloom"`), nil
+	case ANY_KEY_VALUE:
+		return []byte(`"keyValueStore"`), nil
+	case ANY_LIST:
+		return []byte(`"listStore"`), nil
 	}
 	return nil, errors.New("Unknown source type")
 }
@@ -137,23 +266,51 @@ type Pin struct {
 }
 
 // A Spec defines a block's input and output Pins, and the block's Kernel.
+// Triggers optionally sets the Trigger of each input, by index. Inputs without
+// an entry are REQUIRED. Defaults optionally sets a route value on inputs, by
+// index, when a block is created, so that inputs added to an existing Spec
+// don't leave saved patterns waiting on them. ExtraSources optionally lists the
+// types of sources a block is linked to besides Source, such as the second set
+// of a set operation.
 type Spec struct {
-	Name     string
-	Category []string
-	Inputs   []Pin
-	Outputs  []Pin
-	Source   SourceType
-	Kernel   Kernel
+	Name         string
+	Category     []string
+	Inputs       []Pin
+	Outputs      []Pin
+	Triggers     []Trigger
+	Defaults     map[RouteIndex]Message
+	Variadic     *Variadic
+	Reshape      Reshape
+	Source       SourceType
+	ExtraSources []SourceType
+	Kernel       Kernel
+}
+
+// Reshape is called whenever a route value is set on a block. If it returns
+// true, the block's outputs are replaced by the returned Pins. Outputs that
+// keep their index also keep their connections.
+type Reshape func(RouteIndex, *InputValue) ([]Pin, bool)
+
+// Variadic marks a Spec's inputs from Start onwards as a group whose size can
+// be changed on a running block. The group can never hold fewer than Min
+// inputs, or more than Max. Inputs added to the group copy the name, type and
+// trigger of the group's first input.
+type Variadic struct {
+	Start int
+	Min   int
+	Max   int
 }
 
 // Input is an inbound route to a block. A Input holds the channel that allows Messages
 // to be passed into the block. A Input's Path is applied to the inbound Message before populating the
 // MessageMap and calling the Kernel. A Input can be set to a Value, instead of waiting for an inbound message.
+// An Input's Trigger decides whether a message on it fires the Kernel.
 type Input struct {
-	Name  string       `json:"name"`
-	Value *InputValue  `json:"value"`
-	Type  JSONType     `json:"type"`
-	C     chan Message `json:"-"`
+	Name    string       `json:"name"`
+	Value   *InputValue  `json:"value"`
+	Type    JSONType     `json:"type"`
+	Trigger Trigger      `json:"trigger"`
+	C       chan Message `json:"-"`
 }
 
 type InputValue struct {
@@ -192,11 +349,13 @@ type ManifestPair struct {
 // A block's Manifest is the set of Connections
 type Manifest map[ManifestPair]struct{}
 
-// A block's BlockState is the pair of input/output MessageMaps, and the Manifest
+// A block's BlockState is the pair of input/output MessageMaps, and the Manifest.
+// latchedValues holds the latest message received on each COLD input.
 type BlockState struct {
 	inputValues    MessageMap
 	outputValues   MessageMap
 	internalValues MessageMap
+	latchedValues  MessageMap
 	manifest       Manifest
 	Processed      bool
 }
@@ -211,6 +370,8 @@ type Interface interface {
 	Stop()
 }
 
+// A Store holds a value that can be read and replaced as a whole. Get returns
+// an error, rather than the value, if the store can't be read.
 type Store interface {
 	Source
 	Get() interface{}
@@ -219,24 +380,110 @@ type Store interface {
 	Unlock()
 }
 
+// An Expiring store has entries that expire. TTLs returns how long each entry
+// that expires has left. Like Get, it is called with the store locked.
+type Expiring interface {
+	Store
+	TTLs() map[string]time.Duration
+}
+
+// A Snapshotter store can save copies of its contents and restore the one
+// taken at a point in time. Like Get and Set, its methods are called with the
+// store locked.
+type Snapshotter interface {
+	Store
+	Snapshot() (time.Time, error)
+	Snapshots() ([]time.Time, error)
+	Restore(time.Time) (time.Time, error)
+}
+
+// A Parameterized source is configured by named string parameters. Describe
+// lists the current parameters as {"name", "value"} pairs.
+type Parameterized interface {
+	Source
+	SetSourceParameter(name, value string)
+	Describe() []map[string]string
+}
+
+// A Stateful source reports its current state, such as whether it is
+// connected. StateChanges receives a signal whenever the state changes.
+type Stateful interface {
+	Source
+	State() map[string]interface{}
+	StateChanges() chan struct{}
+}
+
+// A Writer source is written to one message at a time. Blocks whose source
+// type is ANY_WRITER can be linked to any Writer.
+type Writer interface {
+	Source
+	Write([]byte) (int, error)
+}
+
+// A KeyValueSource is a Store whose entries can be read and written by key.
+// Blocks whose source type is ANY_KEY_VALUE can be linked to any
+// KeyValueSource. Like a kernel, each method is called with the store locked,
+// and returns the interrupt if one arrives while it waits on the store.
+type KeyValueSource interface {
+	Store
+	GetKey(key string, i chan Interrupt) (interface{}, bool, Interrupt, error)
+	SetKey(key string, value interface{}, i chan Interrupt) (bool, Interrupt, error)
+	DeleteKey(key string, i chan Interrupt) (bool, Interrupt, error)
+}
+
+// A ListSource is a Store holding a list that can be added to and taken from
+// at its end. Blocks whose source type is ANY_LIST can be linked to any
+// ListSource, and its methods are called as a KeyValueSource's are.
+type ListSource interface {
+	Store
+	Append(element interface{}, i chan Interrupt) (Interrupt, error)
+	Pop(i chan Interrupt) (interface{}, bool, Interrupt, error)
+}
+
+// Sources is passed to the kernel of a block linked to more than one source,
+// in place of a single Source. It holds them in the order of the block's
+// spec, Source first, followed by ExtraSources.
+type Sources []Source
+
+func (s Sources) GetType() SourceType {
+	return NONE
+}
+
+// linkable reports whether a source of another type can be linked to a block
+// whose source type is t, as it implements the interface that t stands for
+func linkable(t SourceType, s Source) bool {
+	var ok bool
+	switch t {
+	case ANY_WRITER:
+		_, ok = s.(Writer)
+	case ANY_KEY_VALUE:
+		_, ok = s.(KeyValueSource)
+	case ANY_LIST:
+		_, ok = s.(ListSource)
+	}
+	return ok
+}
+
 // A block's BlockRouting is the set of Input and Output routes, and the Interrupt channel
 type BlockRouting struct {
 	Inputs        []Input
 	Outputs       []Output
-	Source        Source
+	Sources       []Source
 	InterruptChan chan Interrupt
 	sync.RWMutex
 }
 
 // A Block describes the block's components
 type Block struct {
-	state      BlockState
-	routing    BlockRouting
-	kernel     Kernel
-	sourceType SourceType
-	Monitor    chan MonitorMessage
-	lastCrank  time.Time
-	done       chan struct{}
+	state       BlockState
+	routing     BlockRouting
+	kernel      Kernel
+	sourceTypes []SourceType
+	variadic    *Variadic
+	reshape     Reshape
+	Monitor     chan MonitorMessage
+	lastCrank   time.Time
+	done        chan struct{}
 	//blockageTimer *time.Timer
 }
 
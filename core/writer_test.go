@@ -0,0 +1,191 @@
+package core
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriters(t *testing.T) {
+	log.Println("testing file and std writers")
+
+	dir, err := ioutil.TempDir("", "writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.log")
+	ioutil.WriteFile(path, []byte("old\n"), 0644)
+
+	fw := NewFileWriter().(*fileWriter)
+	fw.SetSourceParameter("path", path)
+	fw.SetSourceParameter("append", "false")
+	fw.SetSourceParameter("maxSize", "20")
+	fw.SetSourceParameter("gzip", "true")
+	fw.SetSourceParameter("rotateEvery", "soon")
+	go fw.Serve()
+
+	block := NewBlock(GetLibrary()["write"])
+	go block.Serve()
+	go DummyMonitor(block.Monitor)
+	if err := block.SetSource(NewKeyValue()); err == nil {
+		t.Error("write block should not link to a source that isn't a writer")
+	}
+	if err := block.SetSource(fw); err != nil {
+		t.Fatal(err)
+	}
+	written := make(chan Message)
+	block.Connect(0, written)
+	msg, _ := block.GetInput(0)
+	format, _ := block.GetInput(1)
+	write := func(m Message, f string) Message {
+		msg.C <- m
+		format.C <- f
+		return <-written
+	}
+
+	for _, w := range []struct {
+		msg    Message
+		format string
+	}{
+		{map[string]interface{}{"a": 1.0}, "ndjson"},
+		{[]interface{}{"x", 2.0, nil, true}, "csv"},
+		// this one doesn't fit, so the file is rotated first
+		{"0123456789\n", "raw"},
+	} {
+		if r := write(w.msg, w.format); r != true {
+			t.Fatal("write failed", r)
+		}
+	}
+	for _, w := range []struct {
+		msg    Message
+		format string
+	}{
+		{1.0, "raw"},
+		{"x", "csv"},
+		{"x", "xml"},
+	} {
+		if _, ok := write(w.msg, w.format).(*stcoreError); !ok {
+			t.Error("expected error writing", w.msg, "as", w.format)
+		}
+	}
+	fw.Stop()
+
+	data, _ := ioutil.ReadFile(path)
+	if string(data) != "0123456789\n" {
+		t.Error("unexpected contents after rotation", string(data))
+	}
+	rotated, _ := filepath.Glob(path + ".*.gz")
+	if len(rotated) != 1 {
+		t.Fatal("expected one gzipped rotated file", rotated)
+	}
+	f, err := os.Open(rotated[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(gz)
+	if string(data) != "{\"a\":1}\nx,2,,true\n" {
+		t.Error("unexpected contents of rotated file", string(data))
+	}
+
+	// rotate by time, appending to the existing file
+	timed := NewFileWriter().(*fileWriter)
+	timed.SetSourceParameter("path", path)
+	timed.SetSourceParameter("rotateEvery", "20ms")
+	go timed.Serve()
+	timed.Write([]byte("a\n"))
+	time.Sleep(30 * time.Millisecond)
+	timed.Write([]byte("b\n"))
+	timed.Stop()
+	data, _ = ioutil.ReadFile(path)
+	if string(data) != "b\n" {
+		t.Error("unexpected contents after timed rotation", string(data))
+	}
+	rotated, _ = filepath.Glob(path + ".*[0-9]")
+	if len(rotated) != 1 {
+		t.Fatal("expected one rotated file", rotated)
+	}
+	data, _ = ioutil.ReadFile(rotated[0])
+	if string(data) != "0123456789\na\n" {
+		t.Error("unexpected contents of timed rotated file", string(data))
+	}
+
+	// the same block can write to stdout instead
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	if err := block.SetSource(NewStdWriter()); err != nil {
+		t.Fatal(err)
+	}
+	if r := write("hello stdout\n", "raw"); r != true {
+		t.Fatal("write to stdout failed", r)
+	}
+	os.Stdout = stdout
+	w.Close()
+	data, _ = ioutil.ReadAll(r)
+	if string(data) != "hello stdout\n" {
+		t.Error("unexpected stdout", string(data))
+	}
+}
+
+func TestFileWriterCompressError(t *testing.T) {
+	log.Println("testing fileWriter compression errors")
+
+	dir, err := ioutil.TempDir("", "writer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// the rotated file fits in a 255 byte name, but not once .gz is added
+	path := filepath.Join(dir, strings.Repeat("x", 228))
+
+	fw := NewFileWriter().(*fileWriter)
+	fw.SetSourceParameter("path", path)
+	fw.SetSourceParameter("maxSize", "4")
+	fw.SetSourceParameter("gzip", "true")
+	go fw.Serve()
+
+	if _, ok := fw.State()["error"]; ok {
+		t.Error("unexpected error in state", fw.State())
+	}
+	if _, err := fw.Write([]byte("one\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fw.Write([]byte("two\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-fw.StateChanges():
+	case <-time.After(time.Second):
+		t.Fatal("no state change after compression failed")
+	}
+	if _, ok := fw.State()["error"].(string); !ok {
+		t.Error("expected compression error in state", fw.State())
+	}
+	fw.Stop()
+
+	// the rotated file is kept as it is
+	rotated, _ := filepath.Glob(path + ".*[0-9]")
+	if len(rotated) != 1 {
+		t.Fatal("expected one uncompressed rotated file", rotated)
+	}
+	data, _ := ioutil.ReadFile(rotated[0])
+	if string(data) != "one\n" {
+		t.Error("unexpected contents of rotated file", string(data))
+	}
+}
@@ -1,9 +1,20 @@
 package core
 
 import (
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	gorilla "github.com/gorilla/websocket"
+	"golang.org/x/net/websocket"
 )
 
 func TestWsClient(t *testing.T) {
@@ -119,3 +130,273 @@ func TestWsClient(t *testing.T) {
 	}
 
 }
+
+func TestWebsocketReconnect(t *testing.T) {
+
+	log.Println("testing websocket client reconnect")
+
+	defer func(base, max time.Duration) {
+		reconnectBase, reconnectMax = base, max
+	}(reconnectBase, reconnectMax)
+	reconnectBase, reconnectMax = 100*time.Millisecond, 200*time.Millisecond
+
+	// an echo server that drops the connection when asked to
+	server := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		for {
+			var msg string
+			if websocket.Message.Receive(conn, &msg) != nil || msg == "drop" {
+				conn.Close()
+				return
+			}
+			websocket.Message.Send(conn, msg)
+		}
+	}))
+	defer server.Close()
+
+	wsSource := NewWsClient()
+	ws := wsSource.(*wsClient)
+	go ws.Serve()
+	defer ws.Stop()
+
+	waitFor := func(status string) {
+		for {
+			select {
+			case <-ws.StateChanges():
+				if ws.State()["status"] == status {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("websocket client never reached status", status, ws.State())
+			}
+		}
+	}
+
+	errChan := make(chan *stcoreError, 1)
+	ws.connectChan <- connParams{
+		url:     "ws" + strings.TrimPrefix(server.URL, "http"),
+		origin:  "http://localhost",
+		errChan: errChan,
+	}
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(STATUS_CONNECTED)
+
+	if err := ws.SendMessage("drop"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(STATUS_RETRYING)
+	waitFor(STATUS_CONNECTED)
+
+	received := make(chan Message)
+	go func() {
+		msg, _, _ := ws.ReceiveMessage(make(chan Interrupt))
+		received <- msg
+	}()
+	// give the receiver a moment to subscribe
+	time.Sleep(10 * time.Millisecond)
+	if err := ws.SendMessage("hello again"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-received; msg != "hello again" {
+		t.Error("expected echo after reconnect", msg)
+	}
+	if ws.State()["url"] == nil {
+		t.Error("websocket client state should include url")
+	}
+}
+
+func TestWebsocketOptions(t *testing.T) {
+
+	log.Println("testing websocket client headers, protocols, binary and pings")
+
+	defer func(base, max time.Duration) {
+		reconnectBase, reconnectMax = base, max
+	}(reconnectBase, reconnectMax)
+	reconnectBase, reconnectMax = time.Second, time.Second
+
+	var silent int32
+	pings := make(chan struct{}, 10)
+	upgrader := gorilla.Upgrader{
+		Subprotocols: []string{"feed.v2"},
+		CheckOrigin:  func(r *http.Request) bool { return true },
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetPingHandler(func(data string) error {
+			select {
+			case pings <- struct{}{}:
+			default:
+			}
+			if atomic.LoadInt32(&silent) == 1 {
+				return nil
+			}
+			return conn.WriteControl(gorilla.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		conn.WriteMessage(gorilla.TextMessage, []byte(conn.Subprotocol()))
+		// answer once with a binary message, then stay quiet, reading only
+		// to handle pings
+		for j := 0; ; j++ {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			if j == 0 {
+				conn.WriteMessage(gorilla.BinaryMessage, []byte{0, 1, 2, 255})
+			}
+		}
+	}))
+	defer server.Close()
+
+	wsSource := NewWsClient()
+	ws := wsSource.(*wsClient)
+	go ws.Serve()
+	defer ws.Stop()
+
+	received := make(chan Message)
+	receive := func() {
+		go func() {
+			msg, _, _ := ws.ReceiveMessage(make(chan Interrupt))
+			received <- msg
+		}()
+		// give the receiver a moment to subscribe
+		time.Sleep(10 * time.Millisecond)
+	}
+	receive()
+
+	block := NewBlock(GetLibrary()["wsClientConnect"])
+	go block.Serve()
+	go DummyMonitor(block.Monitor)
+	if err := block.SetSource(ws); err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan Message)
+	block.Connect(0, connected)
+	inputs := []interface{}{
+		"http://localhost",
+		map[string]interface{}{"Authorization": "Bearer secret"},
+		[]interface{}{"feed.v1", "feed.v2"},
+		"20ms",
+		"300ms",
+	}
+	for route, v := range inputs {
+		if err := block.SetInput(RouteIndex(route+1), &InputValue{v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	urlIn, _ := block.GetInput(0)
+	urlIn.C <- "ws" + strings.TrimPrefix(server.URL, "http")
+	if r := <-connected; r != true {
+		t.Fatal("expected true from websocket connect", r)
+	}
+
+	if msg := <-received; msg != "feed.v2" {
+		t.Error("expected negotiated protocol feed.v2, got", msg)
+	}
+	receive()
+	if err := ws.SendMessage("binary please"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := <-received; !reflect.DeepEqual(msg, map[string]interface{}{"type": "binary", "data": "AAEC/w=="}) {
+		t.Error("expected binary message, got", msg)
+	}
+
+	select {
+	case <-pings:
+	case <-time.After(time.Second):
+		t.Error("server never received a ping")
+	}
+
+	// pongs keep an otherwise quiet connection past its read deadline
+	for j := 0; j < 20; j++ {
+		time.Sleep(50 * time.Millisecond)
+		if ws.State()["status"] != STATUS_CONNECTED {
+			t.Fatal("connection dropped while the server answered pings", ws.State())
+		}
+	}
+
+	// once the server stops answering pings, the read deadline drops the
+	// connection
+	atomic.StoreInt32(&silent, 1)
+	for ws.State()["status"] != STATUS_RETRYING {
+		select {
+		case <-ws.StateChanges():
+		case <-time.After(2 * time.Second):
+			t.Fatal("read deadline never dropped the connection", ws.State())
+		}
+	}
+}
+
+func TestWebsocketSlowDial(t *testing.T) {
+
+	log.Println("testing websocket client with a dial that never completes")
+
+	// a server that accepts connections but never answers the handshake
+	stuck, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	go func() {
+		for {
+			conn, err := stuck.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	server := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		io.Copy(ioutil.Discard, conn)
+	}))
+	defer server.Close()
+
+	ws := NewWsClient().(*wsClient)
+	go ws.Serve()
+
+	within := func(what string, f func()) {
+		done := make(chan struct{})
+		go func() {
+			f()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal(what, "was held up by a dial")
+		}
+	}
+	connect := func(url string) chan *stcoreError {
+		errChan := make(chan *stcoreError, 1)
+		within("connect", func() {
+			ws.connectChan <- connParams{url: url, origin: "http://localhost", errChan: errChan}
+		})
+		return errChan
+	}
+
+	first := connect("ws://" + stuck.Addr().String())
+	within("send", func() {
+		if ws.SendMessage("hello") == nil {
+			t.Error("expected send to fail while dialing")
+		}
+	})
+
+	// a new connect replaces the dial in progress
+	second := connect("ws" + strings.TrimPrefix(server.URL, "http"))
+	if err := <-second; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-first; err == nil {
+		t.Error("expected the replaced connect to fail")
+	}
+
+	connect("ws://" + stuck.Addr().String())
+	within("stop", ws.Stop)
+}
@@ -0,0 +1,136 @@
+package core
+
+import (
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWsServer(t *testing.T) {
+	log.Println("testing websocket server")
+
+	wsSource := NewWsServer()
+	ws, ok := wsSource.(Interface)
+	if !ok {
+		t.Fatal("could not assert websocket server to Interface")
+	}
+	go ws.Serve()
+	defer ws.Stop()
+
+	wss := wsSource.(*wsServer)
+	wss.SetSourceParameter("bufferSize", "1")
+	wss.SetSourceParameter("maxSize", "1024")
+	wss.SetSourceParameter("maxSize", "0")
+	if wss.Describe()[2]["value"] != "1024" {
+		t.Error("websocket server kept unexpected maxSize", wss.Describe())
+	}
+	wss.SetSourceParameter("path", "no-slash")
+	if wss.Path() != defaultWsServerPath {
+		t.Error("websocket server accepted a path without a leading slash")
+	}
+
+	server := httptest.NewServer(wss)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	library := GetLibrary()
+	send := NewBlock(library["wsServerSend"])
+	receive := NewBlock(library["wsServerReceive"])
+	for _, b := range []*Block{send, receive} {
+		go b.Serve()
+		go DummyMonitor(b.Monitor)
+		err := b.SetSource(ws)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sendIn, _ := send.GetInput(0)
+	sent := make(chan Message)
+	send.Connect(0, sent)
+	received := make(chan Message)
+	receive.Connect(0, received)
+
+	client, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// this client never reads, and must not hold up the pattern
+	slow, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+
+	// wait for both clients to register
+	for i := 0; i < 100; i++ {
+		wss.mu.Lock()
+		n := len(wss.clients)
+		wss.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sendIn.C <- map[string]interface{}{"hello": "dashboard"}
+	<-sent
+	_, msg, err := client.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != `{"hello":"dashboard"}` {
+		t.Error("websocket client received unexpected message", string(msg))
+	}
+
+	err = client.WriteMessage(websocket.TextMessage, []byte("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := (<-received).(map[string]interface{})
+	if m["msg"] != "hi" || m["client"] == "" {
+		t.Error("wsServerReceive emitted unexpected message", m)
+	}
+
+	// a client that sends more than maxSize is disconnected
+	greedy, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer greedy.Close()
+	err = greedy.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("x", 2048)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	greedy.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = greedy.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Error("expected a client sending too much to be disconnected", err)
+	}
+	select {
+	case m := <-received:
+		t.Error("wsServerReceive emitted an oversized message", m)
+	default:
+	}
+
+	big := strings.Repeat("x", 64*1024)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 200; i++ {
+			sendIn.C <- big
+			<-sent
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow websocket client stalled wsServerSend")
+	}
+}
@@ -10,6 +10,10 @@ import (
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/nytlabs/st-core/server"
+
+	// database drivers for the sql source
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 )
 
 var (
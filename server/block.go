@@ -24,18 +24,19 @@ type ProtoBlock struct {
 }
 
 type BlockLedger struct {
-	Label        string          `json:"label"`
-	Type         string          `json:"type"`
-	Id           int             `json:"id"`
-	Block        *core.Block     `json:"-"`
-	Parent       *Group          `json:"-"`
-	Composition  int             `json:"composition,omitempty"`
-	Inputs       []core.Input    `json:"inputs"`
-	Outputs      []core.Output   `json:"outputs"`
-	Source       core.SourceType `json:"source"`
-	Position     Position        `json:"position"`
-	MonitorQuery chan struct{}   `json:"-"`
-	MonitorQuit  chan struct{}   `json:"-"`
+	Label        string            `json:"label"`
+	Type         string            `json:"type"`
+	Id           int               `json:"id"`
+	Block        *core.Block       `json:"-"`
+	Parent       *Group            `json:"-"`
+	Composition  int               `json:"composition,omitempty"`
+	Inputs       []core.Input      `json:"inputs"`
+	Outputs      []core.Output     `json:"outputs"`
+	Source       core.SourceType   `json:"source"`
+	ExtraSources []core.SourceType `json:"extraSources,omitempty"`
+	Position     Position          `json:"position"`
+	MonitorQuery chan struct{}     `json:"-"`
+	MonitorQuit  chan struct{}     `json:"-"`
 }
 
 func (bl *BlockLedger) GetID() int {
@@ -145,6 +146,7 @@ func (s *Server) CreateBlock(p ProtoBlock) (*BlockLedger, error) {
 		Type:         p.Type,
 		Block:        block,
 		Source:       blockSpec.Source,
+		ExtraSources: blockSpec.ExtraSources,
 		Id:           s.GetNextID(),
 		MonitorQuit:  make(chan struct{}),
 		MonitorQuery: make(chan struct{}),
@@ -379,5 +381,116 @@ func (s *Server) ModifyBlockRoute(id int, route int, v *core.InputValue) error {
 	s.blocks[id].Inputs[route].Value = value
 
 	s.websocketBroadcast(Update{Action: UPDATE, Type: ROUTE, Data: wsRouteModify{ConnectionNode{id, route}, value}})
+
+	// some blocks change their outputs when a route value changes
+	outputs := b.Block.GetOutputs()
+	if !sameOutputs(b.Outputs, outputs) {
+		// the block has already dropped connections on its removed outputs,
+		// so all that's left is to remove them from the ledger
+		for cid, c := range s.connections {
+			if c.Source.Id == id && c.Source.Route >= len(outputs) {
+				delete(s.connections, cid)
+				s.websocketBroadcast(Update{Action: DELETE, Type: CONNECTION, Data: wsConnection{wsId{cid}}})
+			}
+		}
+		b.Outputs = outputs
+		s.websocketBroadcast(Update{Action: UPDATE, Type: BLOCK, Data: wsBlock{wsOutputs{wsId{id}, outputs}}})
+	}
+	return nil
+}
+
+func sameOutputs(a, b []core.Output) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Type != b[i].Type {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) BlockModifyInputCountHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromMux(mux.Vars(r))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, err)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, Error{"could not read request body"})
+		return
+	}
+
+	var count int
+	err = json.Unmarshal(body, &count)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, Error{"could not unmarshal value"})
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	err = s.ModifyBlockInputCount(id, count)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, Error{err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ModifyBlockInputCount resizes the variadic input group of a block to count
+// inputs, deleting any connections to the inputs that are removed.
+func (s *Server) ModifyBlockInputCount(id int, count int) error {
+	b, ok := s.blocks[id]
+	if !ok {
+		return errors.New("could not find block")
+	}
+
+	variadic := s.library[b.Type].Variadic
+	if variadic == nil {
+		return errors.New("block does not have variadic inputs")
+	}
+
+	if count < variadic.Min {
+		return errors.New("too few inputs for this block")
+	}
+
+	if count > variadic.Max {
+		return errors.New("too many inputs for this block")
+	}
+
+	total := variadic.Start + count
+
+	deleteSet := make(map[int]struct{})
+	for _, c := range s.connections {
+		if c.Target.Id == id && c.Target.Route >= total {
+			deleteSet[c.Id] = struct{}{}
+		}
+	}
+
+	for k, _ := range deleteSet {
+		err := s.DeleteConnection(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := b.Block.SetInputCount(count)
+	if err != nil {
+		return err
+	}
+
+	b.Inputs = b.Block.GetInputs()
+
+	s.websocketBroadcast(Update{Action: UPDATE, Type: BLOCK, Data: wsBlock{wsInputs{wsId{id}, b.Inputs}}})
 	return nil
 }
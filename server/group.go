@@ -11,6 +11,7 @@ import (
 
 	"github.com/google/go-github/github"
 	"github.com/gorilla/mux"
+	"github.com/nytlabs/st-core/core"
 	"golang.org/x/oauth2"
 )
 
@@ -435,7 +436,11 @@ func (s *Server) ExportGroup(id int) (*Pattern, error) {
 			continue
 		}
 		if source, ok := s.sources[c]; ok {
-			p.Sources = append(p.Sources, *source)
+			exported, err := exportSource(source)
+			if err != nil {
+				return nil, err
+			}
+			p.Sources = append(p.Sources, exported)
 			continue
 		}
 		if group, ok := s.groups[c]; ok {
@@ -453,6 +458,24 @@ func (s *Server) ExportGroup(id int) (*Pattern, error) {
 	return p, nil
 }
 
+// exportSource copies a source for a pattern. A bloom filter is only useful
+// with the members it holds, so its value is saved with its parameters.
+func exportSource(source *SourceLedger) (SourceLedger, error) {
+	exported := *source
+	store, ok := source.Source.(core.Store)
+	if !ok || source.Source.GetType() != core.BLOOM {
+		return exported, nil
+	}
+	store.Lock()
+	value, err := json.Marshal(store.Get())
+	store.Unlock()
+	if err != nil {
+		return exported, err
+	}
+	exported.Value = value
+	return exported, nil
+}
+
 func (s *Server) Export(id int) (*Pattern, error) {
 	p, err := s.ExportGroup(id)
 	if err != nil {
@@ -612,13 +635,28 @@ func (s *Server) ImportGroup(id int, p Pattern) ([]int, error) {
 
 		newIds[b.Id] = nb.Id
 		newBlocks[nb.Id] = struct{}{}
+
+		// restore the size of a variadic input group before anything is
+		// connected to it
+		if variadic := s.library[b.Type].Variadic; variadic != nil && len(b.Inputs) != len(nb.Inputs) {
+			err = s.ModifyBlockInputCount(nb.Id, len(b.Inputs)-variadic.Start)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	for _, source := range p.Sources {
+		params := make(map[string]string)
+		for _, param := range source.Parameters {
+			params[param["name"]] = param["value"]
+		}
+
 		ns, err := s.CreateSource(ProtoSource{
-			Label:    source.Label,
-			Position: source.Position,
-			Type:     source.Type,
+			Label:      source.Label,
+			Position:   source.Position,
+			Type:       source.Type,
+			Parameters: params,
 		})
 
 		if err != nil {
@@ -626,6 +664,24 @@ func (s *Server) ImportGroup(id int, p Pattern) ([]int, error) {
 		}
 
 		newIds[source.Id] = ns.Id
+
+		if len(source.Value) > 0 {
+			err = s.SetSourceValue(ns.Id, source.Value)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// route values are set before connections are made, as they can change
+	// the outputs of a block
+	for _, b := range p.Blocks {
+		for route, v := range b.Inputs {
+			err := s.ModifyBlockRoute(newIds[b.Id], route, v.Value)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	for _, c := range p.Connections {
@@ -644,6 +700,7 @@ func (s *Server) ImportGroup(id int, p Pattern) ([]int, error) {
 	for _, l := range p.Links {
 		pl := ProtoLink{}
 		pl.Block.Id = newIds[l.Block.Id]
+		pl.Block.Route = l.Block.Route
 		pl.Source.Id = newIds[l.Source.Id]
 		nl, err := s.CreateLink(pl)
 		if err != nil {
@@ -652,15 +709,6 @@ func (s *Server) ImportGroup(id int, p Pattern) ([]int, error) {
 		newIds[l.Id] = nl.Id
 	}
 
-	for _, b := range p.Blocks {
-		for route, v := range b.Inputs {
-			err := s.ModifyBlockRoute(newIds[b.Id], route, v.Value)
-			if err != nil {
-				return nil, err
-			}
-		}
-	}
-
 	assigned := make(map[int]struct{})
 
 	for _, g := range p.Groups {
@@ -7,6 +7,7 @@ import (
 	"net/http"
 
 	"github.com/gorilla/mux"
+	"github.com/nytlabs/st-core/core"
 )
 
 type LinkLedger struct {
@@ -14,7 +15,8 @@ type LinkLedger struct {
 		Id int `json:"id"`
 	} `json:"source"` // the soure id
 	Block struct {
-		Id int `json:"id"`
+		Id    int `json:"id"`
+		Route int `json:"route"` // which of the block's sources
 	} `json:"block"` // the block id
 	Id int `json:"id"` // link id
 }
@@ -24,7 +26,8 @@ type ProtoLink struct {
 		Id int `json:"id"`
 	} `json:"source"` // the soure id
 	Block struct {
-		Id int `json:"id"`
+		Id    int `json:"id"`
+		Route int `json:"route"` // which of the block's sources
 	} `json:"block"` // the block id
 }
 
@@ -43,8 +46,9 @@ func (s *Server) CreateLink(l ProtoLink) (*LinkLedger, error) {
 	link.Id = s.GetNextID()
 	link.Source.Id = l.Source.Id
 	link.Block.Id = l.Block.Id
+	link.Block.Route = l.Block.Route
 
-	err := b.Block.SetSource(sl.Source)
+	err := b.Block.SetSourceAt(core.RouteIndex(l.Block.Route), sl.Source)
 	if err != nil {
 		return nil, err
 	}
@@ -66,7 +70,7 @@ func (s *Server) DeleteLink(id int) error {
 	if !ok {
 		return errors.New("could not find block")
 	}
-	block.Block.SetSource(nil)
+	block.Block.SetSourceAt(core.RouteIndex(link.Block.Route), nil)
 	delete(s.links, id)
 
 	s.websocketBroadcast(Update{Action: DELETE, Type: LINK, Data: wsLink{wsId{id}}})
@@ -60,3 +60,16 @@ func (s *Server) MonitorMux(id int, c chan core.MonitorMessage, query chan struc
 		}
 	}
 }
+
+// SourceMonitor emits the state of a stateful source, such as a connection
+// that is retrying, over websocket whenever it changes.
+func (s *Server) SourceMonitor(id int, source core.Stateful, quit chan struct{}) {
+	for {
+		select {
+		case <-source.StateChanges():
+			s.websocketBroadcast(Update{Action: INFO, Type: SOURCE, Data: wsSource{wsSourceState{wsId{id}, source.State()}}})
+		case <-quit:
+			return
+		}
+	}
+}
@@ -147,6 +147,12 @@ func (s *Server) NewRouter() *mux.Router {
 			"PUT",
 			s.BlockModifyRouteHandler,
 		},
+		Route{
+			"BlockModifyInputCount",
+			"/blocks/{id}/inputs",
+			"PUT",
+			s.BlockModifyInputCountHandler,
+		},
 		Route{
 			"BlockModifyPosition",
 			"/blocks/{id}/position",
@@ -219,6 +225,36 @@ func (s *Server) NewRouter() *mux.Router {
 			"PUT",
 			s.SourceSetValueHandler,
 		},
+		Route{
+			"SourceGetSnapshots",
+			"/sources/{id}/snapshots",
+			"GET",
+			s.SourceGetSnapshotsHandler,
+		},
+		Route{
+			"SourceCreateSnapshot",
+			"/sources/{id}/snapshots",
+			"POST",
+			s.SourceCreateSnapshotHandler,
+		},
+		Route{
+			"SourceRestore",
+			"/sources/{id}/restore",
+			"POST",
+			s.SourceRestoreHandler,
+		},
+		Route{
+			"SourceGetState",
+			"/sources/{id}/state",
+			"GET",
+			s.SourceGetStateHandler,
+		},
+		Route{
+			"SourceModifyParams",
+			"/sources/{id}/params",
+			"PUT",
+			s.SourceModifyParamsHandler,
+		},
 		Route{
 			"Source",
 			"/sources/{id}",
@@ -264,6 +300,19 @@ func (s *Server) NewRouter() *mux.Router {
 			Handler(handler)
 	}
 
+	// ingress accepts any method, so it is routed outside of the table above
+	router.
+		Path("/ingress/{name}").
+		Name("Ingress").
+		Handler(Logger(http.HandlerFunc(s.IngressHandler), "Ingress"))
+
+	// sources such as wsServer choose their own path, so they are matched
+	// after the API but before static files
+	router.
+		MatcherFunc(s.matchMountedSource).
+		Name("MountedSource").
+		Handler(Logger(http.HandlerFunc(s.MountedSourceHandler), "MountedSource"))
+
 	router.PathPrefix("/").Handler(http.FileServer(http.Dir("./static/")))
 
 	return router
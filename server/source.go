@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/nytlabs/st-core/core"
@@ -12,14 +13,16 @@ import (
 )
 
 type SourceLedger struct {
-	Label      string              `json:"label"`
-	Type       string              `json:"type"`
-	Id         int                 `json:"id"`
-	Source     core.Source         `json:"-"`
-	Parent     *Group              `json:"-"`
-	Token      suture.ServiceToken `json:"-"`
-	Position   Position            `json:"position"`
-	Parameters []map[string]string `json:"params"`
+	Label       string              `json:"label"`
+	Type        string              `json:"type"`
+	Id          int                 `json:"id"`
+	Source      core.Source         `json:"-"`
+	Parent      *Group              `json:"-"`
+	Token       suture.ServiceToken `json:"-"`
+	Position    Position            `json:"position"`
+	Parameters  []map[string]string `json:"params"`
+	Value       json.RawMessage     `json:"value,omitempty"` // only set in patterns
+	MonitorQuit chan struct{}       `json:"-"`
 }
 
 type ProtoSource struct {
@@ -97,10 +100,22 @@ func (s *Server) CreateSource(p ProtoSource) (*SourceLedger, error) {
 		Parameters: make([]map[string]string, 0), // this will get overwritten if we have parameters
 	}
 
+	if ps, ok := source.(core.Parameterized); ok {
+		for name, value := range p.Parameters {
+			ps.SetSourceParameter(name, value)
+		}
+		sl.Parameters = ps.Describe()
+	}
+
 	if i, ok := source.(core.Interface); ok {
 		go i.Serve()
 	}
 
+	if ss, ok := source.(core.Stateful); ok {
+		sl.MonitorQuit = make(chan struct{})
+		go s.SourceMonitor(sl.Id, ss, sl.MonitorQuit)
+	}
+
 	s.sources[sl.Id] = sl
 	s.websocketBroadcast(Update{Action: CREATE, Type: SOURCE, Data: wsSource{*sl}})
 
@@ -132,6 +147,10 @@ func (s *Server) DeleteSource(id int) error {
 		si.Stop()
 	}
 
+	if source.MonitorQuit != nil {
+		close(source.MonitorQuit)
+	}
+
 	s.DetachChild(source)
 
 	s.websocketBroadcast(Update{Action: DELETE, Type: SOURCE, Data: wsSource{wsId{id}}})
@@ -200,7 +219,7 @@ func (s *Server) SourceGetValueHandler(w http.ResponseWriter, r *http.Request) {
 	s.Lock()
 	defer s.Unlock()
 
-	val, err := s.GetSourceValue(id)
+	val, err := s.GetSourceValue(id, r.URL.Query().Get("ttl") == "true")
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		writeJSON(w, Error{err.Error()})
@@ -212,6 +231,35 @@ func (s *Server) SourceGetValueHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(val)
 }
 
+func (s *Server) SourceGetStateHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromMux(mux.Vars(r))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, err)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	source, ok := s.sources[id]
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, Error{"source does not exist"})
+		return
+	}
+
+	ss, ok := source.Source.(core.Stateful)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, Error{"source does not have state"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, ss.State())
+}
+
 func (s *Server) SourceModifyPositionHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := getIDFromMux(mux.Vars(r))
 	if err != nil {
@@ -290,6 +338,70 @@ func (s *Server) SourceModifyNameHandler(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (s *Server) SourceModifyParamsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromMux(mux.Vars(r))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, err)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, Error{"could not read request body"})
+		return
+	}
+
+	var params []map[string]string
+	err = json.Unmarshal(body, &params)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, Error{"could not read JSON"})
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, p := range params {
+		err = s.ModifySourceParameter(id, p["name"], p["value"])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, Error{err.Error()})
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ModifySourceParameter sets a parameter on a running source. Sources ignore
+// values they can't use, so the value broadcast is the one the source reports.
+func (s *Server) ModifySourceParameter(id int, name, value string) error {
+	source, ok := s.sources[id]
+	if !ok {
+		return errors.New("source does not exist")
+	}
+
+	ps, ok := source.Source.(core.Parameterized)
+	if !ok {
+		return errors.New("source does not have parameters")
+	}
+
+	ps.SetSourceParameter(name, value)
+	source.Parameters = ps.Describe()
+
+	for _, p := range source.Parameters {
+		if p["name"] == name {
+			s.websocketBroadcast(Update{Action: UPDATE, Type: PARAM, Data: wsSourceModify{wsId{id}, name, p["value"]}})
+			return nil
+		}
+	}
+
+	return errors.New("source has no parameter " + name)
+}
+
 func (s *Server) SourceSetValueHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := getIDFromMux(mux.Vars(r))
 	if err != nil {
@@ -318,7 +430,10 @@ func (s *Server) SourceSetValueHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (s *Server) GetSourceValue(id int) ([]byte, error) {
+// GetSourceValue returns the value of a store. If ttl is set, the value is
+// returned under "value" alongside the seconds each expiring entry has left
+// under "ttl".
+func (s *Server) GetSourceValue(id int, ttl bool) ([]byte, error) {
 	source, ok := s.sources[id]
 	if !ok {
 		return nil, errors.New("source does not exist")
@@ -331,7 +446,25 @@ func (s *Server) GetSourceValue(id int) ([]byte, error) {
 
 	store.Lock()
 	defer store.Unlock()
-	out, err := json.Marshal(store.Get())
+	var value interface{} = store.Get()
+	if err, ok := value.(error); ok {
+		return nil, err
+	}
+	if ttl {
+		expiring, ok := store.(core.Expiring)
+		if !ok {
+			return nil, errors.New("source does not have TTLs")
+		}
+		ttls := make(map[string]float64)
+		for k, d := range expiring.TTLs() {
+			ttls[k] = d.Seconds()
+		}
+		value = map[string]interface{}{
+			"value": value,
+			"ttl":   ttls,
+		}
+	}
+	out, err := json.Marshal(value)
 	if err != nil {
 		return nil, err
 	}
@@ -365,3 +498,209 @@ func (s *Server) SetSourceValue(id int, body []byte) error {
 
 	return nil
 }
+
+// Snapshot is the time a snapshot of a store was taken
+type Snapshot struct {
+	Time time.Time `json:"time"`
+}
+
+func (s *Server) snapshotter(id int) (core.Snapshotter, error) {
+	source, ok := s.sources[id]
+	if !ok {
+		return nil, errors.New("source does not exist")
+	}
+
+	store, ok := source.Source.(core.Snapshotter)
+	if !ok {
+		return nil, errors.New("source does not have snapshots")
+	}
+	return store, nil
+}
+
+func (s *Server) GetSourceSnapshots(id int) ([]Snapshot, error) {
+	store, err := s.snapshotter(id)
+	if err != nil {
+		return nil, err
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	times, err := store.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []Snapshot{}
+	for _, t := range times {
+		snapshots = append(snapshots, Snapshot{t})
+	}
+	return snapshots, nil
+}
+
+func (s *Server) CreateSourceSnapshot(id int) (Snapshot, error) {
+	store, err := s.snapshotter(id)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	t, err := store.Snapshot()
+	return Snapshot{t}, err
+}
+
+// RestoreSource restores the latest snapshot taken at or before the time in
+// body, or the latest snapshot if body is empty
+func (s *Server) RestoreSource(id int, body []byte) (Snapshot, error) {
+	store, err := s.snapshotter(id)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	at := Snapshot{time.Now()}
+	if len(body) > 0 {
+		err = json.Unmarshal(body, &at)
+		if err != nil {
+			return Snapshot{}, err
+		}
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	t, err := store.Restore(at.Time)
+	return Snapshot{t}, err
+}
+
+func (s *Server) SourceGetSnapshotsHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromMux(mux.Vars(r))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, err)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	snapshots, err := s.GetSourceSnapshots(id)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, Error{err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, snapshots)
+}
+
+func (s *Server) SourceCreateSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromMux(mux.Vars(r))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, err)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	snapshot, err := s.CreateSourceSnapshot(id)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, Error{err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, snapshot)
+}
+
+func (s *Server) SourceRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := getIDFromMux(mux.Vars(r))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, err)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, Error{"could not read request body"})
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	snapshot, err := s.RestoreSource(id, body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeJSON(w, Error{err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, snapshot)
+}
+
+// IngressHandler passes requests on /ingress/{name} to the httpIngress source
+// labelled name. The request is served without holding the server lock, as it
+// stays open until the pattern responds.
+func (s *Server) IngressHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	var ingress *core.HTTPIngress
+	s.Lock()
+	for _, source := range s.sources {
+		if h, ok := source.Source.(*core.HTTPIngress); ok && source.Label == name {
+			ingress = h
+			break
+		}
+	}
+	s.Unlock()
+
+	if ingress == nil {
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, Error{"could not find ingress " + name})
+		return
+	}
+
+	ingress.ServeHTTP(w, r)
+}
+
+// mountedSource is a source that serves HTTP on a path of its choosing, such
+// as a websocket server.
+type mountedSource interface {
+	core.Source
+	http.Handler
+	Path() string
+}
+
+// findMountedSource returns the source mounted on path, if there is one
+func (s *Server) findMountedSource(path string) mountedSource {
+	s.Lock()
+	defer s.Unlock()
+	for _, source := range s.sources {
+		if ms, ok := source.Source.(mountedSource); ok && ms.Path() == path {
+			return ms
+		}
+	}
+	return nil
+}
+
+func (s *Server) matchMountedSource(r *http.Request, rm *mux.RouteMatch) bool {
+	return s.findMountedSource(r.URL.Path) != nil
+}
+
+// MountedSourceHandler passes the request to the source mounted on its path.
+// Like ingress, it is served without holding the server lock.
+func (s *Server) MountedSourceHandler(w http.ResponseWriter, r *http.Request) {
+	ms := s.findMountedSource(r.URL.Path)
+	if ms == nil {
+		w.WriteHeader(http.StatusNotFound)
+		writeJSON(w, Error{"could not find source on " + r.URL.Path})
+		return
+	}
+	ms.ServeHTTP(w, r)
+}
@@ -26,6 +26,16 @@ type wsPosition struct {
 	Position Position `json:"position"`
 }
 
+type wsInputs struct {
+	wsId
+	Inputs []core.Input `json:"inputs"`
+}
+
+type wsOutputs struct {
+	wsId
+	Outputs []core.Output `json:"outputs"`
+}
+
 // type BLOCK
 type wsBlock struct {
 	Block interface{} `json:"block"`
@@ -70,6 +80,11 @@ type wsGroupRouteModify struct {
 	IsVisible bool      `json:"isVisible"`
 }
 
+type wsSourceState struct {
+	wsId
+	State map[string]interface{} `json:"state"`
+}
+
 // type PARAM
 type wsSourceModify struct {
 	wsId
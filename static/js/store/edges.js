@@ -169,7 +169,7 @@ var app = app || {};
 
     function Link(data) {
         this.routeIdFrom = 'source_' + data.source.id + '_0_output';
-        this.routeIdTo = 'source_' + data.block.id + '_0_input';
+        this.routeIdTo = 'source_' + data.block.id + '_' + (data.block.route || 0) + '_input';
         this.idFrom = data.source.id;
         this.idTo = data.block.id;
         Edge.call(this, data);
@@ -282,7 +282,8 @@ var app = app || {};
                         'id': from.blockId,
                     },
                     'block': {
-                        'id': to.blockId
+                        'id': to.blockId,
+                        'route': to.index
                     }
                 },
                 null);
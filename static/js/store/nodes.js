@@ -643,23 +643,26 @@ var app = app || {};
             nodes[node.id].addRoute(id);
         })
 
-        // if this block is associated with a source
+        // if this block is associated with sources, one route for each
         if (nodes[node.id].data.source !== null) {
-            var id = 'source_' + node.id + '_0_input';
-            app.Dispatcher.dispatch({
-                action: app.Actions.APP_ROUTE_CREATE,
-                id: id,
-                blockId: node.id,
-                index: 0,
-                direction: 'input',
-                data: {
-                    name: nodes[node.id].data.source,
-                    type: 'any',
-                    value: null
-                },
-                source: nodes[node.id].data.source
+            var sources = [nodes[node.id].data.source].concat(nodes[node.id].data.extraSources || []);
+            sources.forEach(function(source, i) {
+                var id = 'source_' + node.id + '_' + i + '_input';
+                app.Dispatcher.dispatch({
+                    action: app.Actions.APP_ROUTE_CREATE,
+                    id: id,
+                    blockId: node.id,
+                    index: i,
+                    direction: 'input',
+                    data: {
+                        name: source,
+                        type: 'any',
+                        value: null
+                    },
+                    source: source
+                })
+                nodes[node.id].addRoute(id);
             })
-            nodes[node.id].addRoute(id);
         }
 
         nodes[node.id].render();